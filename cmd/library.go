@@ -0,0 +1,58 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+// libraryCmd groups the commands of the .strm and NFO library.
+var libraryCmd = &cobra.Command{
+	Use:   "library",
+	Short: "File library of the xtream movies and series for Kodi, Jellyfin and Emby",
+}
+
+// libraryExportCmd exports the library once, e.g from a cron job when the proxy doesn't run the export itself.
+var libraryExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the .strm and NFO files of the movies and series to --library-dir",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		stats, err := server.ExportLibrary(ctx, loadProxyConfig())
+		if err != nil {
+			log.Fatalf("[iptv-proxy] Error: %v", err)
+		}
+
+		log.Printf("[iptv-proxy] library exported: %d written, %d unchanged, %d removed, %d failed", stats.Written, stats.Unchanged, stats.Removed, stats.Failed)
+	},
+}
+
+func init() {
+	libraryCmd.AddCommand(libraryExportCmd)
+	rootCmd.AddCommand(libraryCmd)
+}
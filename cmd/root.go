@@ -31,6 +31,7 @@ import (
 	"time"
 
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/rules"
 
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/server"
 
@@ -52,65 +53,7 @@ var rootCmd = &cobra.Command{
 
 		log.Printf("[iptv-proxy] Server is starting...")
 
-		m3uURL := viper.GetString("m3u-url")
-		remoteHostURL, err := url.Parse(m3uURL)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		xtreamUser := viper.GetString("xtream-user")
-		xtreamPassword := viper.GetString("xtream-password")
-		xtreamBaseURL := viper.GetString("xtream-base-url")
-
-		var username, password string
-		if strings.Contains(m3uURL, "/get.php") {
-			username = remoteHostURL.Query().Get("username")
-			password = remoteHostURL.Query().Get("password")
-		}
-
-		if xtreamBaseURL == "" && xtreamPassword == "" && xtreamUser == "" {
-			if username != "" && password != "" {
-				log.Printf("[iptv-proxy] INFO: It's seams you are using an Xtream provider!")
-
-				xtreamUser = username
-				xtreamPassword = password
-				xtreamBaseURL = fmt.Sprintf("%s://%s", remoteHostURL.Scheme, remoteHostURL.Host)
-				log.Printf("[iptv-proxy] INFO: xtream service enable with xtream base url: %q xtream username: %q xtream password: %q", xtreamBaseURL, xtreamUser, xtreamPassword)
-			}
-		}
-
-		config.DebugLoggingEnabled = viper.GetBool("debug-logging")
-		config.CacheFolder = viper.GetString("cache-folder")
-		if config.CacheFolder != "" {
-			// Ensure CacheFolder ends with a '/'
-			if config.CacheFolder != "" && !strings.HasSuffix(config.CacheFolder, "/") {
-				config.CacheFolder += "/"
-			}
-		}
-
-		conf := &config.ProxyConfig{
-			HostConfig: &config.HostConfiguration{
-				Hostname: viper.GetString("hostname"),
-				Port:     viper.GetInt("port"),
-			},
-			RemoteURL:            remoteHostURL,
-			XtreamUser:           config.CredentialString(xtreamUser),
-			XtreamPassword:       config.CredentialString(xtreamPassword),
-			XtreamBaseURL:        xtreamBaseURL,
-			M3UCacheExpiration:   viper.GetInt("m3u-cache-expiration"),
-			User:                 config.CredentialString(viper.GetString("user")),
-			Password:             config.CredentialString(viper.GetString("password")),
-			AdvertisedPort:       viper.GetInt("advertised-port"),
-			HTTPS:                viper.GetBool("https"),
-			M3UFileName:          viper.GetString("m3u-file-name"),
-			CustomEndpoint:       viper.GetString("custom-endpoint"),
-			CustomId:             viper.GetString("custom-id"),
-			XtreamGenerateApiGet: viper.GetBool("xtream-api-get"),
-		}
-
-		if conf.AdvertisedPort == 0 {
-			conf.AdvertisedPort = conf.HostConfig.Port
-		}
+		conf := loadProxyConfig()
 
 		srv, err := server.NewServer(conf)
 		if err != nil {
@@ -144,6 +87,192 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// loadProxyConfig returns the configuration of the flags, the environment and the config file.
+func loadProxyConfig() *config.ProxyConfig {
+	config.DebugLoggingEnabled = viper.GetBool("debug-logging")
+	config.CacheFolder = viper.GetString("cache-folder")
+	if config.CacheFolder != "" {
+		// Ensure CacheFolder ends with a '/'
+		if config.CacheFolder != "" && !strings.HasSuffix(config.CacheFolder, "/") {
+			config.CacheFolder += "/"
+		}
+	}
+
+	sources, err := loadSources()
+	if err != nil {
+		log.Fatalf("[iptv-proxy] Error: %v", err)
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		log.Fatalf("[iptv-proxy] Error: %v", err)
+	}
+
+	var playlistRules *rules.Rules
+	if rulesFile := viper.GetString("playlist-rules-file"); rulesFile != "" {
+		if playlistRules, err = rules.Load(rulesFile); err != nil {
+			log.Fatalf("[iptv-proxy] Error: %v", err)
+		}
+	}
+
+	var failoverChannels []config.FailoverChannel
+	if failoverFile := viper.GetString("failover-file"); failoverFile != "" {
+		if failoverChannels, err = config.LoadFailoverChannels(failoverFile); err != nil {
+			log.Fatalf("[iptv-proxy] Error: %v", err)
+		}
+	}
+
+	var epgConfig *config.EPGConfig
+	if epgFile := viper.GetString("epg-file"); epgFile != "" {
+		if epgConfig, err = config.LoadEPGConfig(epgFile); err != nil {
+			log.Fatalf("[iptv-proxy] Error: %v", err)
+		}
+	}
+
+	apiCacheTTLs, err := loadAPICacheTTLs()
+	if err != nil {
+		log.Fatalf("[iptv-proxy] Error: %v", err)
+	}
+
+	conf := &config.ProxyConfig{
+		HostConfig: &config.HostConfiguration{
+			Hostname: viper.GetString("hostname"),
+			Port:     viper.GetInt("port"),
+		},
+		Sources:                sources,
+		M3UCacheExpiration:     viper.GetInt("m3u-cache-expiration"),
+		M3URefreshInterval:     viper.GetInt("m3u-refresh-interval"),
+		Users:                  users,
+		PlaylistRules:          playlistRules,
+		FailoverChannels:       failoverChannels,
+		FailoverTimeout:        viper.GetInt("failover-timeout"),
+		LiveFanout:             viper.GetBool("live-fanout"),
+		FanoutGracePeriod:      viper.GetInt("fanout-grace-period"),
+		FanoutBufferSize:       viper.GetInt("fanout-buffer-size"),
+		ConnectionQueueTimeout: viper.GetInt("connection-queue-timeout"),
+		HLSSigningKey:          viper.GetString("hls-signing-key"),
+		CacheURL:               viper.GetString("cache-url"),
+		APICacheExpiration:     viper.GetInt("api-cache-expiration"),
+		APICacheTTLs:           apiCacheTTLs,
+		APICacheStale:          viper.GetInt("api-cache-stale"),
+		EPG:                    epgConfig,
+		EPGMatchTvgIDs:         viper.GetBool("epg-match-tvg-ids"),
+		EPGCacheDir:            viper.GetString("epg-cache-dir"),
+		EPGRefreshInterval:     viper.GetInt("epg-refresh-interval"),
+		HDHomeRun:              viper.GetBool("hdhomerun"),
+		HDHomeRunUser:          viper.GetString("hdhomerun-user"),
+		HDHomeRunTuners:        viper.GetInt("hdhomerun-tuners"),
+		SSDP:                   viper.GetBool("ssdp"),
+		LibraryDir:             viper.GetString("library-dir"),
+		LibraryUser:            viper.GetString("library-user"),
+		LibraryRefreshInterval: viper.GetInt("library-refresh-interval"),
+		DVRDir:                 viper.GetString("dvr-dir"),
+		DVRPaddingStart:        viper.GetInt("dvr-padding-start"),
+		DVRPaddingEnd:          viper.GetInt("dvr-padding-end"),
+		AdvertisedPort:         viper.GetInt("advertised-port"),
+		HTTPS:                  viper.GetBool("https"),
+		M3UFileName:            viper.GetString("m3u-file-name"),
+		CustomEndpoint:         viper.GetString("custom-endpoint"),
+		CustomId:               viper.GetString("custom-id"),
+		XtreamGenerateApiGet:   viper.GetBool("xtream-api-get"),
+	}
+
+	if conf.AdvertisedPort == 0 {
+		conf.AdvertisedPort = conf.HostConfig.Port
+	}
+
+	return conf
+}
+
+// loadSources returns the sources of the sources file,
+// or the m3u and xtream sources of the m3u-url and xtream-* flags if there is no sources file.
+func loadSources() ([]*config.Source, error) {
+	if sourcesFile := viper.GetString("sources-file"); sourcesFile != "" {
+		return config.LoadSources(sourcesFile)
+	}
+
+	m3uURL := viper.GetString("m3u-url")
+	remoteHostURL, err := url.Parse(m3uURL)
+	if err != nil {
+		return nil, err
+	}
+
+	xtreamUser := viper.GetString("xtream-user")
+	xtreamPassword := viper.GetString("xtream-password")
+	xtreamBaseURL := viper.GetString("xtream-base-url")
+
+	var username, password string
+	if strings.Contains(m3uURL, "/get.php") {
+		username = remoteHostURL.Query().Get("username")
+		password = remoteHostURL.Query().Get("password")
+	}
+
+	if xtreamBaseURL == "" && xtreamPassword == "" && xtreamUser == "" {
+		if username != "" && password != "" {
+			log.Printf("[iptv-proxy] INFO: It's seams you are using an Xtream provider!")
+
+			xtreamUser = username
+			xtreamPassword = password
+			xtreamBaseURL = fmt.Sprintf("%s://%s", remoteHostURL.Scheme, remoteHostURL.Host)
+			log.Printf("[iptv-proxy] INFO: xtream service enable with xtream base url: %q xtream username: %q xtream password: %q", xtreamBaseURL, xtreamUser, xtreamPassword)
+		}
+	}
+
+	xtream := config.Source{
+		Name:           "xtream",
+		M3UURL:         m3uURL,
+		XtreamBaseURL:  xtreamBaseURL,
+		XtreamUser:     config.CredentialString(xtreamUser),
+		XtreamPassword: config.CredentialString(xtreamPassword),
+		EPGShift:       viper.GetDuration("epg-shift"),
+		MaxConnections: viper.GetInt("max-connections"),
+	}
+	if xtream.M3UIsXtreamGet() {
+		// The m3u is the get.php of the xtream account.
+		return config.NewSources(xtream)
+	}
+	xtream.M3UURL = ""
+
+	var sources []config.Source
+	if xtreamBaseURL != "" {
+		sources = append(sources, xtream)
+	}
+	if m3uURL != "" {
+		sources = append(sources, config.Source{Name: "m3u", M3UURL: m3uURL, EPGURLs: viper.GetStringSlice("epg-url"), EPGShift: viper.GetDuration("epg-shift"), MaxConnections: viper.GetInt("max-connections")})
+	}
+
+	return config.NewSources(sources...)
+}
+
+// loadAPICacheTTLs parses the freshness of the player_api responses by action.
+func loadAPICacheTTLs() (map[string]time.Duration, error) {
+	ttls := map[string]time.Duration{}
+	for action, value := range viper.GetStringMapString("api-cache-ttl") {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("api cache ttl of %q: %w", action, err)
+		}
+		ttls[action] = ttl
+	}
+
+	return ttls, nil
+}
+
+// loadUsers returns the accounts of the users file,
+// or the single user/password account if there is no users file.
+func loadUsers() (*config.UserStore, error) {
+	if usersFile := viper.GetString("users-file"); usersFile != "" {
+		return config.LoadUsers(usersFile)
+	}
+
+	// The single account is the one of the operator.
+	return config.NewUserStore(config.User{
+		Username: config.CredentialString(viper.GetString("user")),
+		Password: config.CredentialString(viper.GetString("password")),
+		Admin:    true,
+	})
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -160,23 +289,55 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "iptv-proxy-config", "C", "Config file (default is $HOME/.iptv-proxy.yaml)")
-	rootCmd.Flags().StringP("m3u-url", "u", "", `Iptv m3u file or url e.g: "http://example.com/iptv.m3u"`)
-	rootCmd.Flags().StringP("m3u-file-name", "", "iptv.m3u", `Name of the new proxified m3u file e.g "http://poxy.com/iptv.m3u"`)
-	rootCmd.Flags().StringP("custom-endpoint", "", "", `Custom endpoint "http://poxy.com/<custom-endpoint>/iptv.m3u"`)
-	rootCmd.Flags().StringP("custom-id", "", "", `Custom anti-collison ID for each track "http://proxy.com/<custom-id>/..."`)
-	rootCmd.Flags().Int("port", 8080, "Iptv-proxy listening port")
-	rootCmd.Flags().Int("advertised-port", 0, "Port to expose the IPTV file and xtream (by default, it's taking value from port) useful to put behind a reverse proxy")
-	rootCmd.Flags().String("hostname", "", "Hostname or IP to expose the IPTVs endpoints")
-	rootCmd.Flags().BoolP("https", "", false, "Activate https for urls proxy")
-	rootCmd.Flags().String("user", "usertest", "User auth to access proxy (m3u/xtream)")
-	rootCmd.Flags().String("password", "passwordtest", "Password auth to access proxy (m3u/xtream)")
-	rootCmd.Flags().String("xtream-user", "", "Xtream-code user login")
-	rootCmd.Flags().String("xtream-password", "", "Xtream-code password login")
-	rootCmd.Flags().String("xtream-base-url", "", "Xtream-code base url e.g(http://expample.tv:8080)")
-	rootCmd.Flags().Int("m3u-cache-expiration", 1, "M3U cache expiration in hour")
-	rootCmd.Flags().BoolP("xtream-api-get", "", false, "Generate get.php from xtream API instead of get.php original endpoint")
-
-	if e := viper.BindPFlags(rootCmd.Flags()); e != nil {
+	rootCmd.PersistentFlags().StringP("m3u-url", "u", "", `Iptv m3u file or url e.g: "http://example.com/iptv.m3u"`)
+	rootCmd.PersistentFlags().StringP("m3u-file-name", "", "iptv.m3u", `Name of the new proxified m3u file e.g "http://poxy.com/iptv.m3u"`)
+	rootCmd.PersistentFlags().StringP("custom-endpoint", "", "", `Custom endpoint "http://poxy.com/<custom-endpoint>/iptv.m3u"`)
+	rootCmd.PersistentFlags().StringP("custom-id", "", "", `Custom anti-collison ID for each track "http://proxy.com/<custom-id>/..."`)
+	rootCmd.PersistentFlags().Int("port", 8080, "Iptv-proxy listening port")
+	rootCmd.PersistentFlags().Int("advertised-port", 0, "Port to expose the IPTV file and xtream (by default, it's taking value from port) useful to put behind a reverse proxy")
+	rootCmd.PersistentFlags().String("hostname", "", "Hostname or IP to expose the IPTVs endpoints")
+	rootCmd.PersistentFlags().BoolP("https", "", false, "Activate https for urls proxy")
+	rootCmd.PersistentFlags().String("user", "usertest", "User auth to access proxy (m3u/xtream)")
+	rootCmd.PersistentFlags().String("password", "passwordtest", "Password auth to access proxy (m3u/xtream)")
+	rootCmd.PersistentFlags().String("users-file", "", "YAML/JSON file with the proxy accounts (replaces user and password)")
+	rootCmd.PersistentFlags().String("playlist-rules-file", "", "YAML/JSON file with the rules filtering and rewriting the proxyfied m3u tracks")
+	rootCmd.PersistentFlags().String("sources-file", "", "YAML/JSON file with the m3u and xtream upstream sources (replaces m3u-url and xtream-*)")
+	rootCmd.PersistentFlags().String("failover-file", "", "YAML/JSON file grouping the m3u tracks of a same channel with alternative urls")
+	rootCmd.PersistentFlags().Int("failover-timeout", 10, "Seconds to wait for the first bytes of a stream before trying its next alternative url (0 to disable)")
+	rootCmd.PersistentFlags().Bool("live-fanout", false, "Share one upstream connection between the viewers of a same live MPEG-TS channel")
+	rootCmd.PersistentFlags().Int("fanout-grace-period", 10, "Seconds to keep a shared live upstream connection open after its last viewer left")
+	rootCmd.PersistentFlags().Int("fanout-buffer-size", 4, "Size in MiB of the buffer of a shared live channel")
+	rootCmd.PersistentFlags().Int("max-connections", 0, "Maximum concurrent upstream streams of the account (0 for the limit announced by the xtream account, -1 for no limit)")
+	rootCmd.PersistentFlags().String("cache-url", "", "Cache of the generated playlists and API responses, e.g redis://localhost:6379/0 to share it between replicas (in memory if empty)")
+	rootCmd.PersistentFlags().Int("api-cache-expiration", 5, "Minutes the player_api responses stay fresh in the cache (0 to disable)")
+	rootCmd.PersistentFlags().StringToString("api-cache-ttl", nil, "Freshness of the player_api responses by action, e.g get_live_streams=10m,get_vod_streams=2h (defaults from 10m for the live streams to 6h for the vod infos, other actions use --api-cache-expiration)")
+	rootCmd.PersistentFlags().Int("api-cache-stale", 1440, "Minutes an expired player_api response is still served while it is refreshed in background")
+	rootCmd.PersistentFlags().String("epg-file", "", "YAML/JSON file with XMLTV guides merged into the guide of the sources, and the channel ID mapping")
+	rootCmd.PersistentFlags().StringSlice("epg-url", nil, "XMLTV urls or files of the m3u, replacing the url-tvg of its header")
+	rootCmd.PersistentFlags().Duration("epg-shift", 0, "Shift the programme times of the guide of the sources, e.g -1h when the programmes are shown an hour too late")
+	rootCmd.PersistentFlags().Bool("epg-match-tvg-ids", false, "Fill the missing tvg-ids of the playlists with the guide channels of the same name")
+	rootCmd.PersistentFlags().String("epg-cache-dir", "", "Directory of the cached XMLTV guide, kept between restarts (in the temp directory if empty)")
+	rootCmd.PersistentFlags().Int("epg-refresh-interval", 12, "Download the XMLTV guide again every N hours")
+	rootCmd.PersistentFlags().Bool("hdhomerun", false, "Serve the playlist as an HDHomeRun tuner for the Live TV of Plex, Jellyfin and Emby")
+	rootCmd.PersistentFlags().String("hdhomerun-user", "", "Account whose playlist is served by the HDHomeRun tuner, required with --hdhomerun")
+	rootCmd.PersistentFlags().Int("hdhomerun-tuners", 2, "Number of concurrent streams of the HDHomeRun tuner")
+	rootCmd.PersistentFlags().Bool("ssdp", false, "Advertise the HDHomeRun tuner on the LAN with SSDP, requires --hdhomerun")
+	rootCmd.PersistentFlags().String("library-dir", "", "Folder of the .strm and NFO library of the xtream movies and series (disabled if empty)")
+	rootCmd.PersistentFlags().String("library-user", "", "Account whose movies and series are exported to the library (the first account if empty)")
+	rootCmd.PersistentFlags().Int("library-refresh-interval", 24, "Export the library again every N hours while serving (0 to disable)")
+	rootCmd.PersistentFlags().String("dvr-dir", "", "Folder of the recordings of the live channels, enables the /dvr/recordings API (disabled if empty)")
+	rootCmd.PersistentFlags().Int("dvr-padding-start", 2, "Minutes recorded before the start of a recording")
+	rootCmd.PersistentFlags().Int("dvr-padding-end", 5, "Minutes recorded after the stop of a recording")
+	rootCmd.PersistentFlags().String("hls-signing-key", "", "Key signing the proxy urls of the rewritten hls playlists, random at each start if empty")
+	rootCmd.PersistentFlags().Int("connection-queue-timeout", 5, "Seconds a stream waits for a free upstream connection before being refused")
+	rootCmd.PersistentFlags().String("xtream-user", "", "Xtream-code user login")
+	rootCmd.PersistentFlags().String("xtream-password", "", "Xtream-code password login")
+	rootCmd.PersistentFlags().String("xtream-base-url", "", "Xtream-code base url e.g(http://expample.tv:8080)")
+	rootCmd.PersistentFlags().Int("m3u-cache-expiration", 1, "M3U cache expiration in hour")
+	rootCmd.PersistentFlags().Int("m3u-refresh-interval", 0, "Reload the m3u playlist every N minutes without restarting (0 to disable)")
+	rootCmd.PersistentFlags().BoolP("xtream-api-get", "", false, "Generate get.php from xtream API instead of get.php original endpoint")
+
+	if e := viper.BindPFlags(rootCmd.PersistentFlags()); e != nil {
 		log.Fatal("error binding PFlags to viper")
 	}
 }
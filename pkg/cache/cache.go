@@ -0,0 +1,57 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package cache stores the generated playlists and the API responses,
+// in memory or in Redis to share them between proxy replicas.
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrMiss is returned when a key is not in the cache.
+var ErrMiss = errors.New("cache: miss")
+
+// Cache is a key/value store with expiring entries.
+type Cache interface {
+	// Get returns the value of key, or ErrMiss.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores the value of key for ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key.
+	Delete(ctx context.Context, key string) error
+	// Close releases the cache resources.
+	Close() error
+}
+
+// New returns the cache of a url: empty or "memory://" for an in-memory cache,
+// "redis://[:password@]host:port/db" for a Redis cache.
+func New(url string) (Cache, error) {
+	switch {
+	case url == "" || url == "memory://":
+		return NewMemory(), nil
+	case strings.HasPrefix(url, "redis://"), strings.HasPrefix(url, "rediss://"):
+		return NewRedis(url)
+	default:
+		return nil, fmt.Errorf("cache: unsupported url %q", url)
+	}
+}
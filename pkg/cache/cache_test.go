@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisCache, err := New("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redisCache.Close()
+
+	memory := NewMemory()
+	now := time.Now()
+	memory.now = func() time.Time { return now }
+
+	tests := []struct {
+		name   string
+		cache  Cache
+		elapse func(time.Duration)
+	}{
+		{"memory", memory, func(d time.Duration) { now = now.Add(d) }},
+		{"redis", redisCache, mr.FastForward},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			if _, err := tt.cache.Get(ctx, "key"); err != ErrMiss {
+				t.Errorf("Get() of a missing key = %v, want %v", err, ErrMiss)
+			}
+
+			if err := tt.cache.Set(ctx, "key", []byte("value"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := tt.cache.Get(ctx, "key"); err != nil || string(b) != "value" {
+				t.Errorf("Get() = %q, %v, want %q", b, err, "value")
+			}
+
+			tt.elapse(2 * time.Minute)
+			if _, err := tt.cache.Get(ctx, "key"); err != ErrMiss {
+				t.Errorf("Get() of an expired key = %v, want %v", err, ErrMiss)
+			}
+
+			if err := tt.cache.Set(ctx, "key", []byte("value"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.cache.Delete(ctx, "key"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tt.cache.Get(ctx, "key"); err != ErrMiss {
+				t.Errorf("Get() of a deleted key = %v, want %v", err, ErrMiss)
+			}
+		})
+	}
+
+	if _, err := New("etcd://localhost"); err == nil {
+		t.Error("New() of an unsupported url: want an error")
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	memory := NewMemory()
+	defer memory.Close()
+	now := time.Now()
+	memory.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	memory.Set(ctx, "short", []byte("value"), time.Minute) // nolint: errcheck
+	memory.Set(ctx, "long", []byte("value"), time.Hour)    // nolint: errcheck
+
+	now = now.Add(2 * time.Minute)
+	memory.sweep()
+	if _, ok := memory.entries["short"]; ok {
+		t.Error("sweep() kept an expired entry")
+	}
+	if _, ok := memory.entries["long"]; !ok {
+		t.Error("sweep() removed an unexpired entry")
+	}
+
+	if err := memory.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+}
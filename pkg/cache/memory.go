@@ -0,0 +1,128 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often the expired entries are removed from the memory.
+const memorySweepInterval = time.Minute
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// Memory is an in-memory cache, expired entries are removed when they are read
+// and by a periodic sweep until the cache is closed.
+type Memory struct {
+	lock    sync.RWMutex
+	entries map[string]memoryEntry
+	now     func() time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemory returns an empty in-memory cache.
+func NewMemory() *Memory {
+	m := &Memory{entries: map[string]memoryEntry{}, now: time.Now, done: make(chan struct{})}
+	go m.sweepLoop(memorySweepInterval)
+
+	return m
+}
+
+// Get implements Cache.
+func (m *Memory) Get(_ context.Context, key string) ([]byte, error) {
+	m.lock.RLock()
+	e, ok := m.entries[key]
+	m.lock.RUnlock()
+
+	if !ok {
+		return nil, ErrMiss
+	}
+	if !m.now().Before(e.expires) {
+		m.lock.Lock()
+		// The key may have been set again meanwhile.
+		if e, ok := m.entries[key]; ok && !m.now().Before(e.expires) {
+			delete(m.entries, key)
+		}
+		m.lock.Unlock()
+		return nil, ErrMiss
+	}
+
+	return e.value, nil
+}
+
+// Set implements Cache.
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.entries[key] = memoryEntry{value: value, expires: m.now().Add(ttl)}
+
+	return nil
+}
+
+// Delete implements Cache.
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.entries, key)
+
+	return nil
+}
+
+// Close implements Cache, it stops the sweep.
+func (m *Memory) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+
+	return nil
+}
+
+func (m *Memory) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.sweep()
+		}
+	}
+}
+
+// sweep removes the expired entries.
+func (m *Memory) sweep() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	for k, e := range m.entries {
+		if !now.Before(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+}
@@ -19,7 +19,11 @@
 package config
 
 import (
+	"fmt"
 	"net/url"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/rules"
 )
 
 // Add Debugging Logging option
@@ -50,16 +54,88 @@ type HostConfiguration struct {
 // ProxyConfig Contain original m3u playlist and HostConfiguration
 type ProxyConfig struct {
 	HostConfig           *HostConfiguration
-	XtreamUser           CredentialString
-	XtreamPassword       CredentialString
-	XtreamBaseURL        string
 	XtreamGenerateApiGet bool
 	M3UCacheExpiration   int
+	M3URefreshInterval   int
 	M3UFileName          string
 	CustomEndpoint       string
 	CustomId             string
-	RemoteURL            *url.URL
 	AdvertisedPort       int
 	HTTPS                bool
-	User, Password       CredentialString
+	Users                *UserStore
+	Sources              []*Source
+	FailoverChannels     []FailoverChannel
+	FailoverTimeout      int
+	LiveFanout           bool
+	FanoutGracePeriod    int
+	FanoutBufferSize     int
+	// ConnectionQueueTimeout is the number of seconds a stream waits for a free upstream connection.
+	ConnectionQueueTimeout int
+	// CacheURL is the cache of the generated playlists and API responses, in memory if empty.
+	CacheURL string
+	// APICacheExpiration is the number of minutes the player_api responses stay fresh.
+	APICacheExpiration int
+	// APICacheTTLs overrides APICacheExpiration for some player_api actions.
+	APICacheTTLs map[string]time.Duration
+	// APICacheStale is the number of minutes an expired response is still served while it is refreshed.
+	APICacheStale int
+	// EPG holds the XMLTV guides merged into the guide of the sources.
+	EPG *EPGConfig
+	// EPGMatchTvgIDs fills the missing tvg-ids of the playlists from the names of the guide channels.
+	EPGMatchTvgIDs bool
+	// EPGCacheDir is the directory of the cached XMLTV guide.
+	EPGCacheDir string
+	// EPGRefreshInterval is the number of hours between two downloads of the XMLTV guide.
+	EPGRefreshInterval int
+	// HDHomeRun serves the playlist of HDHomeRunUser as an HDHomeRun tuner, for the Live TV of Plex, Jellyfin and Emby.
+	HDHomeRun bool
+	// HDHomeRunUser is the account of the tuner, required with HDHomeRun.
+	HDHomeRunUser string
+	// HDHomeRunTuners is the number of concurrent streams of the tuner.
+	HDHomeRunTuners int
+	// SSDP advertises the HDHomeRun tuner on the LAN with UPnP discovery.
+	SSDP bool
+	// LibraryDir is the folder of the .strm and NFO library of the movies and series, disabled if empty.
+	LibraryDir string
+	// LibraryUser is the account of the library streams, the first account if empty.
+	LibraryUser string
+	// LibraryRefreshInterval is the number of hours between two exports of the library.
+	LibraryRefreshInterval int
+	// DVRDir is the folder of the recordings of the live channels, disabled if empty.
+	DVRDir string
+	// DVRPaddingStart and DVRPaddingEnd are the minutes recorded before the start and after the stop of a recording.
+	DVRPaddingStart int
+	DVRPaddingEnd   int
+	// HLSSigningKey signs the upstream urls of the rewritten hls playlists, random if empty.
+	HLSSigningKey string
+	// PlaylistRules filters and rewrites the tracks of the proxyfied m3u files, nil without rules file.
+	PlaylistRules *rules.Rules
+}
+
+// XtreamSources returns the xtream sources, in their index order.
+func (c *ProxyConfig) XtreamSources() []*Source {
+	sources := make([]*Source, 0, len(c.Sources))
+	for _, s := range c.Sources {
+		if s.IsXtream() {
+			sources = append(sources, s)
+		}
+	}
+
+	return sources
+}
+
+// XtreamSource returns the xtream source and the upstream ID of a proxyfied ID,
+// the IDs of a single xtream source are its upstream IDs.
+func (c *ProxyConfig) XtreamSource(id int) (*Source, int, error) {
+	sources := c.XtreamSources()
+	if len(sources) == 1 {
+		return sources[0], id, nil
+	}
+
+	index, upstreamID := SplitSourceID(id)
+	if index < 0 || index >= len(sources) {
+		return nil, 0, fmt.Errorf("no xtream source for ID %d", id)
+	}
+
+	return sources[index], upstreamID, nil
 }
@@ -0,0 +1,160 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Content types of the catalogue.
+const (
+	ContentLive   = "live"
+	ContentVOD    = "vod"
+	ContentSeries = "series"
+)
+
+// Content describes a catalogue entry checked against entitlements.
+// Zero values are unknown, e.g. an m3u track has no category ID.
+type Content struct {
+	Type       string
+	Group      string
+	CategoryID int
+	StreamID   int
+	Name       string
+	// EPGChannelID is the guide channel of a live stream.
+	EPGChannelID string
+	// CatchupDays is the number of archived days of a live stream.
+	CatchupDays int
+}
+
+// EntitlementRule matches a content when all its set fields match.
+type EntitlementRule struct {
+	// Type is live, vod or series.
+	Type string `yaml:"type"`
+	// Group is the group-title or the category name.
+	Group      string `yaml:"group"`
+	CategoryID int    `yaml:"category_id"`
+	StreamID   int    `yaml:"stream_id"`
+	// Regex is matched against the channel name.
+	Regex string `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+// match reports whether the known fields of c match the rule,
+// and whether the rule only refers to known fields.
+func (r *EntitlementRule) match(c Content) (matched, complete bool) {
+	matched, complete = true, true
+
+	check := func(set, known, equal bool) {
+		if !set {
+			return
+		}
+		if !known {
+			complete = false
+			return
+		}
+		if !equal {
+			matched = false
+		}
+	}
+
+	check(r.Type != "", c.Type != "", r.Type == c.Type)
+	check(r.Group != "", c.Group != "", r.Group == c.Group)
+	check(r.CategoryID != 0, c.CategoryID != 0, r.CategoryID == c.CategoryID)
+	check(r.StreamID != 0, c.StreamID != 0, r.StreamID == c.StreamID)
+	check(r.regex != nil, c.Name != "", r.regex != nil && r.regex.MatchString(c.Name))
+
+	return matched, complete
+}
+
+// Entitlements restrict the part of the catalogue a user can see.
+// A content is allowed when there is no allow rule or one of them matches,
+// and none of the deny rules matches.
+type Entitlements struct {
+	Allow []EntitlementRule `yaml:"allow"`
+	Deny  []EntitlementRule `yaml:"deny"`
+}
+
+func (e *Entitlements) compile() error {
+	for _, rules := range [][]EntitlementRule{e.Allow, e.Deny} {
+		for i := range rules {
+			if rules[i].Regex == "" {
+				continue
+			}
+			re, err := regexp.Compile(rules[i].Regex)
+			if err != nil {
+				return fmt.Errorf("entitlement regex %q: %w", rules[i].Regex, err)
+			}
+			rules[i].regex = re
+		}
+	}
+
+	return nil
+}
+
+// IsRestricted reports whether there is at least one rule.
+func (e *Entitlements) IsRestricted() bool {
+	return len(e.Allow) > 0 || len(e.Deny) > 0
+}
+
+// NeedsGroup reports whether a rule matches on the group name.
+func (e *Entitlements) NeedsGroup() bool {
+	for _, rules := range [][]EntitlementRule{e.Allow, e.Deny} {
+		for _, r := range rules {
+			if r.Group != "" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Allows reports whether c is allowed, a rule referring to an unknown field of c never matches.
+func (e *Entitlements) Allows(c Content) bool {
+	return e.allows(c, false)
+}
+
+// MayAllow reports whether something inside c could be allowed,
+// it is used for categories where the streams are unknown.
+func (e *Entitlements) MayAllow(c Content) bool {
+	return e.allows(c, true)
+}
+
+func (e *Entitlements) allows(c Content, partial bool) bool {
+	for i := range e.Deny {
+		if matched, complete := e.Deny[i].match(c); matched && complete {
+			return false
+		}
+	}
+
+	if len(e.Allow) == 0 {
+		return true
+	}
+
+	for i := range e.Allow {
+		if matched, complete := e.Allow[i].match(c); matched && (complete || partial) {
+			return true
+		}
+	}
+
+	return false
+}
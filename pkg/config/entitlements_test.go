@@ -0,0 +1,80 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestEntitlements(t *testing.T) {
+	e := Entitlements{
+		Allow: []EntitlementRule{
+			{Type: ContentLive, Group: "Kids"},
+			{Type: ContentVOD},
+		},
+		Deny: []EntitlementRule{
+			{StreamID: 42},
+			{Regex: "(?i)adult"},
+		},
+	}
+	if err := e.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		content  Content
+		allows   bool
+		mayAllow bool
+	}{
+		{
+			name:     "allowed group",
+			content:  Content{Type: ContentLive, Group: "Kids", StreamID: 1, Name: "Cartoons"},
+			allows:   true,
+			mayAllow: true,
+		},
+		{
+			name:    "other group",
+			content: Content{Type: ContentLive, Group: "News", StreamID: 2, Name: "News 24"},
+		},
+		{
+			name:     "denied stream ID",
+			content:  Content{Type: ContentLive, Group: "Kids", StreamID: 42, Name: "Cartoons"},
+			mayAllow: false,
+		},
+		{
+			name:    "denied name",
+			content: Content{Type: ContentVOD, StreamID: 3, Name: "Adult movie"},
+		},
+		{
+			name:     "allowed type",
+			content:  Content{Type: ContentVOD, StreamID: 4, Name: "Movie"},
+			allows:   true,
+			mayAllow: true,
+		},
+		{
+			name:     "category without streams",
+			content:  Content{Type: ContentLive, Group: "Kids", CategoryID: 7},
+			allows:   true,
+			mayAllow: true,
+		},
+		{
+			name:     "unknown group is not allowed",
+			content:  Content{Type: ContentLive, StreamID: 5, Name: "Cartoons"},
+			mayAllow: true,
+		},
+		{
+			name:    "other type",
+			content: Content{Type: ContentSeries, StreamID: 6, Name: "Show"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.Allows(tt.content); got != tt.allows {
+				t.Errorf("Allows() = %v, want %v", got, tt.allows)
+			}
+			if got := e.MayAllow(tt.content); got != tt.mayAllow {
+				t.Errorf("MayAllow() = %v, want %v", got, tt.mayAllow)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// EPGSource is an XMLTV guide merged into the guide of the proxy.
+type EPGSource struct {
+	Name string `yaml:"name"`
+	// URL is an XMLTV url or file, plain or gzipped.
+	URL string `yaml:"url"`
+	// Channels maps the channel IDs of this guide to the tvg-ids of the playlist.
+	Channels map[string]string `yaml:"channels"`
+	// Shift is added to the programme times of a guide published with a wrong timezone, e.g "-1h".
+	Shift time.Duration `yaml:"shift"`
+	// ChannelShifts overrides Shift for single channels, by channel ID of this guide.
+	ChannelShifts map[string]time.Duration `yaml:"channel_shifts"`
+}
+
+// ShiftOf returns the shift of the programme times of a channel of the guide.
+func (s *EPGSource) ShiftOf(channelID string) time.Duration {
+	if shift, ok := s.ChannelShifts[channelID]; ok {
+		return shift
+	}
+
+	return s.Shift
+}
+
+// EPGConfig lists the XMLTV guides merged before the guides of the sources,
+// the first guide giving the programmes of a channel at a time wins.
+type EPGConfig struct {
+	Sources []EPGSource `yaml:"sources"`
+	// Channels maps the channel IDs of every guide to the tvg-ids of the playlist.
+	Channels map[string]string `yaml:"channels"`
+	// TvgIDs pins the tvg-id of the playlist channels without one by name,
+	// instead of the automatic matching. An empty tvg-id leaves the channel without.
+	TvgIDs map[string]string `yaml:"tvg_ids"`
+}
+
+// PinnedTvgID returns the tvg-id pinned for a playlist channel name.
+func (c *EPGConfig) PinnedTvgID(name string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	id, ok := c.TvgIDs[name]
+	return id, ok
+}
+
+// ChannelIDs returns the channel ID mapping of a guide,
+// the mapping of the guide overrides the global one.
+func (c *EPGConfig) ChannelIDs(s *EPGSource) map[string]string {
+	if c == nil {
+		return nil
+	}
+
+	ids := make(map[string]string, len(c.Channels))
+	for k, v := range c.Channels {
+		ids[k] = v
+	}
+	if s != nil {
+		for k, v := range s.Channels {
+			ids[k] = v
+		}
+	}
+
+	return ids
+}
+
+// LoadEPGConfig reads a YAML or JSON epg file e.g:
+//
+//	sources:
+//	  - name: uk
+//	    url: http://epg.example.com/uk.xml.gz
+//	    channels:
+//	      bbc1.uk: BBCOne.uk
+//	    shift: -1h
+//	    channel_shifts:
+//	      bbc1.uk: 0s
+//	channels:
+//	  tf1.fr: TF1.fr
+//	tvg_ids:
+//	  "FR: TF1 HD": TF1.fr
+func LoadEPGConfig(path string) (*EPGConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c EPGConfig
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("epg file %q: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	for i, s := range c.Sources {
+		if s.Name == "" || s.URL == "" {
+			return nil, fmt.Errorf("epg file %q: source %d: missing name or url", path, i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("epg file %q: source %q: duplicated name", path, s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	return &c, nil
+}
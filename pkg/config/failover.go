@@ -0,0 +1,79 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// FailoverChannel groups the m3u tracks of a channel, matched by tvg-id or name,
+// with alternative upstream urls tried after them.
+type FailoverChannel struct {
+	TvgID string   `yaml:"tvg_id"`
+	Names []string `yaml:"names"`
+	URLs  []string `yaml:"urls"`
+}
+
+// Matches reports whether a track belongs to the channel.
+func (f *FailoverChannel) Matches(tvgID, name string) bool {
+	if f.TvgID != "" && f.TvgID == tvgID {
+		return true
+	}
+	for _, n := range f.Names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type failoverFile struct {
+	Channels []FailoverChannel `yaml:"channels"`
+}
+
+// LoadFailoverChannels reads a YAML or JSON failover file e.g:
+//
+//	channels:
+//	  - tvg_id: tf1.fr
+//	    names: ["TF1 HD", "FR: TF1"]
+//	    urls:
+//	      - http://backup.example.com/tf1.ts
+func LoadFailoverChannels(path string) ([]FailoverChannel, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f failoverFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failover file %q: %w", path, err)
+	}
+
+	for i, c := range f.Channels {
+		if c.TvgID == "" && len(c.Names) == 0 {
+			return nil, fmt.Errorf("failover file %q: channel %d: missing tvg_id or names", path, i)
+		}
+	}
+
+	return f.Channels, nil
+}
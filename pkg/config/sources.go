@@ -0,0 +1,195 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// SourceIDStride separates the IDs of the xtream sources in the merged catalogue:
+	// the proxyfied ID of an upstream ID is the source index * SourceIDStride + the upstream ID.
+	// The upstream IDs must be below it.
+	SourceIDStride = 100000000
+	// MaxXtreamSources keeps the proxyfied IDs within int32, the players parse them as such.
+	// The IDs of the slot above the last source are left to the proxy, e.g the recordings.
+	MaxXtreamSources = 21
+)
+
+// Source is an upstream iptv service, an m3u playlist and/or an xtream account.
+type Source struct {
+	Name string `yaml:"name"`
+	// M3UURL is an m3u url or file merged into the proxyfied m3u.
+	M3UURL string `yaml:"m3u_url"`
+	// EPGURLs are the XMLTV urls or files of the m3u, the url-tvg of its header by default.
+	EPGURLs []string `yaml:"epg_urls"`
+	// EPGShift is added to the programme times of the source guide published with a wrong timezone, e.g "-1h".
+	EPGShift time.Duration `yaml:"epg_shift"`
+	// EPGChannelShifts overrides EPGShift for single channels, by channel ID of the guide.
+	EPGChannelShifts map[string]time.Duration `yaml:"epg_channel_shifts"`
+	XtreamBaseURL    string                   `yaml:"xtream_base_url"`
+	XtreamUser       CredentialString         `yaml:"xtream_user"`
+	XtreamPassword   CredentialString         `yaml:"xtream_password"`
+	// XtreamBackupURLs are base urls of the same xtream account tried when the streams of XtreamBaseURL fail.
+	XtreamBackupURLs []string `yaml:"xtream_backup_urls"`
+	// MaxConnections limits the concurrent upstream streams of the account,
+	// 0 uses the limit announced by the xtream account, -1 disables it.
+	MaxConnections int `yaml:"max_connections"`
+
+	// position among the xtream sources
+	xtreamIndex int
+	// shared reports whether the ID space is shared with other xtream sources
+	shared bool
+}
+
+// IsXtream reports whether the source is an xtream account.
+func (s *Source) IsXtream() bool {
+	return s.XtreamBaseURL != ""
+}
+
+// EPGShiftOf returns the shift of the programme times of a channel of the source guide.
+func (s *Source) EPGShiftOf(channelID string) time.Duration {
+	if shift, ok := s.EPGChannelShifts[channelID]; ok {
+		return shift
+	}
+
+	return s.EPGShift
+}
+
+// XtreamBaseURLs returns the xtream base url followed by the backup urls.
+func (s *Source) XtreamBaseURLs() []string {
+	return append([]string{s.XtreamBaseURL}, s.XtreamBackupURLs...)
+}
+
+// M3UIsXtreamGet reports whether the m3u url is the get.php of the xtream account.
+func (s *Source) M3UIsXtreamGet() bool {
+	if !s.IsXtream() || s.M3UURL == "" {
+		return false
+	}
+
+	u, err := url.Parse(s.M3UURL)
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(s.XtreamBaseURL, u.Host) &&
+		s.XtreamUser.String() == u.Query().Get("username") &&
+		s.XtreamPassword.String() == u.Query().Get("password")
+}
+
+// ProxyID returns the proxyfied ID of an upstream stream, category or series ID.
+// The IDs of the first xtream source are unchanged.
+func (s *Source) ProxyID(id int) int {
+	return s.xtreamIndex*SourceIDStride + id
+}
+
+// SharesIDs reports whether the source shares the proxyfied IDs with other xtream sources,
+// its upstream IDs must then be below SourceIDStride.
+func (s *Source) SharesIDs() bool {
+	return s.shared
+}
+
+// ValidID reports whether an upstream ID of the source has a proxyfied ID.
+func (s *Source) ValidID(id int) bool {
+	return !s.shared || (id >= 0 && id < SourceIDStride)
+}
+
+// SplitSourceID returns the xtream source index and the upstream ID of a proxyfied ID.
+func SplitSourceID(id int) (int, int) {
+	return id / SourceIDStride, id % SourceIDStride
+}
+
+type sourcesFile struct {
+	Sources []Source `yaml:"sources"`
+}
+
+// NewSources validates the sources and numbers the xtream ones.
+func NewSources(sources ...Source) ([]*Source, error) {
+	names := map[string]bool{}
+	list := make([]*Source, 0, len(sources))
+	xtreamIndex := 0
+	for i := range sources {
+		s := sources[i]
+		if s.Name == "" {
+			return nil, fmt.Errorf("source %d: empty name", i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("source %q: duplicated name", s.Name)
+		}
+		names[s.Name] = true
+
+		if s.IsXtream() {
+			if s.XtreamUser == "" || s.XtreamPassword == "" {
+				return nil, fmt.Errorf("source %q: missing xtream user or password", s.Name)
+			}
+			s.XtreamBaseURL = strings.TrimSuffix(s.XtreamBaseURL, "/")
+			for j := range s.XtreamBackupURLs {
+				s.XtreamBackupURLs[j] = strings.TrimSuffix(s.XtreamBackupURLs[j], "/")
+			}
+			if xtreamIndex >= MaxXtreamSources {
+				return nil, fmt.Errorf("source %q: more than %d xtream sources", s.Name, MaxXtreamSources)
+			}
+			s.xtreamIndex = xtreamIndex
+			xtreamIndex++
+		} else if s.M3UURL == "" {
+			return nil, fmt.Errorf("source %q: missing m3u url or xtream account", s.Name)
+		}
+
+		list = append(list, &s)
+	}
+	for _, s := range list {
+		s.shared = xtreamIndex > 1
+	}
+
+	return list, nil
+}
+
+// LoadSources reads a YAML or JSON sources file e.g:
+//
+//	sources:
+//	  - name: provider1
+//	    xtream_base_url: http://provider1.example.com:8080
+//	    xtream_user: user
+//	    xtream_password: password
+//	    xtream_backup_urls:
+//	      - http://backup.provider1.example.com:8080
+//	    max_connections: 2
+//	  - name: free
+//	    m3u_url: http://free.example.com/list.m3u
+//	    epg_urls:
+//	      - http://free.example.com/epg.xml.gz
+func LoadSources(path string) ([]*Source, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f sourcesFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("sources file %q: %w", path, err)
+	}
+
+	return NewSources(f.Sources...)
+}
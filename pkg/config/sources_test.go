@@ -0,0 +1,38 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestNewSourcesIDRange(t *testing.T) {
+	xtream := func(n int) []Source {
+		sources := make([]Source, n)
+		for i := range sources {
+			sources[i] = Source{
+				Name:           fmt.Sprintf("provider%d", i),
+				XtreamBaseURL:  "http://provider.example.com",
+				XtreamUser:     "user",
+				XtreamPassword: "password",
+			}
+		}
+		return sources
+	}
+
+	sources, err := NewSources(xtream(MaxXtreamSources)...)
+	if err != nil {
+		t.Fatalf("NewSources(%d xtream sources): %v", MaxXtreamSources, err)
+	}
+	last := sources[len(sources)-1]
+	if id := last.ProxyID(SourceIDStride - 1); id > math.MaxInt32 {
+		t.Errorf("ProxyID of the last source = %d, above int32", id)
+	}
+	if index, id := SplitSourceID(last.ProxyID(123)); index != MaxXtreamSources-1 || id != 123 {
+		t.Errorf("SplitSourceID = %d, %d, want %d, 123", index, id, MaxXtreamSources-1)
+	}
+
+	if _, err := NewSources(xtream(MaxXtreamSources + 1)...); err == nil {
+		t.Errorf("NewSources(%d xtream sources): no error", MaxXtreamSources+1)
+	}
+}
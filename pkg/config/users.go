@@ -0,0 +1,155 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+var (
+	// ErrInvalidCredentials is returned for an unknown user or a wrong password.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUserDisabled is returned when the account is disabled.
+	ErrUserDisabled = errors.New("user disabled")
+	// ErrUserExpired is returned when the account expiry date is reached.
+	ErrUserExpired = errors.New("user expired")
+)
+
+// User is an iptv-proxy account.
+type User struct {
+	Username CredentialString `yaml:"username"`
+	Password CredentialString `yaml:"password"`
+	// Enabled defaults to true when omitted.
+	Enabled *bool `yaml:"enabled"`
+	// ExpiresAt is ignored when zero.
+	ExpiresAt time.Time `yaml:"expires_at"`
+	// Entitlements restrict the channels, categories and content types of the account.
+	Entitlements Entitlements `yaml:"entitlements"`
+	// Admin allows the account to reload the playlist on demand.
+	Admin bool `yaml:"admin"`
+}
+
+// UnmarshalYAML decodes a quoted expiry date of a JSON file as a YAML timestamp.
+func (u *User) UnmarshalYAML(value *yaml.Node) error {
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		v := value.Content[i+1]
+		if value.Content[i].Value == "expires_at" && v.Kind == yaml.ScalarNode && v.Tag == "!!str" {
+			v.Tag = "!!timestamp"
+		}
+	}
+
+	type plain User
+	return value.Decode((*plain)(u))
+}
+
+// IsEnabled reports whether the account is enabled.
+func (u *User) IsEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
+}
+
+// IsExpired reports whether the account is expired at t.
+func (u *User) IsExpired(t time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !t.Before(u.ExpiresAt)
+}
+
+// UserStore contains the iptv-proxy accounts.
+type UserStore struct {
+	users map[string]*User
+}
+
+type usersFile struct {
+	Users []User `yaml:"users"`
+}
+
+// NewUserStore returns a store containing users.
+func NewUserStore(users ...User) (*UserStore, error) {
+	s := &UserStore{users: make(map[string]*User, len(users))}
+	for i := range users {
+		u := users[i]
+		if u.Username == "" {
+			return nil, fmt.Errorf("user %d: empty username", i)
+		}
+		if _, ok := s.users[u.Username.String()]; ok {
+			return nil, fmt.Errorf("user %q: duplicated username", u.Username)
+		}
+		if err := u.Entitlements.compile(); err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Username, err)
+		}
+		s.users[u.Username.String()] = &u
+	}
+
+	return s, nil
+}
+
+// LoadUsers reads a YAML or JSON users file e.g:
+//
+//	users:
+//	  - username: alice
+//	    password: secret
+//	    expires_at: 2030-01-01
+//	  - username: bob
+//	    password: secret
+//	    enabled: false
+func LoadUsers(path string) (*UserStore, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f usersFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("users file %q: %w", path, err)
+	}
+
+	return NewUserStore(f.Users...)
+}
+
+// Authenticate returns the user matching the credentials if the account is usable.
+func (s *UserStore) Authenticate(username, password string) (*User, error) {
+	u, ok := s.users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(u.Password.String()), []byte(password)) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	if !u.IsEnabled() {
+		return nil, ErrUserDisabled
+	}
+	if u.IsExpired(time.Now()) {
+		return nil, ErrUserExpired
+	}
+
+	return u, nil
+}
+
+// Users returns the accounts sorted by username.
+func (s *UserStore) Users() []*User {
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	return users
+}
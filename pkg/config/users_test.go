@@ -0,0 +1,129 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadUsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name: "users.yaml",
+			file: "users:\n  - username: alice\n    password: secret\n    expires_at: 2030-01-01\n",
+			want: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "users-time.yaml",
+			file: "users:\n  - username: alice\n    password: secret\n    expires_at: 2030-01-01T12:30:00+02:00\n",
+			want: time.Date(2030, 1, 1, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "users.json",
+			file: `{"users": [{"username": "alice", "password": "secret", "expires_at": "2030-01-01T00:00:00Z"}]}`,
+			want: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "users-date.json",
+			file: `{"users": [{"username": "alice", "password": "secret", "expires_at": "2030-01-01"}]}`,
+			want: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "no-expiry.yaml",
+			file: "users:\n  - username: alice\n    password: secret\n",
+		},
+		{
+			name:    "invalid-expiry.yaml",
+			file:    "users:\n  - username: alice\n    password: secret\n    expires_at: soon\n",
+			wantErr: true,
+		},
+		{
+			name:    "duplicated.yaml",
+			file:    "users:\n  - username: alice\n    password: a\n  - username: alice\n    password: b\n",
+			wantErr: true,
+		},
+		{
+			name:    "no-username.yaml",
+			file:    "users:\n  - password: secret\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.name)
+		if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := LoadUsers(path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: LoadUsers() succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: LoadUsers() = %v", tt.name, err)
+			continue
+		}
+		users := s.Users()
+		if len(users) != 1 || users[0].Username != "alice" || users[0].Password != "secret" {
+			t.Errorf("%s: users = %+v, want alice", tt.name, users)
+			continue
+		}
+		if !users[0].ExpiresAt.Equal(tt.want) {
+			t.Errorf("%s: expires_at = %v, want %v", tt.name, users[0].ExpiresAt, tt.want)
+		}
+	}
+
+	if _, err := LoadUsers(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadUsers() of a missing file succeeded, want an error")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	disabled := false
+	s, err := NewUserStore(
+		User{Username: "alice", Password: "secret"},
+		User{Username: "bob", Password: "secret", Enabled: &disabled},
+		User{Username: "carol", Password: "secret", ExpiresAt: time.Now().Add(-time.Minute)},
+		User{Username: "dave", Password: "secret", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username, password string
+		wantErr            error
+	}{
+		{"alice", "secret", nil},
+		{"alice", "wrong", ErrInvalidCredentials},
+		{"unknown", "secret", ErrInvalidCredentials},
+		{"bob", "secret", ErrUserDisabled},
+		{"bob", "wrong", ErrInvalidCredentials},
+		{"carol", "secret", ErrUserExpired},
+		{"dave", "secret", nil},
+	}
+	for _, tt := range tests {
+		u, err := s.Authenticate(tt.username, tt.password)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.username, tt.password, err, tt.wantErr)
+			continue
+		}
+		if err == nil && u.Username.String() != tt.username {
+			t.Errorf("Authenticate(%q, %q) = user %q", tt.username, tt.password, u.Username)
+		}
+	}
+
+	if users := s.Users(); len(users) != 4 || users[0].Username != "alice" || users[3].Username != "dave" {
+		t.Errorf("Users() = %+v, want the users sorted by username", users)
+	}
+}
@@ -0,0 +1,492 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dvr schedules the recordings of live channels to MPEG-TS files.
+package dvr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateFile lists the recordings in the recordings directory.
+const stateFile = "recordings.json"
+
+// Status of a recording.
+const (
+	Scheduled = "scheduled"
+	Recording = "recording"
+	Completed = "completed"
+	Failed    = "failed"
+)
+
+// ErrNotFound is returned for an unknown recording ID.
+var ErrNotFound = errors.New("recording not found")
+
+// Entry is a recording of a channel between two times.
+type Entry struct {
+	ID int `json:"id"`
+	// User is the account recording the channel.
+	User string `json:"user"`
+	// Channel is the stream ID of the channel.
+	Channel string `json:"channel"`
+	// ProgrammeID is the guide programme of the recording, if any.
+	ProgrammeID string `json:"programme_id,omitempty"`
+	// RuleID is the rule scheduling the recording, if any.
+	RuleID int `json:"rule_id,omitempty"`
+	// Episode identifies the episode of a series recorded by a rule.
+	Episode string    `json:"episode,omitempty"`
+	Title   string    `json:"title"`
+	Start   time.Time `json:"start"`
+	Stop    time.Time `json:"stop"`
+	Status  string    `json:"status"`
+	// File is the name of the recording in the recordings directory.
+	File string `json:"file,omitempty"`
+	Size int64  `json:"size"`
+	// Drops counts the upstream interruptions of the recording.
+	Drops int    `json:"drops,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder writes the stream of the channel of e to w until ctx is done,
+// it returns early when the upstream drops.
+type Recorder func(ctx context.Context, e Entry, w io.Writer) error
+
+// Options of a Scheduler.
+type Options struct {
+	// PaddingStart and PaddingEnd are recorded before the start and after the stop of the recordings.
+	PaddingStart time.Duration
+	PaddingEnd   time.Duration
+	// RetryDelay is the wait before the stream is requested again after an upstream drop.
+	RetryDelay time.Duration
+}
+
+// Scheduler starts the recordings at their time and keeps their list in its directory.
+type Scheduler struct {
+	dir    string
+	opts   Options
+	record Recorder
+
+	lock       sync.Mutex
+	recordings map[int]*Entry
+	nextID     int
+	// cancels the recordings in progress by ID
+	cancels map[int]context.CancelFunc
+	closing bool
+
+	rules      map[int]*Rule
+	nextRuleID int
+
+	wake      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New returns the scheduler of the recordings of dir, with the recordings of a previous run.
+// The recordings interrupted by a stop are resumed if their time isn't over.
+func New(dir string, opts Options, record Recorder) (*Scheduler, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Scheduler{
+		dir:        dir,
+		opts:       opts,
+		record:     record,
+		recordings: map[int]*Entry{},
+		nextID:     1,
+		cancels:    map[int]context.CancelFunc{},
+		rules:      map[int]*Rule{},
+		nextRuleID: 1,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var entries []*Entry
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %w", stateFile, err)
+		}
+		for _, e := range entries {
+			if e.Status == Recording {
+				e.Status = Scheduled
+			}
+			s.recordings[e.ID] = e
+			s.nextID = max(s.nextID, e.ID+1)
+		}
+	}
+	if err := s.loadRules(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Start runs the scheduler until Close.
+func (s *Scheduler) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Close stops the recordings in progress, they are resumed by the next scheduler of the directory.
+// It can be called more than once.
+func (s *Scheduler) Close() error {
+	s.closeOnce.Do(func() { s.closeErr = s.close() })
+
+	return s.closeErr
+}
+
+func (s *Scheduler) close() error {
+	s.lock.Lock()
+	s.closing = true
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+	s.lock.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.save()
+}
+
+// Schedule adds a recording of e.Channel from e.Start to e.Stop.
+func (s *Scheduler) Schedule(e Entry) (Entry, error) {
+	if e.Channel == "" {
+		return Entry{}, errors.New("no channel to record")
+	}
+	if !e.Stop.After(e.Start) {
+		return Entry{}, errors.New("the stop of the recording is before its start")
+	}
+	if !e.Stop.Add(s.opts.PaddingEnd).After(time.Now()) {
+		return Entry{}, errors.New("the recording is over")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.add(e)
+}
+
+// add schedules e, the lock is held.
+func (s *Scheduler) add(e Entry) (Entry, error) {
+	e.ID = s.nextID
+	s.nextID++
+	e.Status = Scheduled
+	e.File = fileName(&e)
+	e.Size, e.Drops, e.Error = 0, 0, ""
+	s.recordings[e.ID] = &e
+
+	if err := s.save(); err != nil {
+		delete(s.recordings, e.ID)
+		return Entry{}, err
+	}
+	s.signal()
+
+	return e, nil
+}
+
+// Recordings returns the recordings of a user, every recording if user is empty, sorted by start.
+func (s *Scheduler) Recordings(user string) []Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := make([]Entry, 0, len(s.recordings))
+	for _, e := range s.recordings {
+		if user == "" || e.User == user {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Start.Equal(entries[j].Start) {
+			return entries[i].Start.Before(entries[j].Start)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries
+}
+
+// Get returns a recording.
+func (s *Scheduler) Get(id int) (Entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.recordings[id]
+	if !ok {
+		return Entry{}, false
+	}
+
+	return *e, true
+}
+
+// Path returns the file of a recording.
+func (s *Scheduler) Path(e Entry) string {
+	return filepath.Join(s.dir, e.File)
+}
+
+// Delete cancels a recording and removes its file.
+func (s *Scheduler) Delete(id int) error {
+	s.lock.Lock()
+	e, ok := s.recordings[id]
+	if !ok {
+		s.lock.Unlock()
+		return ErrNotFound
+	}
+	delete(s.recordings, id)
+	cancel := s.cancels[id]
+	err := s.save()
+	s.lock.Unlock()
+
+	if cancel != nil {
+		// The recording goroutine removes the file once stopped.
+		cancel()
+		return err
+	}
+
+	if rmErr := os.Remove(s.Path(*e)); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) && err == nil {
+		err = rmErr
+	}
+
+	return err
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	defer s.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		next := s.startDue(time.Now())
+		timer.Reset(time.Until(next))
+
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// startDue starts the recordings whose padded start is reached,
+// and returns the padded start of the next one.
+func (s *Scheduler) startDue(now time.Time) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	next := now.Add(time.Hour)
+	if s.closing {
+		return next
+	}
+
+	changed := false
+	for id, e := range s.recordings {
+		if e.Status != Scheduled {
+			continue
+		}
+
+		start, end := e.Start.Add(-s.opts.PaddingStart), e.Stop.Add(s.opts.PaddingEnd)
+		switch {
+		case !end.After(now):
+			// The proxy was stopped until the end of the recording.
+			e.Status, e.Error = s.finalStatus(e), "the proxy was stopped during the recording"
+			changed = true
+		case !start.After(now):
+			ctx, cancel := context.WithDeadline(context.Background(), end)
+			s.cancels[id] = cancel
+			e.Status = Recording
+			changed = true
+
+			s.wg.Add(1)
+			go s.recordEntry(ctx, cancel, *e)
+		case start.Before(next):
+			next = start
+		}
+	}
+	if changed {
+		s.save() // nolint: errcheck
+	}
+
+	return next
+}
+
+// finalStatus is the status of a recording once over.
+func (s *Scheduler) finalStatus(e *Entry) string {
+	if e.Size > 0 {
+		return Completed
+	}
+
+	return Failed
+}
+
+// recordEntry records e until its padded stop, the stream is requested again when the upstream drops.
+func (s *Scheduler) recordEntry(ctx context.Context, cancel context.CancelFunc, e Entry) {
+	defer s.wg.Done()
+	defer cancel()
+
+	w := &entryWriter{s: s, id: e.ID}
+	f, err := os.OpenFile(s.Path(e), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err == nil {
+		w.f = f
+		err = s.recordStream(ctx, e, w)
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.cancels, e.ID)
+	current, ok := s.recordings[e.ID]
+	if !ok {
+		// Deleted while recording.
+		os.Remove(s.Path(e)) // nolint: errcheck
+		return
+	}
+
+	if s.closing && time.Now().Before(e.Stop.Add(s.opts.PaddingEnd)) {
+		current.Status = Scheduled
+	} else {
+		current.Status = s.finalStatus(current)
+		if err != nil {
+			current.Error = err.Error()
+		}
+		if current.Status == Completed && current.RuleID != 0 {
+			s.ruleRecorded(current)
+			s.prune(time.Now())
+		}
+	}
+	s.save() // nolint: errcheck
+}
+
+// recordStream calls the recorder until ctx is done, it returns the last upstream error.
+func (s *Scheduler) recordStream(ctx context.Context, e Entry, w io.Writer) error {
+	var lastErr error
+	for {
+		err := s.record(ctx, e, w)
+		if ctx.Err() != nil {
+			return lastErr
+		}
+		if err == nil {
+			err = errors.New("upstream closed the stream")
+		}
+		lastErr = err
+
+		s.lock.Lock()
+		if current, ok := s.recordings[e.ID]; ok {
+			current.Drops++
+			current.Error = err.Error()
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(s.opts.RetryDelay):
+		}
+	}
+}
+
+// entryWriter writes a recording to its file and counts its size.
+type entryWriter struct {
+	s  *Scheduler
+	id int
+	f  *os.File
+}
+
+func (w *entryWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+
+	w.s.lock.Lock()
+	if e, ok := w.s.recordings[w.id]; ok {
+		e.Size += int64(n)
+	}
+	w.s.lock.Unlock()
+
+	return n, err
+}
+
+// save writes the list of the recordings, the lock is held.
+func (s *Scheduler) save() error {
+	entries := make([]*Entry, 0, len(s.recordings))
+	for _, e := range s.recordings {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	return s.writeState(stateFile, entries)
+}
+
+// writeState replaces a state file of the directory with v.
+func (s *Scheduler) writeState(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(s.dir, name)
+	if err := os.WriteFile(p+".tmp", b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(p+".tmp", p)
+}
+
+// fileName returns the file name of a recording: its title, start and ID.
+func fileName(e *Entry) string {
+	title := strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return ' '
+		}
+		return r
+	}, e.Title)
+	title = strings.Trim(strings.Join(strings.Fields(title), " "), ". ")
+	if title == "" {
+		title = "Channel " + e.Channel
+	}
+
+	return fmt.Sprintf("%s %s [%d].ts", title, e.Start.Local().Format("2006-01-02 15.04"), e.ID)
+}
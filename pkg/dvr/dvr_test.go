@@ -0,0 +1,118 @@
+package dvr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// waitStatus waits for a recording to reach a status.
+func waitStatus(t *testing.T, s *Scheduler, id int, status string) Entry {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if e, ok := s.Get(id); ok && e.Status == status {
+			return e
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e, _ := s.Get(id)
+	t.Fatalf("recording %d is %q, want %q", id, e.Status, status)
+
+	return e
+}
+
+func TestSchedulerRetriesDrops(t *testing.T) {
+	dir := t.TempDir()
+	calls := 0
+	record := func(ctx context.Context, e Entry, w io.Writer) error {
+		calls++
+		if _, err := w.Write([]byte("ts")); err != nil {
+			return err
+		}
+		if calls == 1 {
+			return errors.New("upstream dropped")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	s, err := New(dir, Options{PaddingEnd: 100 * time.Millisecond, RetryDelay: 10 * time.Millisecond}, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	now := time.Now()
+	if _, err := s.Schedule(Entry{Channel: "1", Start: now, Stop: now.Add(-time.Second)}); err == nil {
+		t.Error("recording stopping before its start was scheduled")
+	}
+	e, err := s.Schedule(Entry{User: "bob", Channel: "1", Title: "News: 8 PM", Start: now, Stop: now.Add(200 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e = waitStatus(t, s, e.ID, Completed)
+	if e.Drops != 1 || e.Size != 4 || calls != 2 {
+		t.Errorf("recording = %+v after %d calls, want 1 drop and 4 bytes after 2 calls", e, calls)
+	}
+	if b, err := os.ReadFile(s.Path(e)); err != nil || string(b) != "tsts" {
+		t.Errorf("file = %q, %v", b, err)
+	}
+	if got := s.Recordings("alice"); len(got) != 0 {
+		t.Errorf("recordings of another user = %+v", got)
+	}
+
+	if err := s.Delete(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.Path(e)); !os.IsNotExist(err) {
+		t.Errorf("deleted recording file: %v", err)
+	}
+}
+
+func TestSchedulerResumes(t *testing.T) {
+	dir := t.TempDir()
+	record := func(ctx context.Context, e Entry, w io.Writer) error {
+		w.Write([]byte("ts")) // nolint: errcheck
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	s, err := New(dir, Options{RetryDelay: time.Second}, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+
+	now := time.Now()
+	e, err := s.Schedule(Entry{Channel: "1", Start: now, Stop: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, s, e.ID, Recording)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next scheduler of the directory resumes the recording.
+	s, err = New(dir, Options{RetryDelay: time.Second}, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get(e.ID); got.Status != Scheduled || got.Size != 2 {
+		t.Errorf("reloaded recording = %+v, want scheduled with 2 bytes", got)
+	}
+	s.Start()
+	defer s.Close()
+
+	waitStatus(t, s, e.ID, Recording)
+	if next, err := s.Schedule(Entry{Channel: "2", Start: now, Stop: now.Add(time.Minute)}); err != nil || next.ID != e.ID+1 {
+		t.Errorf("next recording = %+v, %v, want ID %d", next, err, e.ID+1)
+	}
+}
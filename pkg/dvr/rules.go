@@ -0,0 +1,372 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dvr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+)
+
+// rulesFile lists the rules in the recordings directory.
+const rulesFile = "rules.json"
+
+// ProgrammeTimeLayout is the XMLTV start time of the programme IDs.
+const ProgrammeTimeLayout = "20060102150405 -0700"
+
+// ProgrammeID returns the ID of a guide programme: its guide channel and its start.
+func ProgrammeID(channelID string, start time.Time) string {
+	return channelID + "@" + start.Format(ProgrammeTimeLayout)
+}
+
+// Rule records the programmes of the guide matching it.
+type Rule struct {
+	ID int `json:"id"`
+	// User is the account recording the programmes.
+	User string `json:"user"`
+	// Title is the title of the programmes, case insensitive.
+	Title string `json:"title,omitempty"`
+	// Pattern is a regular expression matching the title of the programmes.
+	Pattern string `json:"pattern,omitempty"`
+	// Channel is the guide channel of the programmes, every channel if empty.
+	Channel string `json:"channel,omitempty"`
+	// Category is a category of the programmes, case insensitive.
+	Category string `json:"category,omitempty"`
+	// Keep is the number of recordings kept, the older ones are deleted.
+	Keep int `json:"keep,omitempty"`
+	// KeepDays is the number of days a recording is kept.
+	KeepDays int `json:"keep_days,omitempty"`
+	// Episodes are the episodes already recorded, they are never recorded again.
+	Episodes []string `json:"episodes,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// compile checks the rule and compiles its pattern.
+func (r *Rule) compile() error {
+	if r.Title == "" && r.Pattern == "" && r.Category == "" {
+		return errors.New("the rule needs a title, a pattern or a category")
+	}
+	if r.Keep < 0 || r.KeepDays < 0 {
+		return errors.New("negative keep")
+	}
+
+	r.pattern = nil
+	if r.Pattern != "" {
+		p, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.pattern = p
+	}
+
+	return nil
+}
+
+// Match reports whether the rule records a programme of a guide channel.
+func (r *Rule) Match(channelID string, l *epg.Listing) bool {
+	if r.Channel != "" && r.Channel != channelID {
+		return false
+	}
+	if r.Title != "" && !strings.EqualFold(r.Title, l.Title) {
+		return false
+	}
+	if r.pattern != nil && !r.pattern.MatchString(l.Title) {
+		return false
+	}
+	if r.Category != "" && !slices.ContainsFunc(l.Categories, func(c string) bool { return strings.EqualFold(r.Category, c) }) {
+		return false
+	}
+
+	return true
+}
+
+// EpisodeKey identifies the episode of a programme by its title and its episode number or sub-title,
+// it is empty when the programme has neither.
+func EpisodeKey(l *epg.Listing) string {
+	title := strings.ToLower(strings.Join(strings.Fields(l.Title), " "))
+	switch {
+	case l.EpisodeNum != "":
+		return title + "/" + l.EpisodeNum
+	case l.SubTitle != "":
+		return title + "/" + strings.ToLower(strings.Join(strings.Fields(l.SubTitle), " "))
+	default:
+		return ""
+	}
+}
+
+// Guide gives the programmes of the guide to the rules.
+type Guide interface {
+	// Channels returns the IDs of the guide channels.
+	Channels() []string
+	// Listings returns the programmes of a guide channel.
+	Listings(channelID string) []epg.Listing
+	// Stream returns the live stream ID of a guide channel for a user.
+	Stream(user, channelID string) (string, bool)
+}
+
+// AddRule adds a rule, the guide programmes are matched by ApplyRules.
+func (s *Scheduler) AddRule(r Rule) (Rule, error) {
+	if err := r.compile(); err != nil {
+		return Rule{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r.ID = s.nextRuleID
+	s.nextRuleID++
+	r.Episodes = nil
+	s.rules[r.ID] = &r
+
+	if err := s.saveRules(); err != nil {
+		delete(s.rules, r.ID)
+		return Rule{}, err
+	}
+
+	return r, nil
+}
+
+// Rules returns the rules of a user, every rule if user is empty, sorted by ID.
+func (s *Scheduler) Rules(user string) []Rule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rules := make([]Rule, 0, len(s.rules))
+	for _, r := range s.rules {
+		if user == "" || r.User == user {
+			rules = append(rules, *r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+
+	return rules
+}
+
+// GetRule returns a rule by ID.
+func (s *Scheduler) GetRule(id int) (Rule, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.rules[id]
+	if !ok {
+		return Rule{}, false
+	}
+
+	return *r, true
+}
+
+// DeleteRule removes a rule, its scheduled recordings are cancelled and its completed ones are kept.
+func (s *Scheduler) DeleteRule(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.rules[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.rules, id)
+
+	for rid, e := range s.recordings {
+		if e.RuleID == id && e.Status == Scheduled {
+			delete(s.recordings, rid)
+		}
+	}
+
+	return errors.Join(s.saveRules(), s.save())
+}
+
+// ApplyRules schedules the recordings of the upcoming programmes of the guide matching the rules,
+// except the programmes and the episodes already recorded or scheduled for the user of the rule.
+// The recordings beyond the keep limits of the rules are deleted.
+func (s *Scheduler) ApplyRules(g Guide) ([]Entry, error) {
+	rules := s.Rules("")
+
+	var (
+		now       = time.Now()
+		scheduled []Entry
+		errs      []error
+		// stream IDs by user and guide channel, empty without stream
+		streams = map[[2]string]string{}
+	)
+	for i := range rules {
+		r := &rules[i]
+		channels := []string{r.Channel}
+		if r.Channel == "" {
+			channels = g.Channels()
+		}
+
+		for _, channelID := range channels {
+			for _, l := range g.Listings(channelID) {
+				if !l.Start.After(now) || !l.Stop.After(l.Start) || !r.Match(channelID, &l) {
+					continue
+				}
+
+				key := [2]string{r.User, channelID}
+				stream, ok := streams[key]
+				if !ok {
+					if stream, ok = g.Stream(r.User, channelID); !ok {
+						stream = ""
+					}
+					streams[key] = stream
+				}
+				if stream == "" {
+					continue
+				}
+
+				title := l.Title
+				if l.SubTitle != "" {
+					title += " - " + l.SubTitle
+				}
+				e, ok, err := s.scheduleRule(Entry{
+					User:        r.User,
+					Channel:     stream,
+					ProgrammeID: ProgrammeID(channelID, l.Start),
+					RuleID:      r.ID,
+					Episode:     EpisodeKey(&l),
+					Title:       title,
+					Start:       l.Start,
+					Stop:        l.Stop,
+				})
+				if err != nil {
+					errs = append(errs, fmt.Errorf("rule %d: %w", r.ID, err))
+				}
+				if ok {
+					scheduled = append(scheduled, e)
+				}
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.prune(now) {
+		errs = append(errs, s.save())
+	}
+
+	return scheduled, errors.Join(errs...)
+}
+
+// scheduleRule adds the recording of a rule unless it is a duplicate.
+func (s *Scheduler) scheduleRule(e Entry) (Entry, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.rules[e.RuleID]
+	if !ok || (e.Episode != "" && slices.Contains(r.Episodes, e.Episode)) {
+		return Entry{}, false, nil
+	}
+	for _, other := range s.recordings {
+		if other.User != e.User || other.Status == Failed {
+			continue
+		}
+		if other.ProgrammeID == e.ProgrammeID || (e.Episode != "" && other.Episode == e.Episode) {
+			return Entry{}, false, nil
+		}
+	}
+
+	e, err := s.add(e)
+
+	return e, err == nil, err
+}
+
+// ruleRecorded remembers the episode of a completed recording in its rule, the lock is held.
+func (s *Scheduler) ruleRecorded(e *Entry) {
+	r, ok := s.rules[e.RuleID]
+	if !ok || e.Episode == "" || slices.Contains(r.Episodes, e.Episode) {
+		return
+	}
+
+	r.Episodes = append(r.Episodes, e.Episode)
+	s.saveRules() // nolint: errcheck
+}
+
+// prune deletes the completed recordings of the rules beyond their keep limits,
+// it reports whether recordings were deleted. The lock is held.
+func (s *Scheduler) prune(now time.Time) bool {
+	pruned := false
+	for _, r := range s.rules {
+		if r.Keep == 0 && r.KeepDays == 0 {
+			continue
+		}
+
+		var completed []*Entry
+		for _, e := range s.recordings {
+			if e.RuleID == r.ID && e.Status == Completed {
+				completed = append(completed, e)
+			}
+		}
+		sort.Slice(completed, func(i, j int) bool { return completed[i].Start.After(completed[j].Start) })
+
+		for i, e := range completed {
+			if (r.Keep > 0 && i >= r.Keep) || (r.KeepDays > 0 && e.Stop.Before(now.AddDate(0, 0, -r.KeepDays))) {
+				delete(s.recordings, e.ID)
+				os.Remove(s.Path(*e)) // nolint: errcheck
+				pruned = true
+			}
+		}
+	}
+
+	return pruned
+}
+
+// loadRules reads the rules of a previous run.
+func (s *Scheduler) loadRules() error {
+	b, err := os.ReadFile(filepath.Join(s.dir, rulesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var rules []*Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return fmt.Errorf("%s: %w", rulesFile, err)
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("%s: rule %d: %w", rulesFile, r.ID, err)
+		}
+		s.rules[r.ID] = r
+		s.nextRuleID = max(s.nextRuleID, r.ID+1)
+	}
+
+	return nil
+}
+
+// saveRules writes the list of the rules, the lock is held.
+func (s *Scheduler) saveRules() error {
+	rules := make([]*Rule, 0, len(s.rules))
+	for _, r := range s.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+
+	return s.writeState(rulesFile, rules)
+}
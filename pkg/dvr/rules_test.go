@@ -0,0 +1,113 @@
+package dvr
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+)
+
+type testGuide map[string][]epg.Listing
+
+func (g testGuide) Channels() []string {
+	return []string{"Arte.fr", "M6.fr", "TF1.fr"}
+}
+
+func (g testGuide) Listings(channelID string) []epg.Listing {
+	return g[channelID]
+}
+
+func (g testGuide) Stream(user, channelID string) (string, bool) {
+	if stream, ok := map[string]string{"TF1.fr": "1", "M6.fr": "6"}[channelID]; ok {
+		return stream, true
+	}
+	// The stream of a channel without stream is unusable.
+	return "0", false
+}
+
+func TestApplyRules(t *testing.T) {
+	record := func(ctx context.Context, e Entry, w io.Writer) error {
+		if _, err := w.Write([]byte("ts")); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	s, err := New(t.TempDir(), Options{}, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	if _, err := s.AddRule(Rule{User: "bob", Keep: 1}); err == nil {
+		t.Error("rule matching every programme was added")
+	}
+	series, err := s.AddRule(Rule{User: "bob", Title: "dark", Channel: "TF1.fr", Keep: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddRule(Rule{User: "bob", Pattern: "^Film", Category: "movie"}); err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(d time.Duration) time.Time { return time.Now().Add(d).Truncate(time.Millisecond) }
+	// The programme IDs have a precision of a second.
+	next := time.Now().Truncate(time.Second).Add(2 * time.Second)
+	guide := testGuide{
+		"TF1.fr": {
+			{Title: "Dark", SubTitle: "Secrets", EpisodeNum: "0.0.", Start: at(50 * time.Millisecond), Stop: at(100 * time.Millisecond)},
+			{Title: "Dark", SubTitle: "Lies", EpisodeNum: "0.1.", Start: next, Stop: next.Add(50 * time.Millisecond)},
+			{Title: "Dark", SubTitle: "Secrets", EpisodeNum: "0.0.", Start: at(time.Hour), Stop: at(2 * time.Hour)},
+			{Title: "News", Start: at(2 * time.Hour), Stop: at(3 * time.Hour)},
+		},
+		// Arte.fr has no live stream.
+		"Arte.fr": {
+			{Title: "Film: Metropolis", Categories: []string{"Movie"}, Start: at(time.Hour), Stop: at(3 * time.Hour)},
+		},
+		"M6.fr": {
+			{Title: "Dark", EpisodeNum: "0.2.", Start: at(time.Hour), Stop: at(2 * time.Hour)},
+			{Title: "Film: Heat", Categories: []string{"Movie"}, Start: at(time.Hour), Stop: at(3 * time.Hour)},
+			{Title: "Film: Alien", Start: at(3 * time.Hour), Stop: at(5 * time.Hour)},
+		},
+	}
+
+	scheduled, err := s.ApplyRules(guide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, e := range scheduled {
+		titles = append(titles, e.Channel+" "+e.Title)
+	}
+	if len(titles) != 3 || titles[0] != "1 Dark - Secrets" || titles[1] != "1 Dark - Lies" || titles[2] != "6 Film: Heat" {
+		t.Fatalf("scheduled = %q", titles)
+	}
+	if again, err := s.ApplyRules(guide); err != nil || len(again) != 0 {
+		t.Errorf("scheduled again = %+v, %v", again, err)
+	}
+
+	first := waitStatus(t, s, scheduled[0].ID, Completed)
+	waitStatus(t, s, scheduled[1].ID, Completed)
+	if _, ok := s.Get(first.ID); ok {
+		t.Error("recording beyond the keep count wasn't deleted")
+	}
+	if r, _ := s.GetRule(series.ID); len(r.Episodes) != 2 {
+		t.Errorf("recorded episodes = %q", r.Episodes)
+	}
+
+	// The rerun of a deleted episode isn't recorded again.
+	guide["TF1.fr"][2].Start, guide["TF1.fr"][2].Stop = at(time.Hour), at(2*time.Hour)
+	if again, err := s.ApplyRules(guide); err != nil || len(again) != 0 {
+		t.Errorf("scheduled again = %+v, %v", again, err)
+	}
+
+	if err := s.DeleteRule(series.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Recordings("bob"); len(got) != 2 {
+		t.Errorf("recordings after the rule deletion = %+v", got)
+	}
+}
@@ -0,0 +1,325 @@
+package epg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sherif-fanous/xmltv"
+)
+
+func xmltvSource(name, doc string, gzipped bool) Source {
+	return Source{
+		Name: name,
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			if !gzipped {
+				return io.NopCloser(strings.NewReader(doc)), nil
+			}
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write([]byte(doc)) // nolint: errcheck
+			zw.Close()            // nolint: errcheck
+			return io.NopCloser(&buf), nil
+		},
+	}
+}
+
+func readGuide(t *testing.T, g *Guide) string {
+	t.Helper()
+
+	f, err := os.Open(g.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestStore(t *testing.T) {
+	first := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="one"><display-name>One</display-name></channel>
+  <programme start="20240101100000 +0000" stop="20240101110000 +0000" channel="one"><title>News</title><date>2019</date></programme>
+</tv>`
+	second := `<tv>
+  <channel id="two"><display-name>Two</display-name></channel>
+  <programme start="20240101100000 +0000" stop="20240101120000 +0000" channel="two"><title>Movie</title></programme>
+</tv>`
+
+	dir := t.TempDir()
+	s, err := NewStore(dir, []Source{xmltvSource("first", first, false), xmltvSource("second", second, true)}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guide, err := s.Guide(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := readGuide(t, guide)
+	for _, want := range []string{`<channel id="two">`, `<date>2019</date>`, `channel="two"`} {
+		if !strings.Contains(doc, want) {
+			t.Errorf("guide misses %q:\n%s", want, doc)
+		}
+	}
+	if strings.Index(doc, `<channel id="two">`) > strings.Index(doc, "<programme") {
+		t.Errorf("a channel follows the programmes:\n%s", doc)
+	}
+
+	filtered, err := s.Filtered(context.Background(), []string{"two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = readGuide(t, filtered)
+	if strings.Contains(doc, `"one"`) || !strings.Contains(doc, `channel="two"`) {
+		t.Errorf("filtered guide:\n%s", doc)
+	}
+
+	reloaded, err := NewStore(dir, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := reloaded.Current(); g == nil || g.ETag != guide.ETag {
+		t.Errorf("reloaded guide = %+v, want the etag %s", g, guide.ETag)
+	}
+	if _, err := os.Stat(filtered.Path); !os.IsNotExist(err) {
+		t.Errorf("the filtered guide of the previous run is kept: %v", err)
+	}
+}
+
+func TestStoreMerge(t *testing.T) {
+	first := `<tv>
+  <channel id="a1"><display-name>One from first</display-name></channel>
+  <programme start="20240101100000 +0000" stop="20240101110000 +0000" channel="a1"><title>First 10h</title></programme>
+  <programme start="20240101110000 +0000" stop="20240101120000 +0000" channel="a1"><title>First 11h</title></programme>
+</tv>`
+	second := `<tv>
+  <channel id="one"><display-name>One from second</display-name></channel>
+  <channel id="two"><display-name>Two</display-name></channel>
+  <programme start="20240101103000 +0000" stop="20240101113000 +0000" channel="one"><title>Second 10h30</title></programme>
+  <programme start="20240101120000 +0000" stop="20240101130000 +0000" channel="one"><title>Second 12h</title></programme>
+  <programme start="20240101100000 +0000" stop="20240101110000 +0000" channel="two"><title>Two 10h</title></programme>
+</tv>`
+
+	a := xmltvSource("first", first, false)
+	a.ChannelIDs = map[string]string{"a1": "one"}
+	b := xmltvSource("second", second, false)
+	b.Shift = func(channelID string) time.Duration {
+		if channelID == "one" {
+			return 30 * time.Minute
+		}
+		return 0
+	}
+	s, err := NewStore(t.TempDir(), []Source{a, b}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guide, err := s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := readGuide(t, guide)
+
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"One from first", true},
+		{"One from second", false},
+		{`channel="a1"`, false},
+		{"First 11h", true},
+		{"Second 10h30", false},
+		{"Second 12h", true},
+		{"Two 10h", true},
+		{`start="20240101123000 +0000" stop="20240101133000 +0000"`, true},
+		{`start="20240101100000 +0000" stop="20240101110000 +0000" channel="two"`, true},
+	}
+	for _, tt := range tests {
+		if strings.Contains(doc, tt.text) != tt.want {
+			t.Errorf("guide contains %q = %v, want %v:\n%s", tt.text, !tt.want, tt.want, doc)
+		}
+	}
+}
+
+func TestStoreSourceFailure(t *testing.T) {
+	good := `<tv>
+  <channel id="one"><display-name>One</display-name></channel>
+  <programme start="20240101100000 +0000" stop="20240101110000 +0000" channel="one"><title>One 10h</title></programme>
+  <programme start="20240101100000 +0000" stop="20240101110000 +0000" channel="one"><title>One 10h</title></programme>
+</tv>`
+	flakyDoc := `<tv>
+  <channel id="two"><display-name>Two</display-name></channel>
+  <programme start="20240101100000 +0000" stop="20240101110000 +0000" channel="two"><title>Two 10h</title></programme>
+</tv>`
+
+	var flakyErr error
+	flakyBody := flakyDoc
+	flaky := Source{
+		Name: "flaky",
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			if flakyErr != nil {
+				return nil, flakyErr
+			}
+			return io.NopCloser(strings.NewReader(flakyBody)), nil
+		},
+	}
+	s, err := NewStore(t.TempDir(), []Source{xmltvSource("good", good, false), flaky}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func() string {
+		t.Helper()
+		guide, err := s.Refresh(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readGuide(t, guide)
+	}
+	check := func(step, doc string) {
+		t.Helper()
+		for _, title := range []string{"One 10h", "Two 10h"} {
+			if n := strings.Count(doc, title); n != 1 {
+				t.Errorf("%s: guide has %d %q, want 1:\n%s", step, n, title, doc)
+			}
+		}
+		if n := strings.Count(doc, `<channel id="two">`); n != 1 {
+			t.Errorf("%s: guide has %d channels two, want 1:\n%s", step, n, doc)
+		}
+	}
+
+	check("first refresh", refresh())
+
+	// The previous feed of a failing source is merged.
+	flakyErr = errors.New("down")
+	check("source down", refresh())
+
+	// A broken feed is dropped, not merged with the previous one.
+	flakyErr = nil
+	flakyBody = flakyDoc[:strings.Index(flakyDoc, "<title>")]
+	check("broken source", refresh())
+
+	// Without a previous feed, the failing source is skipped.
+	s, err = NewStore(t.TempDir(), []Source{xmltvSource("good", good, false), flaky}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc := refresh(); !strings.Contains(doc, "One 10h") || strings.Contains(doc, "Two 10h") {
+		t.Errorf("guide without the failing source:\n%s", doc)
+	}
+
+	// The refresh fails when no source is left.
+	s, err = NewStore(t.TempDir(), []Source{flaky}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Refresh(context.Background()); err == nil {
+		t.Error("Refresh() without a working source succeeded, want an error")
+	}
+}
+
+func TestStoreWriters(t *testing.T) {
+	programme := func(channel, title string) string {
+		start := time.Now().UTC().Truncate(time.Hour)
+		return `<tv>
+  <channel id="` + channel + `"><display-name>` + channel + `</display-name></channel>
+  <programme start="` + start.Format("20060102150405 -0700") + `" stop="` + start.Add(time.Hour).Format("20060102150405 -0700") + `" channel="` + channel + `"><title>` + title + `</title></programme>
+</tv>`
+	}
+	s, err := NewStore(t.TempDir(), []Source{xmltvSource("refreshed", programme("one", "Refreshed"), false)}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var installed bytes.Buffer
+	zw := gzip.NewWriter(&installed)
+	zw.Write([]byte(programme("two", "Installed"))) // nolint: errcheck
+	zw.Close()                                      // nolint: errcheck
+
+	// The refreshes and the installs write their guide one at a time, each to its own file.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.Refresh(context.Background()) // nolint: errcheck
+		}()
+		go func() {
+			defer wg.Done()
+			s.Install(context.Background(), bytes.NewReader(installed.Bytes()), time.Now()) // nolint: errcheck
+		}()
+	}
+	wg.Wait()
+
+	for _, g := range []*Guide{first, s.Current()} {
+		if etag, err := fileETag(g.Path); err != nil || etag != g.ETag {
+			t.Errorf("guide %s has the etag %s (%v), want %s", g.Path, etag, err, g.ETag)
+		}
+	}
+	if doc := readGuide(t, first); !strings.Contains(doc, "Refreshed") || strings.Contains(doc, "Installed") {
+		t.Errorf("guide %s:\n%s", first.ETag, doc)
+	}
+
+	// The listings are indexed from the current guide.
+	current := readGuide(t, s.Current())
+	for channel, title := range map[string]string{"one": "Refreshed", "two": "Installed"} {
+		listings := s.Listings(channel)
+		if want := strings.Contains(current, title); want != (len(listings) == 1 && listings[0].Title == title) {
+			t.Errorf("listings of %s = %+v, want %q: %v", channel, listings, title, want)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	channels := []xmltv.Channel{
+		{ID: "tf1.fr", DisplayNames: []xmltv.DisplayName{{Text: "TF1"}}},
+		{ID: "france2.fr", DisplayNames: []xmltv.DisplayName{{Text: "France 2"}}},
+		{ID: "france3.fr", DisplayNames: []xmltv.DisplayName{{Text: "France 3"}}},
+		{ID: "bbcone.uk", DisplayNames: []xmltv.DisplayName{{Text: "BBC One"}}},
+		{ID: "bbcone1.uk", DisplayNames: []xmltv.DisplayName{{Text: "BBC One +1"}}},
+	}
+	m := NewMatcher(channels)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"FR: TF1 HD", "tf1.fr"},
+		{"|FR| France 2 FHD", "france2.fr"},
+		{"UK | BBC ONE", "bbcone.uk"},
+		{"BBC One +1", "bbcone1.uk"},
+		{"France", ""},
+		{"Unknown Channel", ""},
+	}
+	for _, tt := range tests {
+		match := m.Match(tt.name)
+		if got, _ := match.ChannelID(); got != tt.want {
+			t.Errorf("Match(%q).ChannelID() = %q, want %q (%+v)", tt.name, got, tt.want, match.Candidates)
+		}
+	}
+
+	if got := Normalize("FR: Télé-Monte Carlo (Backup) HD"); got != "tele monte carlo" {
+		t.Errorf("Normalize() = %q", got)
+	}
+}
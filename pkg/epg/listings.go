@@ -0,0 +1,157 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package epg
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sherif-fanous/xmltv"
+)
+
+// listingsRetention is how long the ended programmes stay in the listings, for the archives.
+const listingsRetention = 7 * 24 * time.Hour
+
+// Listing is a programme of the listings of a channel.
+type Listing struct {
+	Start       time.Time
+	Stop        time.Time
+	Title       string
+	SubTitle    string
+	Description string
+	Language    string
+	Categories  []string
+	// EpisodeNum is the xmltv_ns episode number, or else the first one of the programme.
+	EpisodeNum string
+}
+
+// Listings returns the programmes of a channel of the current guide sorted by start,
+// from a week ago. The listings of a guide are indexed on their first request.
+func (s *Store) Listings(channelID string) []Listing {
+	s.lock.RLock()
+	guide, listings := s.current, s.listings
+	s.lock.RUnlock()
+	if listings == nil && guide != nil {
+		listings = s.indexListings(guide)
+	}
+
+	return listings[channelID]
+}
+
+// indexListings reads the listings of guide, once for the concurrent requests.
+func (s *Store) indexListings(guide *Guide) map[string][]Listing {
+	v, err, _ := s.flight.Do("listings|"+guide.Path, func() (interface{}, error) {
+		listings, err := readListings(guide.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		if s.current == guide {
+			s.listings = listings
+		}
+		s.lock.Unlock()
+
+		return listings, nil
+	})
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: epg listings: %v", err)
+		return nil
+	}
+
+	return v.(map[string][]Listing)
+}
+
+// readChannels returns the channels of a guide file, the whole file is decoded to check it.
+func readChannels(path string) ([]xmltv.Channel, error) {
+	var channels []xmltv.Channel
+	err := readFile(path, func(v interface{}) error {
+		if c, ok := v.(*xmltv.Channel); ok {
+			channels = append(channels, *c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return channels, nil
+}
+
+// readListings returns the listings of the channels of a guide file.
+func readListings(path string) (map[string][]Listing, error) {
+	listings := map[string][]Listing{}
+	since := time.Now().Add(-listingsRetention)
+	err := readFile(path, func(v interface{}) error {
+		p, ok := v.(*Programme)
+		if !ok {
+			return nil
+		}
+
+		l := Listing{Start: p.Start.Time, Stop: p.Start.Time}
+		if p.Stop != nil {
+			l.Stop = p.Stop.Time
+		}
+		if len(p.Titles) > 0 {
+			l.Title = p.Titles[0].Text
+			if p.Titles[0].Lang != nil {
+				l.Language = *p.Titles[0].Lang
+			}
+		}
+		if len(p.SubTitles) > 0 {
+			l.SubTitle = p.SubTitles[0].Text
+		}
+		if len(p.Descriptions) > 0 {
+			l.Description = p.Descriptions[0].Text
+		}
+		for _, c := range p.Categories {
+			l.Categories = append(l.Categories, c.Text)
+		}
+		for i, n := range p.EpisodeNumbers {
+			if i == 0 || n.System == "xmltv_ns" {
+				l.EpisodeNum = strings.Join(strings.Fields(n.Text), "")
+			}
+			if n.System == "xmltv_ns" {
+				break
+			}
+		}
+		if l.Stop.After(since) {
+			listings[p.Channel] = append(listings[p.Channel], l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for id, ls := range listings {
+		sort.SliceStable(ls, func(i, j int) bool { return ls[i].Start.Before(ls[j].Start) })
+		// A programme without stop ends with the next one.
+		for i := range ls {
+			if !ls[i].Stop.After(ls[i].Start) && i+1 < len(ls) {
+				ls[i].Stop = ls[i+1].Start
+			}
+		}
+		listings[id] = ls
+	}
+
+	return listings, nil
+}
@@ -0,0 +1,191 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package epg
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/sherif-fanous/xmltv"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Scores of a match.
+const (
+	// MinScore is the lowest score of a confident match.
+	MinScore = 0.8
+	// MinMargin is the lowest difference between a confident match and the next candidate.
+	MinMargin = 0.15
+)
+
+var (
+	// countryPrefix matches "FR:", "UK |", "|FR|", "[FR]" or "(FR)" at the start of a name.
+	countryPrefix = regexp.MustCompile(`^\s*(\|[a-z]{2,3}\||\[[a-z]{2,3}\]|\([a-z]{2,3}\)|[a-z]{2,3}\s*[:|])\s*`)
+	// qualityTags matches the quality and the backup tags of a name.
+	qualityTags = regexp.MustCompile(`\b(hd|fhd|uhd|sd|hq|4k|8k|hevc|h265|h264|1080[pi]?|720p?|2160p?|50fps|60fps|backup|raw)\b`)
+	nonAlnum    = regexp.MustCompile(`[^\p{L}\p{N}+]+`)
+)
+
+// Normalize returns the comparable form of a channel name:
+// lower case without accent, country prefix, quality tags and punctuation.
+func Normalize(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+
+	s := countryPrefix.ReplaceAllString(b.String(), "")
+	s = nonAlnum.ReplaceAllString(s, " ")
+	s = qualityTags.ReplaceAllString(s, " ")
+
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Candidate is a guide channel a playlist channel may be.
+type Candidate struct {
+	ChannelID   string  `yaml:"channel_id"`
+	DisplayName string  `yaml:"display_name"`
+	Score       float64 `yaml:"score"`
+}
+
+// Match is the result of the matching of a playlist channel name,
+// Candidates are sorted by decreasing score.
+type Match struct {
+	Name       string      `yaml:"name"`
+	Candidates []Candidate `yaml:"candidates"`
+}
+
+// ChannelID returns the ID of the best candidate if the match is confident.
+func (m *Match) ChannelID() (string, bool) {
+	if len(m.Candidates) == 0 || m.Candidates[0].Score < MinScore {
+		return "", false
+	}
+	if len(m.Candidates) > 1 && m.Candidates[0].Score-m.Candidates[1].Score < MinMargin {
+		return "", false
+	}
+
+	return m.Candidates[0].ChannelID, true
+}
+
+// matcherName is a normalized display name or ID of a guide channel.
+type matcherName struct {
+	channelID   string
+	displayName string
+	trigrams    map[string]bool
+}
+
+// Matcher finds the guide channels of playlist channel names.
+type Matcher struct {
+	names []matcherName
+	// indices of the names by trigram
+	index map[string][]int
+}
+
+// NewMatcher returns the matcher of the guide channels,
+// a channel is matched on its display names and on its ID without country suffix.
+func NewMatcher(channels []xmltv.Channel) *Matcher {
+	m := &Matcher{index: map[string][]int{}}
+	for _, c := range channels {
+		seen := map[string]bool{}
+		names := []string{strings.SplitN(c.ID, ".", 2)[0]}
+		for _, n := range c.DisplayNames {
+			names = append(names, n.Text)
+		}
+
+		for _, n := range names {
+			normalized := Normalize(n)
+			if normalized == "" || seen[normalized] {
+				continue
+			}
+			seen[normalized] = true
+
+			display := n
+			if len(c.DisplayNames) > 0 {
+				display = c.DisplayNames[0].Text
+			}
+			name := matcherName{channelID: c.ID, displayName: display, trigrams: trigrams(normalized)}
+			for t := range name.trigrams {
+				m.index[t] = append(m.index[t], len(m.names))
+			}
+			m.names = append(m.names, name)
+		}
+	}
+
+	return m
+}
+
+// Match scores the guide channels sharing a part of the name, at most 5 candidates are returned.
+func (m *Matcher) Match(name string) Match {
+	match := Match{Name: name}
+	normalized := Normalize(name)
+	if normalized == "" {
+		return match
+	}
+
+	grams := trigrams(normalized)
+	shared := map[int]int{}
+	for t := range grams {
+		for _, i := range m.index[t] {
+			shared[i]++
+		}
+	}
+
+	best := map[string]Candidate{}
+	for i, n := range shared {
+		name := &m.names[i]
+		// Dice coefficient of the trigrams.
+		score := math.Round(200*float64(n)/float64(len(grams)+len(name.trigrams))) / 100
+		if c, ok := best[name.channelID]; !ok || score > c.Score {
+			best[name.channelID] = Candidate{ChannelID: name.channelID, DisplayName: name.displayName, Score: score}
+		}
+	}
+
+	for _, c := range best {
+		match.Candidates = append(match.Candidates, c)
+	}
+	sort.Slice(match.Candidates, func(i, j int) bool {
+		a, b := match.Candidates[i], match.Candidates[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.ChannelID < b.ChannelID
+	})
+	if len(match.Candidates) > 5 {
+		match.Candidates = match.Candidates[:5]
+	}
+
+	return match
+}
+
+// trigrams returns the 3 letter sequences of a normalized name without its spaces,
+// padded so the short names have trigrams too.
+func trigrams(s string) map[string]bool {
+	r := []rune("  " + strings.ReplaceAll(s, " ", "") + " ")
+	grams := map[string]bool{}
+	for i := 0; i+3 <= len(r); i++ {
+		grams[string(r[i:i+3])] = true
+	}
+
+	return grams
+}
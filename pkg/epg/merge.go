@@ -0,0 +1,204 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package epg
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/sherif-fanous/xmltv"
+)
+
+// interval is the time span of a programme in Unix seconds.
+type interval struct {
+	start, stop int64
+}
+
+// schedule is the sorted intervals of the programmes of a channel,
+// maxStop[i] is the latest stop of the intervals up to i.
+type schedule struct {
+	intervals []interval
+	maxStop   []int64
+}
+
+// overlaps reports whether iv overlaps a programme of the schedule.
+func (s *schedule) overlaps(iv interval) bool {
+	i := sort.Search(len(s.intervals), func(i int) bool {
+		return s.intervals[i].start >= iv.stop
+	})
+
+	return i > 0 && s.maxStop[i-1] > iv.start
+}
+
+func (s *schedule) add(ivs []interval) {
+	s.intervals = append(s.intervals, ivs...)
+	sort.Slice(s.intervals, func(i, j int) bool {
+		return s.intervals[i].start < s.intervals[j].start
+	})
+
+	s.maxStop = make([]int64, len(s.intervals))
+	for i, iv := range s.intervals {
+		s.maxStop[i] = iv.stop
+		if i > 0 && s.maxStop[i-1] > iv.stop {
+			s.maxStop[i] = s.maxStop[i-1]
+		}
+	}
+}
+
+// programmeKey identifies the programmes of a channel at the same times.
+type programmeKey struct {
+	channel string
+	interval
+}
+
+// merger merges the guides of the sources in their order.
+// The channel IDs are mapped to the playlist tvg-ids, the first source giving a channel
+// describes it, and a programme is dropped when an earlier source has a programme of
+// the channel at the same time, or when the source repeats it.
+type merger struct {
+	channels     []*xmltv.Channel
+	seenChannels map[string]bool
+
+	// programmes of the previous sources, and of the current one
+	schedules map[string]*schedule
+	added     map[string][]interval
+	seen      map[programmeKey]bool
+
+	file       *os.File
+	programmes *bufio.Writer
+	encoder    *xml.Encoder
+
+	// offset of the programmes and number of channels before the current source
+	start         int64
+	startChannels int
+}
+
+// newMerger returns a merger writing the programmes to file.
+func newMerger(file *os.File) *merger {
+	programmes := bufio.NewWriter(file)
+	return &merger{
+		seenChannels: map[string]bool{},
+		schedules:    map[string]*schedule{},
+		added:        map[string][]interval{},
+		seen:         map[programmeKey]bool{},
+		file:         file,
+		programmes:   programmes,
+		encoder:      xml.NewEncoder(programmes),
+	}
+}
+
+// startSource marks the start of a source, rollback drops what it adds.
+func (m *merger) startSource() error {
+	if err := m.programmes.Flush(); err != nil {
+		return err
+	}
+	start, err := m.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	m.start = start
+	m.startChannels = len(m.channels)
+
+	return nil
+}
+
+// rollback drops the channels and the programmes of the current source.
+func (m *merger) rollback() error {
+	m.programmes.Reset(m.file)
+	if err := m.file.Truncate(m.start); err != nil {
+		return err
+	}
+	if _, err := m.file.Seek(m.start, io.SeekStart); err != nil {
+		return err
+	}
+
+	for _, c := range m.channels[m.startChannels:] {
+		delete(m.seenChannels, c.ID)
+	}
+	m.channels = m.channels[:m.startChannels]
+	m.added = map[string][]interval{}
+	m.seen = map[programmeKey]bool{}
+
+	return nil
+}
+
+// flush writes the buffered programmes to the file.
+func (m *merger) flush() error {
+	return m.programmes.Flush()
+}
+
+// add merges a channel or a programme of src.
+func (m *merger) add(src *Source, v interface{}) error {
+	switch v := v.(type) {
+	case *xmltv.Channel:
+		v.ID = src.channelID(v.ID)
+		if m.seenChannels[v.ID] {
+			return nil
+		}
+		m.seenChannels[v.ID] = true
+		m.channels = append(m.channels, v)
+
+	case *Programme:
+		if shift := src.shift(v.Channel); shift != 0 {
+			v.Start.Time = v.Start.Add(shift)
+			if v.Stop != nil {
+				v.Stop.Time = v.Stop.Add(shift)
+			}
+		}
+		v.Channel = src.channelID(v.Channel)
+
+		iv := interval{start: v.Start.Unix(), stop: v.Start.Unix() + 1}
+		if v.Stop != nil && v.Stop.After(v.Start.Time) {
+			iv.stop = v.Stop.Unix()
+		}
+		if s := m.schedules[v.Channel]; s != nil && s.overlaps(iv) {
+			return nil
+		}
+		key := programmeKey{channel: v.Channel, interval: iv}
+		if m.seen[key] {
+			return nil
+		}
+		m.seen[key] = true
+		m.added[v.Channel] = append(m.added[v.Channel], iv)
+
+		if err := m.encoder.Encode(v); err != nil {
+			return err
+		}
+		return m.programmes.WriteByte('\n')
+	}
+
+	return nil
+}
+
+// endSource makes the programmes of the current source take precedence over the next sources.
+func (m *merger) endSource() {
+	for channel, ivs := range m.added {
+		s := m.schedules[channel]
+		if s == nil {
+			s = &schedule{}
+			m.schedules[channel] = s
+		}
+		s.add(ivs)
+	}
+	m.added = map[string][]interval{}
+	m.seen = map[programmeKey]bool{}
+}
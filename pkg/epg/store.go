@@ -0,0 +1,683 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package epg
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sherif-fanous/xmltv"
+	"golang.org/x/sync/singleflight"
+)
+
+// guideFilePrefix prefixes the merged guides in the store directory, they are named by their ETag.
+const guideFilePrefix = "guide-"
+
+// sourceFilePrefix prefixes the last feed downloaded of each source in the store directory.
+const sourceFilePrefix = "source-"
+
+// ErrNoSource is returned by the refresh of a store without source.
+var ErrNoSource = errors.New("no epg source")
+
+// Source is an XMLTV feed of the guide.
+type Source struct {
+	Name string
+	// ID identifies the feed across the refreshes to keep its last download, Name when empty.
+	ID string
+	// Open returns the XMLTV document, plain or gzipped.
+	Open func(ctx context.Context) (io.ReadCloser, error)
+	// ChannelIDs maps the channel IDs of the feed to the playlist tvg-ids.
+	ChannelIDs map[string]string
+	// Shift returns the correction of the programme times of a channel of the feed, nil for none.
+	Shift func(channelID string) time.Duration
+}
+
+func (s *Source) shift(channelID string) time.Duration {
+	if s.Shift == nil {
+		return 0
+	}
+
+	return s.Shift(channelID)
+}
+
+func (s *Source) id() string {
+	if s.ID != "" {
+		return s.ID
+	}
+
+	return s.Name
+}
+
+func (s *Source) channelID(id string) string {
+	if mapped, ok := s.ChannelIDs[id]; ok {
+		return mapped
+	}
+
+	return id
+}
+
+// client downloads the XMLTV urls, the refresh timeout bounds the whole download.
+var client = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// URLSource returns the source of an XMLTV url or file.
+func URLSource(name, rawURL string) Source {
+	return Source{
+		Name: name,
+		ID:   name + " " + rawURL,
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+				return os.Open(rawURL)
+			}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close() // nolint: errcheck
+				return nil, fmt.Errorf("XMLTV request failed with status: %d", resp.StatusCode)
+			}
+
+			return resp.Body, nil
+		},
+	}
+}
+
+// Guide is a gzipped XMLTV guide of the store.
+type Guide struct {
+	Path    string
+	ETag    string
+	ModTime time.Time
+}
+
+// Store keeps the guide merged from its sources on disk,
+// with the guides filtered on a set of channels.
+type Store struct {
+	dir     string
+	timeout time.Duration
+
+	lock    sync.RWMutex
+	sources []Source
+	current *Guide
+	// previous guide, kept on disk for the filters still reading it
+	previous *Guide
+	// channels of the current guide
+	channels []xmltv.Channel
+	// programmes of the current guide by channel ID, indexed on the first request
+	listings map[string][]Listing
+	// filtered guides of the current guide by path
+	filtered map[string]*Guide
+
+	// serializes the writers of the guides
+	writeLock sync.Mutex
+	flight    singleflight.Group
+}
+
+// NewStore returns the store of the sources in dir, with the guide left there by a previous run.
+// A refresh is canceled after timeout.
+func NewStore(dir string, sources []Source, timeout time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir, sources: sources, timeout: timeout, filtered: map[string]*Guide{}}
+
+	// Files of an interrupted refresh.
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	for _, tmp := range tmps {
+		os.Remove(tmp) // nolint: errcheck
+	}
+	s.removeFiltered(nil)
+
+	// The latest guide of a previous run is kept.
+	paths, _ := filepath.Glob(filepath.Join(dir, guideFilePrefix+"*.xml.gz"))
+	var latest os.FileInfo
+	path := ""
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if latest == nil || info.ModTime().After(latest.ModTime()) {
+			latest, path = info, p
+		}
+	}
+	if latest == nil {
+		return s, nil
+	}
+
+	etag, err := fileETag(path)
+	if err != nil {
+		return nil, err
+	}
+	channels, err := readChannels(path)
+	if err != nil {
+		return nil, err
+	}
+	s.current = &Guide{Path: path, ETag: etag, ModTime: latest.ModTime()}
+	s.channels = channels
+	s.removeGuides()
+
+	return s, nil
+}
+
+// SetSources replaces the sources of the next refreshes.
+func (s *Store) SetSources(sources []Source) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sources = sources
+}
+
+// Current returns the current guide, nil before the first refresh.
+func (s *Store) Current() *Guide {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.current
+}
+
+// Channels returns the channels of the current guide.
+func (s *Store) Channels() []xmltv.Channel {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.channels
+}
+
+// Guide returns the current guide, it waits for the first refresh if there is none yet.
+func (s *Store) Guide(ctx context.Context) (*Guide, error) {
+	if g := s.Current(); g != nil {
+		return g, nil
+	}
+
+	return s.wait(ctx, "refresh", s.refresh)
+}
+
+// Refresh fetches the sources again and replaces the current guide,
+// it is kept if a source fails.
+func (s *Store) Refresh(ctx context.Context) (*Guide, error) {
+	return s.wait(ctx, "refresh", s.refresh)
+}
+
+// Filtered returns the current guide restricted to the channel IDs.
+func (s *Store) Filtered(ctx context.Context, channels []string) (*Guide, error) {
+	guide, err := s.Guide(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := append([]string(nil), channels...)
+	sort.Strings(ids)
+	h := sha256.New()
+	h.Write([]byte(strings.Join(ids, "\n"))) // nolint: errcheck
+	path := filepath.Join(s.dir, fmt.Sprintf("epg-%s-%s.xml.gz", strings.Trim(guide.ETag, `"`), hex.EncodeToString(h.Sum(nil)[:8])))
+
+	s.lock.RLock()
+	filtered, ok := s.filtered[path]
+	s.lock.RUnlock()
+	if ok {
+		return filtered, nil
+	}
+
+	return s.wait(ctx, path, func() (*Guide, error) {
+		filtered, err := s.filter(guide, path, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		if s.current == guide {
+			s.filtered[path] = filtered
+		}
+		s.lock.Unlock()
+
+		return filtered, nil
+	})
+}
+
+// wait runs fn once at a time per key, fn is not canceled with ctx.
+func (s *Store) wait(ctx context.Context, key string, fn func() (*Guide, error)) (*Guide, error) {
+	ch := s.flight.DoChan(key, func() (interface{}, error) {
+		return fn()
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*Guide), nil
+	}
+}
+
+func (s *Store) refresh() (*Guide, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.lock.RLock()
+	sources := s.sources
+	s.lock.RUnlock()
+	if len(sources) == 0 {
+		return nil, ErrNoSource
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	guide, err := s.writeGuide(s.guidePath, func(e *Encoder) error {
+		return s.merge(ctx, sources, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	channels, err := readChannels(guide.Path)
+	if err != nil {
+		return nil, err
+	}
+	s.publish(guide, channels)
+
+	return guide, nil
+}
+
+// Install replaces the current guide by the gzipped guide of r modified at modTime,
+// e.g the guide of another store.
+func (s *Store) Install(ctx context.Context, r io.Reader, modTime time.Time) (*Guide, error) {
+	return s.wait(ctx, "install", func() (*Guide, error) {
+		s.writeLock.Lock()
+		defer s.writeLock.Unlock()
+
+		tmp, err := os.CreateTemp(s.dir, "epg-*.tmp")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name()) // nolint: errcheck
+		defer tmp.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+			return nil, err
+		}
+		if err := tmp.Close(); err != nil {
+			return nil, err
+		}
+		if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+			return nil, err
+		}
+		// A broken guide doesn't replace the current one.
+		channels, err := readChannels(tmp.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		tag := etag(h)
+		path := s.guidePath(tag)
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return nil, err
+		}
+		guide := &Guide{Path: path, ETag: tag, ModTime: modTime}
+		s.publish(guide, channels)
+
+		return guide, nil
+	})
+}
+
+// publish makes the guide written to the store directory the current guide.
+func (s *Store) publish(guide *Guide, channels []xmltv.Channel) {
+	s.lock.Lock()
+	if s.current == nil || s.current.Path != guide.Path {
+		s.previous = s.current
+	}
+	s.current = guide
+	s.channels = channels
+	s.listings = nil
+	s.filtered = map[string]*Guide{}
+	s.lock.Unlock()
+
+	s.removeGuides()
+	s.removeFiltered(guide)
+}
+
+// guidePath returns the path of the merged guide of an ETag.
+func (s *Store) guidePath(etag string) string {
+	return filepath.Join(s.dir, guideFilePrefix+strings.Trim(etag, `"`)+".xml.gz")
+}
+
+// removeGuides removes the merged guides other than the current and the previous one.
+func (s *Store) removeGuides() {
+	s.lock.RLock()
+	keep := map[string]bool{}
+	for _, g := range []*Guide{s.current, s.previous} {
+		if g != nil {
+			keep[g.Path] = true
+		}
+	}
+	s.lock.RUnlock()
+
+	paths, _ := filepath.Glob(filepath.Join(s.dir, guideFilePrefix+"*.xml.gz"))
+	for _, path := range paths {
+		if !keep[path] {
+			os.Remove(path) // nolint: errcheck
+		}
+	}
+}
+
+// merge encodes the channels of every source, then their programmes.
+// A source failing is skipped, it fails the merge only when no source is left.
+func (s *Store) merge(ctx context.Context, sources []Source, e *Encoder) error {
+	programmes, err := os.CreateTemp(s.dir, "programmes-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(programmes.Name()) // nolint: errcheck
+	defer programmes.Close()
+
+	m := newMerger(programmes)
+	merged := 0
+	var mergeErr error
+	for i := range sources {
+		src := &sources[i]
+		if err := s.mergeSource(ctx, src, m); err != nil {
+			mergeErr = fmt.Errorf("epg source %q: %w", src.Name, err)
+			log.Printf("[iptv-proxy] ERROR: %v", mergeErr)
+			continue
+		}
+		merged++
+	}
+	if merged == 0 {
+		return mergeErr
+	}
+	if err := m.flush(); err != nil {
+		return err
+	}
+	s.removeSourceFiles(sources)
+
+	for _, c := range m.channels {
+		if err := e.Encode(c); err != nil {
+			return err
+		}
+	}
+
+	if _, err := programmes.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return e.copyElements(programmes)
+}
+
+// mergeSource merges the feed of a source downloaded again,
+// or its previous download when the source fails.
+func (s *Store) mergeSource(ctx context.Context, src *Source, m *merger) error {
+	add := func(v interface{}) error {
+		return m.add(src, v)
+	}
+	previous := s.sourcePath(src)
+
+	tmp, err := s.download(ctx, src)
+	if err == nil {
+		if err = m.startSource(); err != nil {
+			os.Remove(tmp) // nolint: errcheck
+			return err
+		}
+		if err = readFile(tmp, add); err == nil {
+			m.endSource()
+			return os.Rename(tmp, previous)
+		}
+		os.Remove(tmp) // nolint: errcheck
+		if rerr := m.rollback(); rerr != nil {
+			return rerr
+		}
+	}
+
+	if _, serr := os.Stat(previous); serr != nil {
+		return err
+	}
+	log.Printf("[iptv-proxy] ERROR: epg source %q: %v, its previous guide is used", src.Name, err)
+
+	if err := m.startSource(); err != nil {
+		return err
+	}
+	if err := readFile(previous, add); err != nil {
+		if rerr := m.rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	m.endSource()
+
+	return nil
+}
+
+// sourcePath returns the path of the last feed downloaded of a source.
+func (s *Store) sourcePath(src *Source) string {
+	h := sha256.Sum256([]byte(src.id()))
+
+	return filepath.Join(s.dir, sourceFilePrefix+hex.EncodeToString(h[:8])+".xml")
+}
+
+// download copies the feed of a source to a new temporary file.
+func (s *Store) download(ctx context.Context, src *Source) (string, error) {
+	r, err := src.Open(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp(s.dir, sourceFilePrefix+"*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		os.Remove(f.Name()) // nolint: errcheck
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name()) // nolint: errcheck
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// removeSourceFiles removes the feeds downloaded of the sources removed.
+func (s *Store) removeSourceFiles(sources []Source) {
+	keep := map[string]bool{}
+	for i := range sources {
+		keep[s.sourcePath(&sources[i])] = true
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(s.dir, sourceFilePrefix+"*.xml"))
+	for _, path := range paths {
+		if !keep[path] {
+			os.Remove(path) // nolint: errcheck
+		}
+	}
+}
+
+// readFile calls fn with the channels and the programmes of a feed file.
+func readFile(path string, fn func(v interface{}) error) error {
+	r, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	d, err := NewDecoder(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		v, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+}
+
+// filter writes the channels of the guide in ids and their programmes to path.
+func (s *Store) filter(guide *Guide, path string, ids []string) (*Guide, error) {
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+
+	return s.writeGuide(func(string) string { return path }, func(e *Encoder) error {
+		f, err := os.Open(guide.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		d, err := NewDecoder(f)
+		if err != nil {
+			return err
+		}
+
+		for {
+			v, err := d.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			switch v := v.(type) {
+			case *xmltv.Channel:
+				if !keep[v.ID] {
+					continue
+				}
+			case *Programme:
+				if !keep[v.Channel] {
+					continue
+				}
+			}
+			if err := e.Encode(v); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// writeGuide writes the document encoded by fn to the gzipped file named by its ETag,
+// the file is replaced once complete.
+func (s *Store) writeGuide(name func(etag string) string, fn func(e *Encoder) error) (*Guide, error) {
+	tmp, err := os.CreateTemp(s.dir, "epg-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+	defer tmp.Close()
+
+	h := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(tmp, h))
+	e := NewEncoder(zw)
+	if err := fn(e); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	tag := etag(h)
+	path := name(tag)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Guide{Path: path, ETag: tag, ModTime: info.ModTime()}, nil
+}
+
+// removeFiltered removes the filtered guides of the other guides than current,
+// files being served keep their open descriptor.
+func (s *Store) removeFiltered(current *Guide) {
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "epg-*-*.xml.gz"))
+	for _, path := range paths {
+		if current != nil && strings.HasPrefix(path, filepath.Join(s.dir, "epg-"+strings.Trim(current.ETag, `"`)+"-")) {
+			continue
+		}
+		os.Remove(path) // nolint: errcheck
+	}
+}
+
+func etag(h hash.Hash) string {
+	return `"` + hex.EncodeToString(h.Sum(nil)[:8]) + `"`
+}
+
+func fileETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return etag(h), nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package epg caches the XMLTV guide of the sources on disk.
+package epg
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+
+	"github.com/sherif-fanous/xmltv"
+)
+
+// Programme is an XMLTV programme.
+// Its date is kept as is, the providers often give a year only.
+type Programme struct {
+	xmltv.Programme
+	Date *string `xml:"date,omitempty"`
+}
+
+// Decoder reads the channels and the programmes of an XMLTV document one at a time,
+// the whole guide is never held in memory.
+type Decoder struct {
+	d *xml.Decoder
+}
+
+// NewDecoder returns a decoder of r, r can be gzipped.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &Decoder{d: xml.NewDecoder(zr)}, nil
+	}
+
+	return &Decoder{d: xml.NewDecoder(br)}, nil
+}
+
+// Next returns the next *xmltv.Channel or *Programme of the document, or io.EOF at its end.
+func (d *Decoder) Next() (interface{}, error) {
+	for {
+		tok, err := d.d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "tv":
+		case "channel":
+			var c xmltv.Channel
+			if err := d.d.DecodeElement(&c, &start); err != nil {
+				return nil, err
+			}
+			return &c, nil
+		case "programme":
+			var p Programme
+			if err := d.d.DecodeElement(&p, &start); err != nil {
+				return nil, err
+			}
+			return &p, nil
+		default:
+			if err := d.d.Skip(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+const (
+	header = xml.Header + `<!DOCTYPE tv SYSTEM "xmltv.dtd">` + "\n" + `<tv generator-info-name="iptv-proxy">` + "\n"
+	footer = "</tv>\n"
+)
+
+// Encoder writes an XMLTV document, the channels must be encoded before the programmes.
+type Encoder struct {
+	w       *bufio.Writer
+	e       *xml.Encoder
+	started bool
+}
+
+// NewEncoder returns an encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	bw := bufio.NewWriter(w)
+	return &Encoder{w: bw, e: xml.NewEncoder(bw)}
+}
+
+func (e *Encoder) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+
+	_, err := e.w.WriteString(header)
+	return err
+}
+
+// Encode writes a *xmltv.Channel or a *Programme.
+func (e *Encoder) Encode(v interface{}) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if err := e.e.Encode(v); err != nil {
+		return err
+	}
+
+	return e.w.WriteByte('\n')
+}
+
+// copyElements writes elements already encoded in r.
+func (e *Encoder) copyElements(r io.Reader) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(e.w, r)
+	return err
+}
+
+// Close ends the document, it doesn't close the underlying writer.
+func (e *Encoder) Close() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if _, err := e.w.WriteString(footer); err != nil {
+		return err
+	}
+
+	return e.w.Flush()
+}
@@ -0,0 +1,332 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package fanout shares one upstream live stream connection between its viewers.
+package fanout
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PacketSize is the MPEG-TS packet size, viewers join a stream on a packet boundary.
+const PacketSize = 188
+
+// ErrClosed is returned when reading a closed viewer.
+var ErrClosed = errors.New("fanout: viewer closed")
+
+// Upstream is an opened upstream stream.
+type Upstream struct {
+	Header http.Header
+	Body   io.ReadCloser
+}
+
+// OpenFunc opens the upstream stream of a key.
+type OpenFunc func() (*Upstream, error)
+
+// Hub holds the shared streams by key.
+type Hub struct {
+	bufferSize int
+	grace      time.Duration
+
+	lock    sync.Mutex
+	streams map[string]*stream
+}
+
+// NewHub returns a hub buffering bufferSize bytes of each stream, and closing
+// the upstream of a stream the grace period after its last viewer left.
+func NewHub(bufferSize int, grace time.Duration) *Hub {
+	if bufferSize < PacketSize {
+		bufferSize = PacketSize
+	}
+
+	return &Hub{
+		bufferSize: bufferSize,
+		grace:      grace,
+		streams:    map[string]*stream{},
+	}
+}
+
+// Subscribe returns a viewer of the stream of key, the upstream is opened by
+// open if nobody is watching it.
+func (h *Hub) Subscribe(key string, open OpenFunc) (*Viewer, error) {
+	h.lock.Lock()
+	s, ok := h.streams[key]
+	if ok {
+		s.lock.Lock()
+		if s.done {
+			ok = false
+		} else {
+			s.viewers++
+			if s.timer != nil {
+				s.timer.Stop()
+				s.timer = nil
+			}
+		}
+		s.lock.Unlock()
+	}
+	if !ok {
+		s = &stream{
+			hub:     h,
+			key:     key,
+			ready:   make(chan struct{}),
+			ring:    make([]byte, h.bufferSize),
+			viewers: 1,
+		}
+		s.cond = sync.NewCond(&s.lock)
+		h.streams[key] = s
+	}
+	h.lock.Unlock()
+
+	if !ok {
+		up, err := open()
+		if err != nil {
+			s.err = err
+			close(s.ready)
+			s.finish(err)
+			return nil, err
+		}
+		s.header, s.body = up.Header, up.Body
+		close(s.ready)
+		go s.pump()
+	}
+
+	<-s.ready
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return s.newViewer(), nil
+}
+
+// Len returns the number of opened upstream streams.
+func (h *Hub) Len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.streams)
+}
+
+// CloseIdle closes the upstream of the streams without viewer whose key matches,
+// instead of waiting for their grace period. It returns the number of closed streams.
+func (h *Hub) CloseIdle(match func(key string) bool) int {
+	var idle []*stream
+
+	h.lock.Lock()
+	for key, s := range h.streams {
+		s.lock.Lock()
+		if s.viewers == 0 && !s.done && match(key) {
+			if s.timer != nil {
+				s.timer.Stop()
+				s.timer = nil
+			}
+			idle = append(idle, s)
+		}
+		s.lock.Unlock()
+	}
+	h.lock.Unlock()
+
+	for _, s := range idle {
+		s.expire()
+	}
+
+	return len(idle)
+}
+
+func (h *Hub) remove(s *stream) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.streams[s.key] == s {
+		delete(h.streams, s.key)
+	}
+}
+
+type stream struct {
+	hub *Hub
+	key string
+
+	// closed once the upstream is opened, or failed to
+	ready  chan struct{}
+	err    error
+	header http.Header
+	body   io.ReadCloser
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// ring buffer of the last bytes read from the upstream
+	ring    []byte
+	written int64
+	done    bool
+	readErr error
+	viewers int
+	// closes the upstream the grace period after the last viewer left
+	timer *time.Timer
+}
+
+func (s *stream) pump() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.body.Read(buf)
+		if n > 0 {
+			s.write(buf[:n])
+		}
+		if err != nil {
+			s.finish(err)
+			return
+		}
+	}
+}
+
+func (s *stream) write(p []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	size := int64(len(s.ring))
+	for len(p) > 0 {
+		start := s.written % size
+		n := copy(s.ring[start:], p)
+		s.written += int64(n)
+		p = p[n:]
+	}
+	s.cond.Broadcast()
+}
+
+// finish ends the stream, viewers read the buffered bytes then err.
+func (s *stream) finish(err error) {
+	s.lock.Lock()
+	s.done = true
+	if err != io.EOF {
+		s.readErr = err
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if s.body != nil {
+		s.body.Close() // nolint: errcheck
+	}
+	s.hub.remove(s)
+}
+
+// expire closes the upstream if there is still no viewer.
+func (s *stream) expire() {
+	s.lock.Lock()
+	idle := s.viewers == 0 && !s.done
+	if idle {
+		// A viewer subscribing from now on opens a new upstream.
+		s.done = true
+	}
+	s.lock.Unlock()
+
+	if idle {
+		// The pump gets a read error and finishes the stream.
+		s.body.Close() // nolint: errcheck
+	}
+}
+
+// oldest returns the first buffered position on a packet boundary.
+func (s *stream) oldest() int64 {
+	oldest := s.written - int64(len(s.ring))
+	if oldest <= 0 {
+		return 0
+	}
+
+	return (oldest + PacketSize - 1) / PacketSize * PacketSize
+}
+
+func (s *stream) newViewer() *Viewer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return &Viewer{stream: s, pos: s.oldest()}
+}
+
+// Viewer reads a shared stream.
+type Viewer struct {
+	stream *stream
+	pos    int64
+	closed bool
+	once   sync.Once
+}
+
+// Header returns the upstream response header.
+func (v *Viewer) Header() http.Header {
+	return v.stream.header
+}
+
+// Read reads the stream, a viewer too slow to keep up with the buffer skips the bytes it missed.
+func (v *Viewer) Read(p []byte) (int, error) {
+	s := v.stream
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for v.pos >= s.written && !s.done && !v.closed {
+		s.cond.Wait()
+	}
+	if v.closed {
+		return 0, ErrClosed
+	}
+	if v.pos >= s.written {
+		if s.readErr != nil {
+			return 0, s.readErr
+		}
+		return 0, io.EOF
+	}
+
+	if oldest := s.oldest(); v.pos < oldest {
+		v.pos = oldest
+	}
+
+	size := int64(len(s.ring))
+	start := v.pos % size
+	end := size
+	if s.written-v.pos < end-start {
+		end = start + s.written - v.pos
+	}
+	n := copy(p, s.ring[start:end])
+	v.pos += int64(n)
+
+	return n, nil
+}
+
+// Close leaves the stream, it can be called concurrently with Read.
+func (v *Viewer) Close() error {
+	v.once.Do(func() {
+		s := v.stream
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		v.closed = true
+		s.viewers--
+		s.cond.Broadcast()
+		if s.viewers == 0 && !s.done {
+			s.timer = time.AfterFunc(s.hub.grace, s.expire)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package fanout
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeUpstream returns an open func counting its calls, and the writer feeding the upstream.
+func pipeUpstream(opens *int32) (OpenFunc, *io.PipeWriter) {
+	r, w := io.Pipe()
+	return func() (*Upstream, error) {
+		atomic.AddInt32(opens, 1)
+		return &Upstream{Body: r}, nil
+	}, w
+}
+
+func TestHubShare(t *testing.T) {
+	var opens int32
+	open, w := pipeUpstream(&opens)
+	hub := NewHub(4*PacketSize, 50*time.Millisecond)
+
+	first, err := hub.Subscribe("channel", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := bytes.Repeat([]byte{0x47}, PacketSize)
+	go w.Write(packet) // nolint: errcheck
+
+	buf := make([]byte, PacketSize)
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := hub.Subscribe("channel", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new viewer starts with the buffered bytes.
+	if _, err := io.ReadFull(second, buf); err != nil || !bytes.Equal(buf, packet) {
+		t.Fatalf("second viewer read %v, %v", buf[:4], err)
+	}
+	if opens != 1 {
+		t.Errorf("upstream opened %d times, want 1", opens)
+	}
+
+	first.Close()  // nolint: errcheck
+	second.Close() // nolint: errcheck
+	if _, err := second.Read(buf); err != ErrClosed {
+		t.Errorf("Read() after Close() = %v, want %v", err, ErrClosed)
+	}
+
+	// The upstream is kept during the grace period.
+	if hub.Len() != 1 {
+		t.Fatalf("hub.Len() = %d, want 1", hub.Len())
+	}
+	third, err := hub.Subscribe("channel", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Close() // nolint: errcheck
+	if opens != 1 {
+		t.Errorf("upstream opened %d times, want 1", opens)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for hub.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream not closed after the grace period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestViewerSkipsLag(t *testing.T) {
+	var opens int32
+	open, w := pipeUpstream(&opens)
+	hub := NewHub(2*PacketSize, time.Minute)
+
+	v, err := hub.Subscribe("channel", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close() // nolint: errcheck
+
+	for i := byte(1); i <= 4; i++ {
+		if _, err := w.Write(bytes.Repeat([]byte{i}, PacketSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the pump to buffer the last packet.
+	for {
+		v.stream.lock.Lock()
+		written := v.stream.written
+		v.stream.lock.Unlock()
+		if written == 4*PacketSize {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.Close() // nolint: errcheck
+
+	b, err := io.ReadAll(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{3}, PacketSize), bytes.Repeat([]byte{4}, PacketSize)...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("lagging viewer read %d bytes starting with %v, want the last 2 packets", len(b), b[:1])
+	}
+}
+
+// blockingBody is an upstream body whose Close waits for release.
+type blockingBody struct {
+	io.Reader
+	closing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBody) Close() error {
+	close(b.closing)
+	<-b.release
+	return nil
+}
+
+func TestSubscribeDuringExpire(t *testing.T) {
+	var opens int32
+	// The pump waits for the upstream data until the body is closed.
+	r, _ := io.Pipe()
+	body := &blockingBody{Reader: r, closing: make(chan struct{}), release: make(chan struct{})}
+	open := func() (*Upstream, error) {
+		if atomic.AddInt32(&opens, 1) == 1 {
+			return &Upstream{Body: body}, nil
+		}
+		r, _ := io.Pipe()
+		return &Upstream{Body: r}, nil
+	}
+	hub := NewHub(PacketSize, time.Hour)
+
+	v, err := hub.Subscribe("channel", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Close() // nolint: errcheck
+
+	hub.lock.Lock()
+	s := hub.streams["channel"]
+	hub.lock.Unlock()
+	go s.expire()
+	<-body.closing
+
+	// The upstream is being closed, a new viewer doesn't join it.
+	v, err = hub.Subscribe("channel", open)
+	close(body.release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close() // nolint: errcheck
+	if opens != 2 {
+		t.Errorf("upstream opened %d times, want 2", opens)
+	}
+}
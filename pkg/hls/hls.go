@@ -0,0 +1,161 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package hls rewrites the URIs referenced by HLS master and media playlists.
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ErrNotPlaylist is returned when the input is not an HLS playlist.
+var ErrNotPlaylist = errors.New("hls: not an HLS playlist")
+
+// Kind is the kind of resource a playlist URI references.
+type Kind int
+
+const (
+	// KindPlaylist is a variant stream, an alternate rendition or an I-frame playlist.
+	KindPlaylist Kind = iota
+	// KindSegment is a media segment or a partial segment.
+	KindSegment
+	// KindKey is an encryption key.
+	KindKey
+	// KindMap is a media initialization section.
+	KindMap
+)
+
+// URIFunc returns the URI written in place of the absolute URI ref of the given kind.
+type URIFunc func(ref *url.URL, kind Kind) (string, error)
+
+// uriAttribute matches the URI attribute of a tag.
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// tagKinds are the tags with a URI attribute and the kind it references.
+var tagKinds = map[string]Kind{
+	"#EXT-X-KEY":                KindKey,
+	"#EXT-X-SESSION-KEY":        KindKey,
+	"#EXT-X-MAP":                KindMap,
+	"#EXT-X-MEDIA":              KindPlaylist,
+	"#EXT-X-I-FRAME-STREAM-INF": KindPlaylist,
+	"#EXT-X-RENDITION-REPORT":   KindPlaylist,
+	"#EXT-X-PART":               KindSegment,
+	"#EXT-X-PRELOAD-HINT":       KindSegment,
+}
+
+// IsPlaylist reports whether b starts like an HLS playlist.
+func IsPlaylist(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimPrefix(bytes.TrimSpace(b), []byte("\ufeff")), []byte("#EXTM3U"))
+}
+
+// Rewrite rewrites every URI of the playlist read from r with fn,
+// the relative URIs are resolved against base, the playlist url.
+// URIs which are not http(s), like data: or skd: keys, are kept.
+func Rewrite(r io.Reader, base *url.URL, fn URIFunc) ([]byte, error) {
+	var out bytes.Buffer
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	first := true
+	streamInf := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			if !strings.HasPrefix(strings.TrimPrefix(line, "\ufeff"), "#EXTM3U") {
+				return nil, ErrNotPlaylist
+			}
+			first = false
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			tag := trimmed
+			if i := strings.IndexByte(tag, ':'); i >= 0 {
+				tag = tag[:i]
+			}
+			if tag == "#EXT-X-STREAM-INF" {
+				streamInf = true
+			}
+
+			kind, ok := tagKinds[tag]
+			if !ok {
+				break
+			}
+			if tag == "#EXT-X-PRELOAD-HINT" && strings.Contains(trimmed, "TYPE=MAP") {
+				kind = KindMap
+			}
+
+			var err error
+			line = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				uri, rerr := rewriteURI(uriAttribute.FindStringSubmatch(attr)[1], base, kind, fn)
+				if rerr != nil {
+					err = rerr
+				}
+				return `URI="` + uri + `"`
+			})
+			if err != nil {
+				return nil, err
+			}
+		default:
+			kind := KindSegment
+			if streamInf {
+				kind = KindPlaylist
+				streamInf = false
+			}
+
+			uri, err := rewriteURI(trimmed, base, kind, fn)
+			if err != nil {
+				return nil, err
+			}
+			line = uri
+		}
+
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first {
+		return nil, ErrNotPlaylist
+	}
+
+	return out.Bytes(), nil
+}
+
+func rewriteURI(uri string, base *url.URL, kind Kind, fn URIFunc) (string, error) {
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	ref = base.ResolveReference(ref)
+	if ref.Scheme != "http" && ref.Scheme != "https" {
+		return uri, nil
+	}
+
+	return fn(ref, kind)
+}
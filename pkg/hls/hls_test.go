@@ -0,0 +1,108 @@
+package hls
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     string
+	}{
+		{
+			name: "master playlist",
+			playlist: `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,AUDIO="aud"
+low/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="http://cdn.example.com/iframes.m3u8"
+`,
+			want: `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="playlist|http://up.example.com/live/audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,AUDIO="aud"
+playlist|http://up.example.com/live/low/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="playlist|http://cdn.example.com/iframes.m3u8"
+`,
+		},
+		{
+			name: "media playlist",
+			playlist: "#EXTM3U\r\n" +
+				"#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/1\",IV=0x1\r\n" +
+				"#EXT-X-MAP:URI=\"init.mp4\"\r\n" +
+				"#EXTINF:6.0,\r\n" +
+				"seg1.m4s?t=1\r\n" +
+				"#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key\"\r\n" +
+				"#EXTINF:6.0,\r\n" +
+				"https://cdn.example.com/seg2.m4s\r\n",
+			want: `#EXTM3U
+#EXT-X-KEY:METHOD=AES-128,URI="key|http://up.example.com/keys/1",IV=0x1
+#EXT-X-MAP:URI="map|http://up.example.com/live/init.mp4"
+#EXTINF:6.0,
+segment|http://up.example.com/live/seg1.m4s?t=1
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key"
+#EXTINF:6.0,
+segment|https://cdn.example.com/seg2.m4s
+`,
+		},
+	}
+
+	kinds := map[Kind]string{KindPlaylist: "playlist", KindSegment: "segment", KindKey: "key", KindMap: "map"}
+	base, _ := url.Parse("http://up.example.com/live/index.m3u8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Rewrite(strings.NewReader(tt.playlist), base, func(ref *url.URL, kind Kind) (string, error) {
+				return fmt.Sprintf("%s|%s", kinds[kind], ref), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Rewrite() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Rewrite(strings.NewReader("<html>"), base, nil); err != ErrNotPlaylist {
+		t.Errorf("Rewrite() of a non playlist = %v, want %v", err, ErrNotPlaylist)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	s, err := NewSigner("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://up.example.com/live/user/secret/seg1.ts?t=1")
+	now := time.Now()
+
+	token := s.Sign("user|1", u, now)
+	got, err := s.Verify("user|1", token, now.Add(time.Minute))
+	if err != nil || got.String() != u.String() {
+		t.Errorf("Verify() = %v, %v, want %v", got, err, u)
+	}
+	for _, leak := range []string{"up.example.com", "secret", "seg1"} {
+		if b, _ := base64.RawURLEncoding.DecodeString(token); strings.Contains(token, leak) || strings.Contains(string(b), leak) {
+			t.Errorf("token %q reveals %q", token, leak)
+		}
+	}
+	if _, err := s.Verify("other|1", token, now); err != ErrInvalidToken {
+		t.Errorf("Verify() of another scope = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := s.Verify("user|1", token, now.Add(2*time.Hour)); err != ErrInvalidToken {
+		t.Errorf("Verify() of an expired token = %v, want %v", err, ErrInvalidToken)
+	}
+	forged := []byte(token)
+	forged[len(forged)/2] ^= 1
+	if _, err := s.Verify("user|1", string(forged), now); err != ErrInvalidToken {
+		t.Errorf("Verify() of a forged token = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := s.Verify("user|1", "aHR0cDovL2V2aWwuZXhhbXBsZS5jb20", now); err != ErrInvalidToken {
+		t.Errorf("Verify() of a plain url = %v, want %v", err, ErrInvalidToken)
+	}
+}
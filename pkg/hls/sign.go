@@ -0,0 +1,100 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// ErrInvalidToken is returned when a token was not sealed by the signer, or expired.
+var ErrInvalidToken = errors.New("hls: invalid token")
+
+// Signer seals the upstream urls embedded in the proxy urls,
+// so the proxy only fetches the urls it wrote in a playlist.
+// The tokens are encrypted, the clients never see the upstream urls and their credentials.
+type Signer struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+}
+
+// NewSigner returns a signer of tokens valid for ttl using key, or a random key if it is empty.
+func NewSigner(key string, ttl time.Duration) (*Signer, error) {
+	b := make([]byte, 32)
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		b = sum[:]
+	} else if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{aead: aead, ttl: ttl}, nil
+}
+
+// Sign returns the token of the upstream url u, only valid for scope until now + the signer ttl.
+func (s *Signer) Sign(scope string, u *url.URL, now time.Time) string {
+	raw := u.String()
+
+	plain := make([]byte, 8, 8+len(raw))
+	binary.BigEndian.PutUint64(plain, uint64(now.Add(s.ttl).Unix()))
+	plain = append(plain, raw...)
+
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		// The system random source doesn't fail.
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plain, []byte(scope)))
+}
+
+// Verify returns the upstream url of a token signed for scope, unless it expired at now.
+func (s *Signer) Verify(scope, token string, now time.Time) (*url.URL, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < s.aead.NonceSize() {
+		return nil, ErrInvalidToken
+	}
+
+	nonce, sealed := b[:s.aead.NonceSize()], b[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, sealed, []byte(scope))
+	if err != nil || len(plain) < 8 {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() > int64(binary.BigEndian.Uint64(plain)) {
+		return nil, ErrInvalidToken
+	}
+
+	return url.Parse(string(plain[8:]))
+}
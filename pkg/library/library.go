@@ -0,0 +1,369 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package library exports the xtream movies and series as a file library for Kodi, Jellyfin and Emby:
+// .strm files pointing at the proxy streams, next to Kodi NFO metadata.
+package library
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	xtream "github.com/sherif-fanous/xtreamcodes"
+	"go.yaml.in/yaml/v3"
+)
+
+// stateFile records the exported files in the library directory.
+const stateFile = ".library-state.yaml"
+
+// Folders of the library.
+const (
+	MoviesDir = "Movies"
+	SeriesDir = "TV Shows"
+)
+
+// Catalog gives the movies and the series to export, with their proxyfied IDs.
+type Catalog interface {
+	VODStreams(ctx context.Context) ([]xtream.VODStream, error)
+	VODInfo(ctx context.Context, id int) (*xtream.VOD, error)
+	SeriesStreams(ctx context.Context) ([]xtream.SeriesStream, error)
+	SeriesInfo(ctx context.Context, id int) (*xtream.Series, error)
+}
+
+// Library is a folder tree of .strm and NFO files.
+type Library struct {
+	// Dir is the root of the library, the movies are in its Movies folder and the series in its TV Shows folder.
+	Dir string
+	// MovieURL and EpisodeURL return the proxy url of a stream, e.g http://proxy:8080/movie/user/pass/12.mkv.
+	MovieURL   func(id int, extension string) string
+	EpisodeURL func(id int, extension string) string
+}
+
+// Stats counts the files of an export.
+type Stats struct {
+	Written   int
+	Unchanged int
+	Removed   int
+	// Failed is the number of movies and series whose info couldn't be fetched, their previous files are kept.
+	Failed int
+}
+
+// entry is an exported movie or series.
+type entry struct {
+	// Version changes with the catalogue entry, the info isn't fetched again while it is the same.
+	Version string   `yaml:"version"`
+	Files   []string `yaml:"files"`
+}
+
+type state struct {
+	// URLs identifies the stream urls of the .strm files, everything is written again when they change.
+	URLs   string        `yaml:"urls"`
+	Movies map[int]entry `yaml:"movies"`
+	Series map[int]entry `yaml:"series"`
+}
+
+// exporter is a run of Export.
+type exporter struct {
+	*Library
+	catalog Catalog
+	old     state
+	new     state
+	// folder names in use, lower cased
+	folders map[string]bool
+	stats   Stats
+}
+
+// Export writes the movies and the series of the catalog to the library.
+// A file is only written when its content changed, and the files of the entries
+// no longer in the catalog are removed.
+func (l *Library) Export(ctx context.Context, catalog Catalog) (Stats, error) {
+	if err := os.MkdirAll(l.Dir, 0o755); err != nil {
+		return Stats{}, err
+	}
+
+	e := &exporter{
+		Library: l,
+		catalog: catalog,
+		old:     l.readState(),
+		new:     state{URLs: l.MovieURL(0, "") + " " + l.EpisodeURL(0, ""), Movies: map[int]entry{}, Series: map[int]entry{}},
+		folders: map[string]bool{},
+	}
+	if e.old.URLs != e.new.URLs {
+		for _, entries := range []map[int]entry{e.old.Movies, e.old.Series} {
+			for id, old := range entries {
+				old.Version = ""
+				entries[id] = old
+			}
+		}
+	}
+
+	movies, err := catalog.VODStreams(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	series, err := catalog.SeriesStreams(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	sort.Slice(movies, func(i, j int) bool { return movies[i].StreamID < movies[j].StreamID })
+	for i := range movies {
+		if err := ctx.Err(); err != nil {
+			return e.stats, err
+		}
+		if err := e.movie(ctx, &movies[i]); err != nil {
+			return e.stats, err
+		}
+	}
+
+	sort.Slice(series, func(i, j int) bool { return series[i].SeriesID < series[j].SeriesID })
+	for i := range series {
+		if err := ctx.Err(); err != nil {
+			return e.stats, err
+		}
+		if err := e.series(ctx, &series[i]); err != nil {
+			return e.stats, err
+		}
+	}
+
+	e.removeStale()
+
+	return e.stats, e.writeState()
+}
+
+// movie exports Movies/<name>/<name>.strm and <name>.nfo.
+func (e *exporter) movie(ctx context.Context, stream *xtream.VODStream) error {
+	name := e.folder(MoviesDir, stream.Name, stream.StreamID)
+	version := fmt.Sprintf("%s|%d|%s", name, stream.AddedOn.Unix(), stream.ContainerExtension)
+	if e.keep(e.old.Movies, e.new.Movies, stream.StreamID, version) {
+		return nil
+	}
+
+	vod, err := e.catalog.VODInfo(ctx, stream.StreamID)
+	if err != nil {
+		e.failed(e.old.Movies, e.new.Movies, stream.StreamID)
+		return ctx.Err()
+	}
+
+	dir := path.Join(MoviesDir, name)
+	nfo, err := movieNFO(stream, &vod.Info)
+	if err != nil {
+		return err
+	}
+
+	return e.write(e.new.Movies, stream.StreamID, version, map[string][]byte{
+		path.Join(dir, name+".strm"): strm(e.MovieURL(stream.StreamID, stream.ContainerExtension)),
+		path.Join(dir, name+".nfo"):  nfo,
+	})
+}
+
+// series exports TV Shows/<name>/tvshow.nfo and the Season NN/<name> SNNENN.strm and .nfo of its episodes.
+func (e *exporter) series(ctx context.Context, stream *xtream.SeriesStream) error {
+	name := e.folder(SeriesDir, stream.Name, stream.SeriesID)
+	version := fmt.Sprintf("%s|%d", name, stream.LastModifiedOn.Unix())
+	if e.keep(e.old.Series, e.new.Series, stream.SeriesID, version) {
+		return nil
+	}
+
+	series, err := e.catalog.SeriesInfo(ctx, stream.SeriesID)
+	if err != nil {
+		e.failed(e.old.Series, e.new.Series, stream.SeriesID)
+		return ctx.Err()
+	}
+
+	dir := path.Join(SeriesDir, name)
+	nfo, err := tvShowNFO(stream, &series.Info)
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{path.Join(dir, "tvshow.nfo"): nfo}
+
+	for key, episodes := range series.Episodes {
+		for i := range episodes {
+			episode := &episodes[i]
+			season := episode.Season
+			if season == 0 {
+				fmt.Sscan(key, &season) // nolint: errcheck
+			}
+
+			base := fmt.Sprintf("%s S%02dE%02d", name, season, episode.EpisodeNumber)
+			p := path.Join(dir, fmt.Sprintf("Season %02d", season), base)
+			if _, ok := files[p+".strm"]; ok {
+				// Same episode number twice, e.g another language.
+				p = fmt.Sprintf("%s [%d]", p, episode.ID)
+			}
+
+			nfo, err := episodeNFO(series.Info.Name, season, episode)
+			if err != nil {
+				return err
+			}
+			files[p+".strm"] = strm(e.EpisodeURL(episode.ID, episode.ContainerExtension))
+			files[p+".nfo"] = nfo
+		}
+	}
+
+	return e.write(e.new.Series, stream.SeriesID, version, files)
+}
+
+// folder returns the file name of a movie or series, unique in the kind folder.
+func (e *exporter) folder(kind, name string, id int) string {
+	name = fileName(name)
+	if name == "" {
+		name = fmt.Sprint(id)
+	}
+
+	key := strings.ToLower(path.Join(kind, name))
+	if e.folders[key] {
+		name = fmt.Sprintf("%s [%d]", name, id)
+		key = strings.ToLower(path.Join(kind, name))
+	}
+	e.folders[key] = true
+
+	return name
+}
+
+// keep reports whether the files of an unchanged entry are kept as they are.
+func (e *exporter) keep(old, new map[int]entry, id int, version string) bool {
+	o, ok := old[id]
+	if !ok || o.Version != version {
+		return false
+	}
+	for _, f := range o.Files {
+		if _, err := os.Stat(filepath.Join(e.Dir, filepath.FromSlash(f))); err != nil {
+			return false
+		}
+	}
+
+	new[id] = o
+	e.stats.Unchanged += len(o.Files)
+
+	return true
+}
+
+// failed keeps the previous files of an entry whose info couldn't be fetched, it is tried again next time.
+func (e *exporter) failed(old, new map[int]entry, id int) {
+	e.stats.Failed++
+	if o, ok := old[id]; ok {
+		new[id] = entry{Files: o.Files}
+	}
+}
+
+// write writes the files of an entry whose content changed.
+func (e *exporter) write(entries map[int]entry, id int, version string, files map[string][]byte) error {
+	exported := entry{Version: version}
+	for f, content := range files {
+		p := filepath.Join(e.Dir, filepath.FromSlash(f))
+		exported.Files = append(exported.Files, f)
+
+		if current, err := os.ReadFile(p); err == nil && bytes.Equal(current, content) {
+			e.stats.Unchanged++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, content, 0o644); err != nil {
+			return err
+		}
+		e.stats.Written++
+	}
+
+	sort.Strings(exported.Files)
+	entries[id] = exported
+
+	return nil
+}
+
+// removeStale removes the files of the previous export which aren't part of the library anymore,
+// and the folders left empty.
+func (e *exporter) removeStale() {
+	current := map[string]bool{}
+	for _, entries := range []map[int]entry{e.new.Movies, e.new.Series} {
+		for _, en := range entries {
+			for _, f := range en.Files {
+				current[f] = true
+			}
+		}
+	}
+
+	for _, entries := range []map[int]entry{e.old.Movies, e.old.Series} {
+		for _, en := range entries {
+			for _, f := range en.Files {
+				if current[f] {
+					continue
+				}
+				if err := os.Remove(filepath.Join(e.Dir, filepath.FromSlash(f))); err == nil {
+					e.stats.Removed++
+				}
+				for dir := path.Dir(f); dir != "." && dir != MoviesDir && dir != SeriesDir; dir = path.Dir(dir) {
+					if os.Remove(filepath.Join(e.Dir, filepath.FromSlash(dir))) != nil {
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func (l *Library) readState() state {
+	var s state
+	b, err := os.ReadFile(filepath.Join(l.Dir, stateFile))
+	if err == nil {
+		yaml.Unmarshal(b, &s) // nolint: errcheck
+	}
+
+	return s
+}
+
+func (e *exporter) writeState() error {
+	b, err := yaml.Marshal(e.new)
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(e.Dir, stateFile)
+	if err := os.WriteFile(p+".tmp", b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(p+".tmp", p)
+}
+
+// strm is the content of a .strm file.
+func strm(url string) []byte {
+	return []byte(url + "\n")
+}
+
+// fileName removes the characters the file systems and the SMB shares reject from a name.
+func fileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, strings.ContainsRune(`<>:"/\|?*`, r):
+			return ' '
+		}
+		return r
+	}, name)
+
+	return strings.Trim(strings.Join(strings.Fields(name), " "), ". ")
+}
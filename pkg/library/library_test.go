@@ -0,0 +1,150 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+type fakeCatalog struct {
+	movies []xtream.VODStream
+	series []xtream.SeriesStream
+	// info fetches by ID
+	fetches map[int]int
+}
+
+func (f *fakeCatalog) VODStreams(context.Context) ([]xtream.VODStream, error) {
+	return append([]xtream.VODStream(nil), f.movies...), nil
+}
+
+func (f *fakeCatalog) VODInfo(_ context.Context, id int) (*xtream.VOD, error) {
+	f.fetches[id]++
+	tmdb := "The Matrix"
+	return &xtream.VOD{Info: xtream.VODInfo{
+		Name:        &tmdb,
+		Plot:        "A hacker learns the truth.",
+		Cast:        "Keanu Reeves, Carrie-Anne Moss",
+		Genre:       "Action / Sci-Fi",
+		Rating:      8.72,
+		TMDBID:      603,
+		MovieImage:  "http://img/matrix.jpg",
+		ReleaseDate: time.Date(1999, 3, 31, 0, 0, 0, 0, time.UTC),
+	}}, nil
+}
+
+func (f *fakeCatalog) SeriesStreams(context.Context) ([]xtream.SeriesStream, error) {
+	return append([]xtream.SeriesStream(nil), f.series...), nil
+}
+
+func (f *fakeCatalog) SeriesInfo(_ context.Context, id int) (*xtream.Series, error) {
+	f.fetches[id]++
+	return &xtream.Series{
+		Info: xtream.SeriesInfo{Name: "Dark", Plot: "A missing child."},
+		Episodes: map[string][]xtream.Episode{
+			"1": {
+				{ID: 301, Season: 1, EpisodeNumber: 1, Title: "Secrets", ContainerExtension: "mkv", EpisodeInfo: map[string]any{"plot": "Jonas.", "duration_secs": float64(3060)}},
+				{ID: 302, Season: 1, EpisodeNumber: 2, Title: "Lies", ContainerExtension: "mkv"},
+			},
+		},
+	}, nil
+}
+
+func readFile(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	l := &Library{
+		Dir:        dir,
+		MovieURL:   func(id int, ext string) string { return fmt.Sprintf("http://proxy/movie/u/p/%d.%s", id, ext) },
+		EpisodeURL: func(id int, ext string) string { return fmt.Sprintf("http://proxy/series/u/p/%d.%s", id, ext) },
+	}
+	catalog := &fakeCatalog{
+		movies: []xtream.VODStream{
+			{StreamID: 12, Name: "The Matrix (1999)", ContainerExtension: "mp4"},
+			{StreamID: 13, Name: "The Matrix (1999)", ContainerExtension: "mkv"},
+			{StreamID: 14, Name: "Alien: Covenant", ContainerExtension: "mkv"},
+		},
+		series:  []xtream.SeriesStream{{SeriesID: 20, Name: "Dark"}},
+		fetches: map[int]int{},
+	}
+
+	stats, err := l.Export(context.Background(), catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Written: 11}); stats != want {
+		t.Errorf("first export = %+v, want %+v", stats, want)
+	}
+
+	if got := readFile(t, dir, "Movies/The Matrix (1999)/The Matrix (1999).strm"); got != "http://proxy/movie/u/p/12.mp4\n" {
+		t.Errorf("strm = %q", got)
+	}
+	if got := readFile(t, dir, "Movies/The Matrix (1999) [13]/The Matrix (1999) [13].strm"); got != "http://proxy/movie/u/p/13.mkv\n" {
+		t.Errorf("duplicate strm = %q", got)
+	}
+	nfo := readFile(t, dir, "Movies/Alien Covenant/Alien Covenant.nfo")
+	for _, want := range []string{
+		"<title>The Matrix</title>",
+		"<value>8.7</value>",
+		`<uniqueid type="tmdb" default="true">603</uniqueid>`,
+		"<genre>Action</genre>\n  <genre>Sci-Fi</genre>",
+		"<premiered>1999-03-31</premiered>",
+		`<thumb aspect="poster">http://img/matrix.jpg</thumb>`,
+		"<actor>\n    <name>Carrie-Anne Moss</name>\n  </actor>",
+	} {
+		if !strings.Contains(nfo, want) {
+			t.Errorf("movie nfo misses %q:\n%s", want, nfo)
+		}
+	}
+	if got := readFile(t, dir, "TV Shows/Dark/Season 01/Dark S01E02.strm"); got != "http://proxy/series/u/p/302.mkv\n" {
+		t.Errorf("episode strm = %q", got)
+	}
+	episode := readFile(t, dir, "TV Shows/Dark/Season 01/Dark S01E01.nfo")
+	if !strings.Contains(episode, "<runtime>51</runtime>") || strings.Contains(episode, "<ratings>") {
+		t.Errorf("episode nfo:\n%s", episode)
+	}
+
+	// Nothing changed: nothing is fetched nor written.
+	stats, err = l.Export(context.Background(), catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Unchanged: 11}); stats != want {
+		t.Errorf("second export = %+v, want %+v", stats, want)
+	}
+	if catalog.fetches[12] != 1 || catalog.fetches[20] != 1 {
+		t.Errorf("fetches = %v, want one per entry", catalog.fetches)
+	}
+
+	// A removed movie loses its folder, a modified series is fetched again.
+	catalog.movies = catalog.movies[:2]
+	catalog.series[0].LastModifiedOn = time.Unix(1700000000, 0)
+	stats, err = l.Export(context.Background(), catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Unchanged: 11 - 2, Removed: 2}); stats != want {
+		t.Errorf("third export = %+v, want %+v", stats, want)
+	}
+	if catalog.fetches[20] != 2 {
+		t.Errorf("series fetched %d times, want 2", catalog.fetches[20])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Movies", "Alien Covenant")); !os.IsNotExist(err) {
+		t.Errorf("removed movie folder: %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package library
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+// listSeparator splits the genres, countries and people of the providers.
+var listSeparator = regexp.MustCompile(`\s*[,/|]\s*`)
+
+type nfoRating struct {
+	Name    string  `xml:"name,attr"`
+	Max     int     `xml:"max,attr"`
+	Default bool    `xml:"default,attr"`
+	Value   float64 `xml:"value"`
+}
+
+type nfoRatings struct {
+	Ratings []nfoRating `xml:"rating"`
+}
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr"`
+	ID      string `xml:",chardata"`
+}
+
+type nfoThumb struct {
+	Aspect string `xml:"aspect,attr,omitempty"`
+	URL    string `xml:",chardata"`
+}
+
+type nfoFanart struct {
+	Thumbs []nfoThumb `xml:"thumb"`
+}
+
+type nfoActor struct {
+	Name string `xml:"name"`
+}
+
+// nfoCommon are the elements shared by the movies and the tv shows.
+type nfoCommon struct {
+	Title         string        `xml:"title"`
+	OriginalTitle string        `xml:"originaltitle,omitempty"`
+	Ratings       *nfoRatings   `xml:"ratings"`
+	Plot          string        `xml:"plot,omitempty"`
+	Runtime       int           `xml:"runtime,omitempty"`
+	Thumbs        []nfoThumb    `xml:"thumb"`
+	Fanart        *nfoFanart    `xml:"fanart"`
+	UniqueIDs     []nfoUniqueID `xml:"uniqueid"`
+	Genres        []string      `xml:"genre"`
+	Countries     []string      `xml:"country"`
+	Directors     []string      `xml:"director"`
+	Premiered     string        `xml:"premiered,omitempty"`
+	Year          int           `xml:"year,omitempty"`
+	Trailer       string        `xml:"trailer,omitempty"`
+	Actors        []nfoActor    `xml:"actor"`
+}
+
+type movie struct {
+	XMLName xml.Name `xml:"movie"`
+	nfoCommon
+}
+
+type tvShow struct {
+	XMLName xml.Name `xml:"tvshow"`
+	nfoCommon
+}
+
+type episodeDetails struct {
+	XMLName   xml.Name    `xml:"episodedetails"`
+	Title     string      `xml:"title"`
+	ShowTitle string      `xml:"showtitle"`
+	Season    int         `xml:"season"`
+	Episode   int         `xml:"episode"`
+	Ratings   *nfoRatings `xml:"ratings"`
+	Plot      string      `xml:"plot,omitempty"`
+	Runtime   int         `xml:"runtime,omitempty"`
+	Thumbs    []nfoThumb  `xml:"thumb"`
+	Aired     string      `xml:"aired,omitempty"`
+}
+
+// movieNFO returns the Kodi NFO of a movie.
+func movieNFO(stream *xtream.VODStream, info *xtream.VODInfo) ([]byte, error) {
+	m := movie{nfoCommon: nfoCommon{
+		Title:     stream.Name,
+		Plot:      info.Plot,
+		Runtime:   info.DurationSeconds / 60,
+		Genres:    split(info.Genre),
+		Directors: split(info.Director),
+		Trailer:   youtubeTrailer(info.YoutubeTrailer),
+	}}
+	if info.Name != nil && *info.Name != "" {
+		m.Title = *info.Name
+	}
+	if info.OriginalName != nil && *info.OriginalName != m.Title {
+		m.OriginalTitle = *info.OriginalName
+	}
+	if m.Plot == "" && info.Description != nil {
+		m.Plot = *info.Description
+	}
+	if info.Country != nil {
+		m.Countries = split(*info.Country)
+	}
+
+	rating := info.Rating
+	if rating == 0 {
+		rating = stream.Rating
+	}
+	m.Ratings = ratings(rating)
+
+	tmdbID := info.TMDBID
+	if tmdbID == 0 && stream.TMDBID != nil {
+		tmdbID = *stream.TMDBID
+	}
+	m.UniqueIDs = uniqueIDs(tmdbID)
+
+	cover := info.MovieImage
+	if cover == "" && info.CoverBig != nil {
+		cover = *info.CoverBig
+	}
+	if cover == "" {
+		cover = stream.StreamIcon
+	}
+	m.Thumbs = posters(cover)
+	m.Fanart = fanart(info.BackdropPath)
+
+	m.Premiered, m.Year = released(info.ReleaseDate)
+
+	cast := info.Cast
+	if cast == "" && info.Actors != nil {
+		cast = *info.Actors
+	}
+	m.Actors = actors(cast)
+
+	return encode(m)
+}
+
+// tvShowNFO returns the Kodi NFO of a series.
+func tvShowNFO(stream *xtream.SeriesStream, info *xtream.SeriesInfo) ([]byte, error) {
+	s := tvShow{nfoCommon: nfoCommon{
+		Title:     info.Name,
+		Plot:      info.Plot,
+		Runtime:   info.EpisodeRunTime,
+		Genres:    split(info.Genre),
+		Directors: split(info.Director),
+		Trailer:   youtubeTrailer(info.YoutubeTrailer),
+		Ratings:   ratings(info.Rating),
+		Thumbs:    posters(info.Cover),
+		Fanart:    fanart(info.BackdropPath),
+		Actors:    actors(info.Cast),
+	}}
+	if s.Title == "" {
+		s.Title = stream.Name
+	}
+	if info.TMDBID != nil {
+		s.UniqueIDs = uniqueIDs(*info.TMDBID)
+	} else if stream.TMDBID != nil {
+		s.UniqueIDs = uniqueIDs(*stream.TMDBID)
+	}
+	s.Premiered, s.Year = released(info.ReleaseDate)
+
+	return encode(s)
+}
+
+// episodeNFO returns the Kodi NFO of an episode, from its free-form episode info.
+func episodeNFO(show string, season int, episode *xtream.Episode) ([]byte, error) {
+	info := episode.EpisodeInfo
+	e := episodeDetails{
+		Title:     episode.Title,
+		ShowTitle: show,
+		Season:    season,
+		Episode:   episode.EpisodeNumber,
+		Plot:      infoString(info, "plot", "overview"),
+		Thumbs:    posters(infoString(info, "movie_image", "cover_big")),
+		Aired:     infoString(info, "air_date", "releasedate", "release_date"),
+	}
+	if rating, err := strconv.ParseFloat(infoString(info, "rating"), 64); err == nil {
+		e.Ratings = ratings(rating)
+	}
+	if seconds, err := strconv.Atoi(infoString(info, "duration_secs")); err == nil {
+		e.Runtime = seconds / 60
+	}
+
+	return encode(e)
+}
+
+// encode returns the indented XML document of an NFO.
+func encode(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+func split(s string) []string {
+	var list []string
+	for _, v := range listSeparator.Split(strings.TrimSpace(s), -1) {
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+func actors(cast string) []nfoActor {
+	var list []nfoActor
+	for _, name := range split(cast) {
+		list = append(list, nfoActor{Name: name})
+	}
+
+	return list
+}
+
+func ratings(rating float64) *nfoRatings {
+	if rating <= 0 {
+		return nil
+	}
+
+	return &nfoRatings{Ratings: []nfoRating{{Name: "themoviedb", Max: 10, Default: true, Value: math.Round(rating*10) / 10}}}
+}
+
+func uniqueIDs(tmdbID int) []nfoUniqueID {
+	if tmdbID <= 0 {
+		return nil
+	}
+
+	return []nfoUniqueID{{Type: "tmdb", Default: true, ID: strconv.Itoa(tmdbID)}}
+}
+
+func posters(url string) []nfoThumb {
+	if url == "" {
+		return nil
+	}
+
+	return []nfoThumb{{Aspect: "poster", URL: url}}
+}
+
+func fanart(urls []string) *nfoFanart {
+	var f nfoFanart
+	for _, url := range urls {
+		if url != "" {
+			f.Thumbs = append(f.Thumbs, nfoThumb{URL: url})
+		}
+	}
+	if len(f.Thumbs) == 0 {
+		return nil
+	}
+
+	return &f
+}
+
+func released(date time.Time) (string, int) {
+	if date.IsZero() {
+		return "", 0
+	}
+
+	return date.Format("2006-01-02"), date.Year()
+}
+
+// youtubeTrailer returns the Kodi url of a YouTube trailer ID.
+func youtubeTrailer(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	return "plugin://plugin.video.youtube/?action=play_video&videoid=" + id
+}
+
+// infoString returns the first non empty value of the keys, the providers send strings or numbers.
+func infoString(info map[string]any, keys ...string) string {
+	for _, k := range keys {
+		switch v := info[k].(type) {
+		case nil:
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+
+	return ""
+}
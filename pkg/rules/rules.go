@@ -0,0 +1,261 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rules filters and rewrites the tracks of a playlist before it is proxyfied.
+package rules
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jamesnetherton/m3u"
+	"go.yaml.in/yaml/v3"
+)
+
+// Actions of a rule.
+const (
+	ActionInclude = "include"
+	ActionExclude = "exclude"
+)
+
+// Track tag names.
+const (
+	TagGroupTitle = "group-title"
+	TagTvgID      = "tvg-id"
+	TagTvgLogo    = "tvg-logo"
+	TagTvgChno    = "tvg-chno"
+)
+
+// Match selects tracks with regular expressions, all the set fields must match.
+type Match struct {
+	Name  string `yaml:"name"`
+	Group string `yaml:"group"`
+	TvgID string `yaml:"tvg_id"`
+
+	name, group, tvgID *regexp.Regexp
+}
+
+// Set rewrites the matching tracks.
+// Name and Group can reference the groups of their Match expression e.g "$1".
+// TvgChno ending with "+" numbers the matching tracks kept by the rules from that value e.g "100+".
+type Set struct {
+	Name    string `yaml:"name"`
+	Group   string `yaml:"group"`
+	TvgID   string `yaml:"tvg_id"`
+	TvgLogo string `yaml:"tvg_logo"`
+	TvgChno string `yaml:"tvg_chno"`
+}
+
+// Rule is applied to the tracks it matches.
+type Rule struct {
+	Match  Match  `yaml:"match"`
+	Action string `yaml:"action"`
+	Set    Set    `yaml:"set"`
+}
+
+// Rules is the ordered list of rules of a rules file.
+// When there is an include rule, only the included tracks are kept.
+type Rules struct {
+	Rules []Rule `yaml:"rules"`
+
+	hasInclude bool
+}
+
+// Load reads a YAML or JSON rules file.
+func Load(path string) (*Rules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rules{}
+	if err := yaml.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("rules file %q: %w", path, err)
+	}
+
+	if err := r.compile(); err != nil {
+		return nil, fmt.Errorf("rules file %q: %w", path, err)
+	}
+
+	return r, nil
+}
+
+func compile(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile(expr)
+}
+
+func (r *Rules) compile() error {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+
+		switch rule.Action {
+		case "", ActionExclude:
+		case ActionInclude:
+			r.hasInclude = true
+		default:
+			return fmt.Errorf("rule %d: unknown action %q", i, rule.Action)
+		}
+
+		var err error
+		if rule.Match.name, err = compile(rule.Match.Name); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if rule.Match.group, err = compile(rule.Match.Group); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if rule.Match.tvgID, err = compile(rule.Match.TvgID); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if chno := strings.TrimSuffix(rule.Set.TvgChno, "+"); chno != "" {
+			if _, err := strconv.Atoi(chno); err != nil {
+				return fmt.Errorf("rule %d: invalid tvg_chno %q", i, rule.Set.TvgChno)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Tag returns the value of a track tag, tag names are case insensitive.
+func Tag(track *m3u.Track, name string) string {
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			return tag.Value
+		}
+	}
+
+	return ""
+}
+
+// SetTag sets or adds a track tag.
+func SetTag(track *m3u.Track, name, value string) {
+	for i := range track.Tags {
+		if strings.EqualFold(track.Tags[i].Name, name) {
+			track.Tags[i].Value = value
+			return
+		}
+	}
+
+	track.Tags = append(track.Tags, m3u.Tag{Name: name, Value: value})
+}
+
+func (m *Match) matches(track *m3u.Track) bool {
+	if m.name != nil && !m.name.MatchString(track.Name) {
+		return false
+	}
+	if m.group != nil && !m.group.MatchString(Tag(track, TagGroupTitle)) {
+		return false
+	}
+	if m.tvgID != nil && !m.tvgID.MatchString(Tag(track, TagTvgID)) {
+		return false
+	}
+
+	return true
+}
+
+// Apply returns the tracks filtered and rewritten by the rules.
+// The tags of the returned tracks are copies, tracks isn't modified.
+func (r *Rules) Apply(tracks []m3u.Track) []m3u.Track {
+	if r == nil || len(r.Rules) == 0 {
+		return tracks
+	}
+
+	// next channel number of the "N+" tvg_chno rules
+	chno := make([]int, len(r.Rules))
+	for i, rule := range r.Rules {
+		if strings.HasSuffix(rule.Set.TvgChno, "+") {
+			chno[i], _ = strconv.Atoi(strings.TrimSuffix(rule.Set.TvgChno, "+"))
+		}
+	}
+
+	filtered := make([]m3u.Track, 0, len(tracks))
+tracks:
+	for _, track := range tracks {
+		track.Tags = append([]m3u.Tag(nil), track.Tags...)
+		included := !r.hasInclude
+		// "N+" rule numbering the track once it is kept, -1 if none
+		numbered := -1
+
+		for i := range r.Rules {
+			rule := &r.Rules[i]
+			if !rule.Match.matches(&track) {
+				continue
+			}
+
+			switch rule.Action {
+			case ActionExclude:
+				continue tracks
+			case ActionInclude:
+				included = true
+			}
+
+			rule.Set.apply(&rule.Match, &track)
+			if rule.Set.TvgChno != "" {
+				numbered = -1
+				if strings.HasSuffix(rule.Set.TvgChno, "+") {
+					numbered = i
+				}
+			}
+		}
+
+		if !included {
+			continue
+		}
+		if numbered >= 0 {
+			SetTag(&track, TagTvgChno, strconv.Itoa(chno[numbered]))
+			chno[numbered]++
+		}
+		filtered = append(filtered, track)
+	}
+
+	return filtered
+}
+
+// apply rewrites track, the "N+" tvg_chno are numbered by Apply.
+func (s *Set) apply(m *Match, track *m3u.Track) {
+	if s.Name != "" {
+		if m.name != nil {
+			track.Name = m.name.ReplaceAllString(track.Name, s.Name)
+		} else {
+			track.Name = s.Name
+		}
+	}
+	if s.Group != "" {
+		group := s.Group
+		if m.group != nil {
+			group = m.group.ReplaceAllString(Tag(track, TagGroupTitle), s.Group)
+		}
+		SetTag(track, TagGroupTitle, group)
+	}
+	if s.TvgID != "" {
+		SetTag(track, TagTvgID, s.TvgID)
+	}
+	if s.TvgLogo != "" {
+		SetTag(track, TagTvgLogo, s.TvgLogo)
+	}
+	if s.TvgChno != "" && !strings.HasSuffix(s.TvgChno, "+") {
+		SetTag(track, TagTvgChno, s.TvgChno)
+	}
+}
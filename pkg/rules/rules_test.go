@@ -0,0 +1,113 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jamesnetherton/m3u"
+)
+
+func track(name, group, tvgID string) m3u.Track {
+	return m3u.Track{
+		Name: name,
+		URI:  "http://example.com/" + name,
+		Tags: []m3u.Tag{{Name: "tvg-ID", Value: tvgID}, {Name: TagGroupTitle, Value: group}},
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  []m3u.Track
+	}{
+		{
+			name:  "exclude by group",
+			rules: []Rule{{Match: Match{Group: "^AR"}, Action: ActionExclude}},
+			want:  []m3u.Track{track("FR: TF1", "FR News", "tf1.fr"), track("UK: BBC One", "UK", "bbc1.uk")},
+		},
+		{
+			name:  "include by tvg-id",
+			rules: []Rule{{Match: Match{TvgID: `\.fr$`}, Action: ActionInclude}},
+			want:  []m3u.Track{track("FR: TF1", "FR News", "tf1.fr")},
+		},
+		{
+			name: "rename and override",
+			rules: []Rule{
+				{Match: Match{Name: `^\w+: (.*)$`}, Set: Set{Name: "$1"}},
+				{Match: Match{Group: "^FR (.*)$"}, Set: Set{Group: "France $1", TvgLogo: "http://logo/tf1.png"}},
+				{Match: Match{Name: "BBC"}, Set: Set{TvgID: "bbcone.uk"}},
+				{Action: ActionInclude, Match: Match{Group: "France|UK"}, Set: Set{TvgChno: "100+"}},
+			},
+			want: []m3u.Track{
+				{
+					Name: "TF1",
+					URI:  "http://example.com/FR: TF1",
+					Tags: []m3u.Tag{
+						{Name: "tvg-ID", Value: "tf1.fr"},
+						{Name: TagGroupTitle, Value: "France News"},
+						{Name: TagTvgLogo, Value: "http://logo/tf1.png"},
+						{Name: TagTvgChno, Value: "100"},
+					},
+				},
+				{
+					Name: "BBC One",
+					URI:  "http://example.com/UK: BBC One",
+					Tags: []m3u.Tag{
+						{Name: "tvg-ID", Value: "bbcone.uk"},
+						{Name: TagGroupTitle, Value: "UK"},
+						{Name: TagTvgChno, Value: "101"},
+					},
+				},
+			},
+		},
+		{
+			name: "number the kept tracks",
+			rules: []Rule{
+				{Set: Set{TvgChno: "1+"}},
+				{Match: Match{Group: "^AR"}, Action: ActionExclude},
+			},
+			want: []m3u.Track{
+				{
+					Name: "FR: TF1",
+					URI:  "http://example.com/FR: TF1",
+					Tags: []m3u.Tag{
+						{Name: "tvg-ID", Value: "tf1.fr"},
+						{Name: TagGroupTitle, Value: "FR News"},
+						{Name: TagTvgChno, Value: "1"},
+					},
+				},
+				{
+					Name: "UK: BBC One",
+					URI:  "http://example.com/UK: BBC One",
+					Tags: []m3u.Tag{
+						{Name: "tvg-ID", Value: "bbc1.uk"},
+						{Name: TagGroupTitle, Value: "UK"},
+						{Name: TagTvgChno, Value: "2"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracks := []m3u.Track{
+				track("FR: TF1", "FR News", "tf1.fr"),
+				track("AR: MBC", "AR", "mbc.ar"),
+				track("UK: BBC One", "UK", "bbc1.uk"),
+			}
+			r := &Rules{Rules: tt.rules}
+			if err := r.compile(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := r.Apply(tracks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %+v, want %+v", got, tt.want)
+			}
+			if tracks[0].Name != "FR: TF1" || tracks[0].Tags[1].Value != "FR News" {
+				t.Errorf("Apply() modified its input: %+v", tracks[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+)
+
+// apiFetchFunc calls the upstream API, it returns the response or an error and its status code.
+type apiFetchFunc func() ([]byte, int, error)
+
+// encodeAPIEntry prefixes a cached API response with the end of its freshness.
+func encodeAPIEntry(body []byte, freshUntil time.Time) []byte {
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint64(b, uint64(freshUntil.UnixNano()))
+
+	return append(b, body...)
+}
+
+func decodeAPIEntry(b []byte) ([]byte, time.Time, bool) {
+	if len(b) < 8 {
+		return nil, time.Time{}, false
+	}
+
+	return b[8:], time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
+
+// defaultAPICacheTTLs is how long the responses of the catalogue actions stay fresh by default.
+var defaultAPICacheTTLs = map[string]time.Duration{
+	"get_live_categories":   time.Hour,
+	"get_live_streams":      10 * time.Minute,
+	"get_vod_categories":    time.Hour,
+	"get_vod_streams":       time.Hour,
+	"get_vod_info":          6 * time.Hour,
+	"get_series_categories": time.Hour,
+	"get_series":            time.Hour,
+	"get_series_info":       time.Hour,
+}
+
+// epgAPICacheStale caps the stale period of the guide actions, their programmes
+// go out of date as the time passes.
+const epgAPICacheStale = 5 * time.Minute
+
+// apiCacheStale returns how long the response of a player_api action is still served once expired.
+func (c *Config) apiCacheStale(action string) time.Duration {
+	stale := time.Duration(c.APICacheStale) * time.Minute
+	if (action == "get_short_epg" || action == "get_simple_data_table") && stale > epgAPICacheStale {
+		return epgAPICacheStale
+	}
+
+	return stale
+}
+
+// apiCacheTTL returns how long the response of a player_api action stays fresh.
+func (c *Config) apiCacheTTL(action string) time.Duration {
+	if ttl, ok := c.APICacheTTLs[action]; ok {
+		return ttl
+	}
+	if ttl, ok := defaultAPICacheTTLs[action]; ok && c.APICacheExpiration > 0 {
+		return ttl
+	}
+
+	return time.Duration(c.APICacheExpiration) * time.Minute
+}
+
+// cachedAPIResponse returns the cached response of key, or fetches and caches it for ttl.
+// A response older than ttl is still served during the stale period while it is fetched again in background.
+func (c *Config) cachedAPIResponse(ctx *gin.Context, key string, ttl, stale time.Duration, fetch apiFetchFunc) ([]byte, int, error) {
+	if ttl <= 0 {
+		return fetch()
+	}
+
+	b, err := c.cache.Get(ctx.Request.Context(), key)
+	if err == nil {
+		if body, freshUntil, ok := decodeAPIEntry(b); ok {
+			if time.Now().After(freshUntil) {
+				c.revalidateAPIResponse(key, ttl, stale, fetch)
+			}
+			return body, 0, nil
+		}
+	} else if !errors.Is(err, cache.ErrMiss) {
+		utils.PrintErrorAndReturn(err) // nolint: errcheck
+	}
+
+	body, code, err := fetch()
+	if err != nil {
+		return nil, code, err
+	}
+	c.storeAPIResponse(ctx.Request.Context(), key, body, ttl, stale)
+
+	return body, 0, nil
+}
+
+// revalidateAPIResponse fetches a stale response again in background, once at a time per key.
+func (c *Config) revalidateAPIResponse(key string, ttl, stale time.Duration, fetch apiFetchFunc) {
+	if _, loaded := c.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	go func() {
+		defer c.revalidating.Delete(key)
+
+		body, _, err := fetch()
+		if err != nil {
+			log.Printf("[iptv-proxy] ERROR: revalidate cached response: %v", err)
+			return
+		}
+		c.storeAPIResponse(context.Background(), key, body, ttl, stale)
+	}()
+}
+
+func (c *Config) storeAPIResponse(ctx context.Context, key string, body []byte, ttl, stale time.Duration) {
+	if err := c.cache.Set(ctx, key, encodeAPIEntry(body, time.Now().Add(ttl)), ttl+stale); err != nil {
+		utils.PrintErrorAndReturn(err) // nolint: errcheck
+	}
+}
+
+// playerAPICacheKey returns the cache key of a player_api.php response,
+// the responses are filtered by the user entitlements.
+func playerAPICacheKey(user *config.User, action string, q url.Values) string {
+	params := url.Values{}
+	for k, v := range q {
+		if k != "username" && k != "password" {
+			params[k] = v
+		}
+	}
+
+	return user.Username.String() + "|player_api|" + action + "|" + params.Encode()
+}
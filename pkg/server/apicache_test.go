@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestCachedAPIResponse(t *testing.T) {
+	c := &Config{
+		cache: cache.NewMemory(),
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/player_api.php", nil)
+
+	var calls int32
+	fetch := func() ([]byte, int, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return []byte("first"), 0, nil
+		}
+		return []byte("second"), 0, nil
+	}
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want string
+	}{
+		{"miss", time.Hour, "first"},
+		{"fresh hit", time.Hour, "first"},
+		{"no cache", 0, "second"},
+	}
+	for _, tt := range tests {
+		body, _, err := c.cachedAPIResponse(ctx, "key", tt.ttl, 10*time.Minute, fetch)
+		if err != nil || string(body) != tt.want {
+			t.Errorf("%s: cachedAPIResponse() = %q, %v, want %q", tt.name, body, err, tt.want)
+		}
+	}
+
+	c.storeAPIResponse(ctx.Request.Context(), "stale", []byte("old"), -time.Minute, 10*time.Minute)
+	body, _, _ := c.cachedAPIResponse(ctx, "stale", time.Hour, 10*time.Minute, fetch)
+	if string(body) != "old" {
+		t.Errorf("stale hit = %q, want %q", body, "old")
+	}
+	for i := 0; i < 100; i++ {
+		if _, loaded := c.revalidating.Load("stale"); !loaded {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	body, _, _ = c.cachedAPIResponse(ctx, "stale", time.Hour, 10*time.Minute, fetch)
+	if string(body) != "second" {
+		t.Errorf("revalidated hit = %q, want %q", body, "second")
+	}
+}
+
+func TestAPICacheStale(t *testing.T) {
+	c := &Config{ProxyConfig: &config.ProxyConfig{APICacheStale: 1440}}
+
+	tests := []struct {
+		action string
+		want   time.Duration
+	}{
+		{"get_live_streams", 24 * time.Hour},
+		{"get_short_epg", epgAPICacheStale},
+		{"get_simple_data_table", epgAPICacheStale},
+	}
+	for _, tt := range tests {
+		if got := c.apiCacheStale(tt.action); got != tt.want {
+			t.Errorf("apiCacheStale(%q) = %v, want %v", tt.action, got, tt.want)
+		}
+	}
+
+	c.APICacheStale = 1
+	if got := c.apiCacheStale("get_short_epg"); got != time.Minute {
+		t.Errorf("apiCacheStale(get_short_epg) below the cap = %v, want %v", got, time.Minute)
+	}
+}
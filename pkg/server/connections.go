@@ -0,0 +1,239 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+)
+
+// connectionLimitError is returned when all the upstream connections of a source account are in use.
+type connectionLimitError struct {
+	source string
+	limit  int
+}
+
+func (e *connectionLimitError) Error() string {
+	return fmt.Sprintf("source %q: the %d upstream connections of the account are in use", e.source, e.limit)
+}
+
+// connectionLimitRetryDelay is the delay before fetching again the limit of an xtream account after a failure.
+const connectionLimitRetryDelay = time.Minute
+
+// fallbackMaxConnections is the limit of an xtream account until its limit is fetched.
+const fallbackMaxConnections = 1
+
+// connectionAccountant counts the active upstream streams of each source account.
+type connectionAccountant struct {
+	lock sync.Mutex
+	// one slot per allowed connection, by source
+	slots map[*config.Source]chan struct{}
+	// next fetch of the limit of the accounts whose fetch failed
+	retries map[*config.Source]time.Time
+}
+
+func newConnectionAccountant() *connectionAccountant {
+	return &connectionAccountant{slots: map[*config.Source]chan struct{}{}, retries: map[*config.Source]time.Time{}}
+}
+
+// sourceSlots returns the connection slots of the source, nil if it is unlimited.
+// The limit of an xtream account not configured is fetched from the account once,
+// after a failure the fallback limit is used and the limit is fetched again in the background.
+func (c *Config) sourceSlots(s *config.Source) chan struct{} {
+	a := c.connections
+
+	a.lock.Lock()
+	slots, ok := a.slots[s]
+	if retry, failed := a.retries[s]; ok && failed && time.Now().After(retry) {
+		a.retries[s] = time.Now().Add(connectionLimitRetryDelay)
+		go c.fetchSourceSlots(s)
+	}
+	a.lock.Unlock()
+	if ok {
+		return slots
+	}
+
+	return c.fetchSourceSlots(s)
+}
+
+// fetchSourceSlots sets the connection slots of the source from its limit.
+func (c *Config) fetchSourceSlots(s *config.Source) chan struct{} {
+	a := c.connections
+
+	limit := s.MaxConnections
+	var err error
+	if limit == 0 && s.IsXtream() {
+		if limit, err = xtreamMaxConnections(s); err != nil {
+			log.Printf("[iptv-proxy] ERROR: source %q: max connections: %v, %d until it is fetched again", s.Name, err, fallbackMaxConnections)
+			limit = fallbackMaxConnections
+		}
+	}
+	var slots chan struct{}
+	if limit > 0 {
+		slots = make(chan struct{}, limit)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, failed := a.retries[s]
+	current, ok := a.slots[s]
+	switch {
+	case err != nil:
+		a.retries[s] = time.Now().Add(connectionLimitRetryDelay)
+		// The fallback slots in use are kept.
+		if ok {
+			return current
+		}
+	case failed:
+		// The fetched limit replaces the fallback one.
+		delete(a.retries, s)
+	case ok:
+		return current
+	}
+	a.slots[s] = slots
+
+	return slots
+}
+
+func xtreamMaxConnections(s *config.Source) (int, error) {
+	client, err := xtreamapi.New(s, "")
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := client.GetAuthInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.UserInfo.MaxConnections, nil
+}
+
+// acquireConnection reserves an upstream connection of the source account, waiting
+// up to the connection queue timeout for one to be released if wait is set.
+// The returned func releases it.
+func (c *Config) acquireConnection(ctx context.Context, s *config.Source, wait bool) (func(), error) {
+	release := func() {}
+	if s == nil {
+		return release, nil
+	}
+
+	slots := c.sourceSlots(s)
+	if slots == nil {
+		return release, nil
+	}
+	release = func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	// Shared live streams waiting for their grace period hold connections nobody watches.
+	if c.fanout != nil {
+		c.fanout.CloseIdle(func(key string) bool {
+			u, err := url.Parse(key)
+			return err == nil && c.upstreamSource(u) == s
+		})
+	}
+
+	if !wait {
+		return nil, &connectionLimitError{source: s.Name, limit: cap(slots)}
+	}
+
+	timer := time.NewTimer(time.Duration(c.ConnectionQueueTimeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, &connectionLimitError{source: s.Name, limit: cap(slots)}
+	}
+}
+
+// upstreamConnections returns the func reserving the connection of the source account
+// of an upstream url, see acquireConnection. ctx bounds the wait for a connection.
+func (c *Config) upstreamConnections(ctx context.Context) func(u *url.URL, wait bool) (func(), error) {
+	return func(u *url.URL, wait bool) (func(), error) {
+		return c.acquireConnection(ctx, c.upstreamSource(u), wait)
+	}
+}
+
+// sourceConnections is upstreamConnections with the source accounts of the urls built from a source, by url.
+func (c *Config) sourceConnections(ctx context.Context, sources map[string]*config.Source) func(u *url.URL, wait bool) (func(), error) {
+	return func(u *url.URL, wait bool) (func(), error) {
+		s, ok := sources[u.String()]
+		if !ok {
+			s = c.upstreamSource(u)
+		}
+		return c.acquireConnection(ctx, s, wait)
+	}
+}
+
+// upstreamSource returns the source account of an upstream url, nil if it is unknown.
+func (c *Config) upstreamSource(u *url.URL) *config.Source {
+	for _, s := range c.XtreamSources() {
+		if !strings.Contains(u.Path, "/"+s.XtreamUser.String()+"/") && u.Query().Get("username") != s.XtreamUser.String() {
+			continue
+		}
+		for _, baseURL := range s.XtreamBaseURLs() {
+			if b, err := url.Parse(baseURL); err == nil && b.Host == u.Host {
+				return s
+			}
+		}
+	}
+
+	for _, s := range c.Sources {
+		if s.M3UURL == "" || s.IsXtream() {
+			continue
+		}
+		if m, err := url.Parse(s.M3UURL); err == nil && m.Host != "" && m.Host == u.Host {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// refuseStream answers a stream request refused by the connection limit.
+func refuseStream(ctx *gin.Context, err error) {
+	log.Printf("[iptv-proxy] %v | %s | stream refused: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), err)
+
+	ctx.Header("Retry-After", "10")
+	ctx.String(http.StatusServiceUnavailable, "Too many streams: %v, stop another stream and retry.", err)
+	ctx.Abort()
+}
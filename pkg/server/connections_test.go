@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestAcquireConnection(t *testing.T) {
+	sources, err := config.NewSources(
+		config.Source{Name: "provider1", XtreamBaseURL: "http://provider1.example.com", XtreamUser: "user", XtreamPassword: "pass", MaxConnections: 1},
+		config.Source{Name: "free", M3UURL: "http://free.example.com/list.m3u", MaxConnections: -1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: sources},
+		connections: newConnectionAccountant(),
+	}
+
+	tests := []struct {
+		url  string
+		want *config.Source
+	}{
+		{"http://provider1.example.com/live/user/pass/1.ts", sources[0]},
+		{"http://provider1.example.com/get.php?username=user&password=pass", sources[0]},
+		{"http://provider1.example.com/live/other/pass/1.ts", nil},
+		{"http://free.example.com/1.ts", sources[1]},
+		{"http://unknown.example.com/1.ts", nil},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.upstreamSource(u); got != tt.want {
+			t.Errorf("upstreamSource(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+
+	release, err := c.acquireConnection(context.Background(), sources[0], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limitErr *connectionLimitError
+	if _, err := c.acquireConnection(context.Background(), sources[0], true); !errors.As(err, &limitErr) {
+		t.Errorf("acquireConnection() above the limit = %v, want a connection limit error", err)
+	}
+	release()
+	if _, err := c.acquireConnection(context.Background(), sources[0], true); err != nil {
+		t.Errorf("acquireConnection() after release = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.acquireConnection(context.Background(), sources[1], true); err != nil {
+			t.Errorf("acquireConnection() on an unlimited source = %v", err)
+		}
+	}
+}
+
+func TestSourceSlotsFallback(t *testing.T) {
+	var fetches int32
+	var up atomic.Value
+	up.Store(false)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if !up.Load().(bool) {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"user_info":{"username":"user","auth":1,"status":"Active","max_connections":"2"},"server_info":{}}`)
+	}))
+	defer upstream.Close()
+
+	sources, err := config.NewSources(config.Source{Name: "provider", XtreamBaseURL: upstream.URL, XtreamUser: "user", XtreamPassword: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sources[0]
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: sources},
+		connections: newConnectionAccountant(),
+	}
+
+	// The account is limited to the fallback limit while its limit can't be fetched.
+	for i := 0; i < 3; i++ {
+		if slots := c.sourceSlots(s); cap(slots) != fallbackMaxConnections {
+			t.Fatalf("slots without the account limit = %d, want %d", cap(slots), fallbackMaxConnections)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("limit fetched %d times within the retry delay, want 1", n)
+	}
+
+	// The limit is fetched again once the retry delay is over.
+	up.Store(true)
+	c.connections.lock.Lock()
+	c.connections.retries[s] = time.Now().Add(-time.Second)
+	c.connections.lock.Unlock()
+	c.sourceSlots(s)
+	deadline := time.Now().Add(5 * time.Second)
+	for cap(c.sourceSlots(s)) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("slots after the retry = %d, want 2", cap(c.sourceSlots(s)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
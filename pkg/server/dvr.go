@@ -0,0 +1,568 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/dvr"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+const (
+	// dvrIDBase is the xtream ID of the recordings category, the VOD ID of a recording is dvrIDBase + its ID.
+	// It is above the IDs of the xtream sources and the recording IDs up to 47483647 stay within int32.
+	dvrIDBase = config.MaxXtreamSources * config.SourceIDStride
+	// dvrRetryDelay is the wait before a dropped recording requests its stream again.
+	dvrRetryDelay = 5 * time.Second
+)
+
+func newDVR(c *Config) (*dvr.Scheduler, error) {
+	return dvr.New(c.DVRDir, dvr.Options{
+		PaddingStart: time.Duration(c.DVRPaddingStart) * time.Minute,
+		PaddingEnd:   time.Duration(c.DVRPaddingEnd) * time.Minute,
+		RetryDelay:   dvrRetryDelay,
+	}, c.dvrRecord)
+}
+
+// dvrRecord pulls the live stream of a recording through the proxy routes,
+// with the account, the entitlements and the connection limits of its user.
+func (c *Config) dvrRecord(ctx context.Context, e dvr.Entry, w io.Writer) error {
+	var user *config.User
+	for _, u := range c.Users.Users() {
+		if u.Username.String() == e.User {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		return fmt.Errorf("no account %q", e.User)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := path.Join("/", c.CustomEndpoint, "live", url.PathEscape(user.Username.String()), url.PathEscape(user.Password.String()), e.Channel+".ts")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://127.0.0.1"+p, nil)
+	if err != nil {
+		return err
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("User-Agent", "iptv-proxy-dvr")
+
+	rw := &recordingWriter{w: w, header: http.Header{}, ctx: ctx}
+	c.httpServer.Handler.ServeHTTP(rw, req)
+	if rw.status != http.StatusOK {
+		return fmt.Errorf("stream answered %d %s", rw.status, http.StatusText(rw.status))
+	}
+
+	return rw.err
+}
+
+// recordingWriter is the response writer of a recorded stream.
+type recordingWriter struct {
+	w      io.Writer
+	header http.Header
+	status int
+	ctx    context.Context
+	err    error
+}
+
+func (w *recordingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status != http.StatusOK {
+		return len(b), nil
+	}
+
+	n, err := w.w.Write(b)
+	if err != nil {
+		w.err = err
+	}
+
+	return n, err
+}
+
+func (w *recordingWriter) Flush() {}
+
+// CloseNotify reports the end of the recording to the streaming handlers.
+func (w *recordingWriter) CloseNotify() <-chan bool {
+	closed := make(chan bool, 1)
+	go func() {
+		<-w.ctx.Done()
+		closed <- true
+	}()
+
+	return closed
+}
+
+// dvrScheduleRequest schedules a recording of a channel between two times, or of a guide programme.
+type dvrScheduleRequest struct {
+	// Channel is the stream ID of the live channel, found from the guide channel of the programme if empty.
+	Channel string    `json:"channel"`
+	Title   string    `json:"title"`
+	Start   time.Time `json:"start"`
+	Stop    time.Time `json:"stop"`
+	// ProgrammeID is the guide channel ID and the XMLTV start of a programme, e.g "TF1.fr@20261017203000 +0200".
+	ProgrammeID string `json:"programme_id"`
+}
+
+func (c *Config) dvrList(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.dvr.Recordings(contextUser(ctx).Username.String()))
+}
+
+func (c *Config) dvrSchedule(ctx *gin.Context) {
+	var req dvrScheduleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	if req.ProgrammeID != "" {
+		if err := c.dvrProgramme(ctx, &req); err != nil {
+			ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+			return
+		}
+	}
+	if _, err := strconv.Atoi(req.Channel); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, utils.PrintErrorAndReturn(fmt.Errorf("invalid channel %q", req.Channel))) // nolint: errcheck
+		return
+	}
+	if !c.dvrEntitled(ctx, req.Channel) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	e, err := c.dvr.Schedule(dvr.Entry{
+		User:        contextUser(ctx).Username.String(),
+		Channel:     req.Channel,
+		ProgrammeID: req.ProgrammeID,
+		Title:       req.Title,
+		Start:       req.Start,
+		Stop:        req.Stop,
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, e)
+}
+
+// dvrEntitled reports whether the request user can watch the live channel of a recording.
+func (c *Config) dvrEntitled(ctx *gin.Context, channel string) bool {
+	if len(c.XtreamSources()) > 0 {
+		return c.xtreamEntitled(ctx, config.ContentLive, channel, false)
+	}
+
+	snapshot := c.playlist.get()
+	_, _, err := snapshot.track(channel)
+
+	return err == nil && contextUser(ctx).Entitlements.Allows(snapshot.content(channel))
+}
+
+// dvrProgramme fills the times, the title and the channel of a recording from its guide programme.
+func (c *Config) dvrProgramme(ctx *gin.Context, req *dvrScheduleRequest) error {
+	i := strings.LastIndex(req.ProgrammeID, "@")
+	if i < 0 || c.epg == nil {
+		return fmt.Errorf("unknown programme %q", req.ProgrammeID)
+	}
+	channelID := req.ProgrammeID[:i]
+	start, err := time.Parse(dvr.ProgrammeTimeLayout, req.ProgrammeID[i+1:])
+	if err != nil {
+		return fmt.Errorf("programme %q: %w", req.ProgrammeID, err)
+	}
+
+	var found bool
+	for _, l := range c.epg.Listings(channelID) {
+		if l.Start.Equal(start) {
+			req.Start, req.Stop, found = l.Start, l.Stop, true
+			if req.Title == "" {
+				req.Title = l.Title
+			}
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown programme %q", req.ProgrammeID)
+	}
+
+	if req.Channel == "" {
+		id, ok := c.guideChannelStream(ctx, ctx.Request.UserAgent(), contextUser(ctx), channelID)
+		if !ok {
+			return fmt.Errorf("no live channel for the guide channel %q", channelID)
+		}
+		req.Channel = strconv.Itoa(id)
+	}
+
+	return nil
+}
+
+// guideChannelStream returns the lowest stream ID of the live channels of a guide channel
+// the user is entitled to.
+func (c *Config) guideChannelStream(ctx context.Context, userAgent string, user *config.User, channelID string) (int, bool) {
+	mapped := c.EPG.ChannelIDs(nil)
+	matches := func(id string) bool {
+		if m, ok := mapped[id]; ok {
+			id = m
+		}
+		return id != "" && id == channelID
+	}
+
+	var ids []int
+	if len(c.XtreamSources()) > 0 {
+		contents, _ := c.catalogContents(ctx, userAgent)
+		for id, content := range contents[config.ContentLive] {
+			if matches(content.EPGChannelID) && (!user.Entitlements.IsRestricted() || user.Entitlements.Allows(content)) {
+				ids = append(ids, id)
+			}
+		}
+	} else if catalog := c.playlist.get().catalog; catalog != nil {
+		for _, s := range catalog.streams {
+			if s.EPGChannelID != nil && matches(*s.EPGChannelID) {
+				ids = append(ids, s.StreamID)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return 0, false
+	}
+	sort.Ints(ids)
+
+	return ids[0], true
+}
+
+func (c *Config) dvrRules(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.dvr.Rules(contextUser(ctx).Username.String()))
+}
+
+func (c *Config) dvrAddRule(ctx *gin.Context) {
+	if c.epg == nil {
+		ctx.AbortWithError(http.StatusBadRequest, utils.PrintErrorAndReturn(errors.New("the rules need an EPG guide"))) // nolint: errcheck
+		return
+	}
+
+	var r dvr.Rule
+	if err := ctx.ShouldBindJSON(&r); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	r.User = contextUser(ctx).Username.String()
+
+	r, err := c.dvr.AddRule(r)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	c.applyDVRRules()
+
+	ctx.JSON(http.StatusCreated, r)
+}
+
+func (c *Config) dvrDeleteRule(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	r, ok := c.dvr.GetRule(id)
+	if err != nil || !ok || r.User != contextUser(ctx).Username.String() {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := c.dvr.DeleteRule(id); err != nil && !errors.Is(err, dvr.ErrNotFound) {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// applyDVRRules schedules the programmes of the cached guide matching the recording rules.
+func (c *Config) applyDVRRules() {
+	if c.dvr == nil || c.epg == nil {
+		return
+	}
+
+	scheduled, err := c.dvr.ApplyRules(dvrGuide{c})
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: recording rules: %v", err)
+	}
+	if len(scheduled) > 0 {
+		log.Printf("[iptv-proxy] %v | recording rules scheduled %d recordings\n", time.Now().Format("2006/01/02 - 15:04:05"), len(scheduled))
+	}
+}
+
+// dvrGuide gives the cached guide and the live channels of the users to the recording rules.
+type dvrGuide struct {
+	c *Config
+}
+
+func (g dvrGuide) Channels() []string {
+	channels := g.c.epg.Channels()
+	ids := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		ids = append(ids, ch.ID)
+	}
+
+	return ids
+}
+
+func (g dvrGuide) Listings(channelID string) []epg.Listing {
+	return g.c.epg.Listings(channelID)
+}
+
+func (g dvrGuide) Stream(username, channelID string) (string, bool) {
+	for _, u := range g.c.Users.Users() {
+		if u.Username.String() == username {
+			id, ok := g.c.guideChannelStream(context.Background(), "", u, channelID)
+			if !ok {
+				return "", false
+			}
+			return strconv.Itoa(id), true
+		}
+	}
+
+	return "", false
+}
+
+func (c *Config) dvrDelete(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	e, ok := c.dvr.Get(id)
+	if err != nil || !ok || e.User != contextUser(ctx).Username.String() {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := c.dvr.Delete(id); err != nil && !errors.Is(err, dvr.ErrNotFound) {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// dvrRecordings returns the completed recordings of a user.
+func (c *Config) dvrRecordings(user *config.User) []dvr.Entry {
+	var completed []dvr.Entry
+	for _, e := range c.dvr.Recordings(user.Username.String()) {
+		if e.Status == dvr.Completed {
+			completed = append(completed, e)
+		}
+	}
+
+	return completed
+}
+
+// dvrCategories returns the recordings VOD category if the user has completed recordings.
+func (c *Config) dvrCategories(user *config.User) []xtream.Category {
+	if c.dvr == nil || len(c.dvrRecordings(user)) == 0 {
+		return []xtream.Category{}
+	}
+
+	return []xtream.Category{{CategoryID: dvrIDBase, CategoryName: "Recordings"}}
+}
+
+// dvrVODStreams returns the completed recordings of a user as VOD streams.
+func (c *Config) dvrVODStreams(user *config.User) []xtream.VODStream {
+	streams := []xtream.VODStream{}
+	if c.dvr == nil {
+		return streams
+	}
+
+	categoryID := dvrIDBase
+	for i, e := range c.dvrRecordings(user) {
+		streams = append(streams, xtream.VODStream{
+			AddedOn:            e.Stop,
+			CategoryID:         &categoryID,
+			CategoryIDs:        []int{categoryID},
+			ContainerExtension: "ts",
+			Name:               dvrName(e),
+			Number:             i + 1,
+			StreamID:           dvrIDBase + e.ID,
+			StreamType:         "movie",
+		})
+	}
+
+	return streams
+}
+
+func dvrName(e dvr.Entry) string {
+	return fmt.Sprintf("%s (%s)", e.Title, e.Start.Local().Format("2006-01-02 15:04"))
+}
+
+// dvrRecording returns the completed recording of a user with a VOD ID, e.g 2100000001.ts.
+func (c *Config) dvrRecording(user *config.User, vodID string) (dvr.Entry, bool) {
+	id, err := strconv.Atoi(strings.TrimSuffix(vodID, path.Ext(vodID)))
+	if err != nil || id <= dvrIDBase {
+		return dvr.Entry{}, false
+	}
+
+	e, ok := c.dvr.Get(id - dvrIDBase)
+	if !ok || e.User != user.Username.String() || e.Status != dvr.Completed {
+		return dvr.Entry{}, false
+	}
+
+	return e, true
+}
+
+// isDVRID reports whether an xtream ID is a recording or the recordings category.
+func isDVRID(id string) bool {
+	n, err := strconv.Atoi(strings.TrimSuffix(id, path.Ext(id)))
+	return err == nil && n >= dvrIDBase
+}
+
+// dvrPlayerAPI answers the player_api actions on the recordings category and its VODs.
+func (c *Config) dvrPlayerAPI(user *config.User, action string, q url.Values) ([]byte, int, bool) {
+	if c.dvr == nil {
+		return nil, 0, false
+	}
+
+	var resp interface{}
+	switch {
+	case action == "get_vod_streams" && isDVRID(q.Get("category_id")):
+		resp = c.dvrVODStreams(user)
+	case action == "get_vod_info" && isDVRID(q.Get("vod_id")):
+		e, ok := c.dvrRecording(user, q.Get("vod_id"))
+		if !ok {
+			return nil, http.StatusNotFound, true
+		}
+		name := dvrName(e)
+		categoryID := dvrIDBase
+		duration := e.Stop.Sub(e.Start)
+		resp = &xtream.VOD{
+			Info: xtream.VODInfo{
+				Name:            &name,
+				Plot:            e.Title,
+				Duration:        duration,
+				DurationSeconds: int(duration.Seconds()),
+				ReleaseDate:     e.Start,
+			},
+			MovieData: xtream.MovieData{
+				AddedOn:            e.Stop,
+				CategoryID:         &categoryID,
+				ContainerExtension: "ts",
+				Name:               name,
+				StreamID:           dvrIDBase + e.ID,
+			},
+		}
+	default:
+		return nil, 0, false
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, http.StatusInternalServerError, true
+	}
+
+	return b, http.StatusOK, true
+}
+
+// serveDVRPlayerAPI answers the player_api actions on the recordings, it reports whether it did.
+func (c *Config) serveDVRPlayerAPI(ctx *gin.Context, action string, q url.Values) bool {
+	b, code, ok := c.dvrPlayerAPI(contextUser(ctx), action, q)
+	if !ok {
+		return false
+	}
+	if code != http.StatusOK {
+		ctx.AbortWithStatus(code)
+		return true
+	}
+
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", b)
+	return true
+}
+
+// appendRecordings adds the recordings category and VODs of a user to the upstream VOD lists.
+func (c *Config) appendRecordings(user *config.User, action string, q url.Values, b []byte) []byte {
+	if c.dvr == nil || q.Get("category_id") != "" {
+		return b
+	}
+
+	switch action {
+	case "get_vod_categories":
+		return appendJSONArray(b, c.dvrCategories(user))
+	case "get_vod_streams":
+		return appendJSONArray(b, c.dvrVODStreams(user))
+	}
+
+	return b
+}
+
+// appendJSONArray appends the JSON encoding of the items list to the JSON array b, b is left unchanged.
+func appendJSONArray(b []byte, items interface{}) []byte {
+	extra, err := json.Marshal(items)
+	if err != nil || len(extra) <= len("[]") {
+		return b
+	}
+
+	array := bytes.TrimSpace(b)
+	if len(array) < 2 || array[0] != '[' || array[len(array)-1] != ']' {
+		return b
+	}
+
+	out := make([]byte, 0, len(array)+len(extra))
+	out = append(out, array[:len(array)-1]...)
+	if len(bytes.TrimSpace(array[1:len(array)-1])) > 0 {
+		out = append(out, ',')
+	}
+	out = append(out, extra[1:]...)
+
+	return out
+}
+
+// dvrMovie serves the recordings of the movie routes, the other IDs go on to the next handler.
+func (c *Config) dvrMovie(ctx *gin.Context) {
+	if !isDVRID(ctx.Param("id")) {
+		return
+	}
+
+	e, ok := c.dvrRecording(contextUser(ctx), ctx.Param("id"))
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.Header("Content-Type", "video/mp2t")
+	ctx.File(c.dvr.Path(e))
+	ctx.Abort()
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/dvr"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+)
+
+func TestDVR(t *testing.T) {
+	// The upstream drops the stream after each chunk.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chunk")) // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	playlist := filepath.Join(dir, "list.m3u")
+	if err := os.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:-1 tvg-id=\"news.fr\" group-title=\"News\",News\n"+upstream.URL+"/news.mp4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := config.NewSources(config.Source{Name: "m3u", M3UURL: playlist})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := config.NewUserStore(
+		config.User{Username: "alice", Password: "secret"},
+		config.User{Username: "bob", Password: "pass"},
+		config.User{Username: "carol", Password: "pass", Entitlements: config.Entitlements{Deny: []config.EntitlementRule{{Group: "News"}}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewServer(&config.ProxyConfig{
+		HostConfig:     &config.HostConfiguration{Hostname: "proxy", Port: 8080},
+		AdvertisedPort: 8080,
+		Sources:        sources,
+		Users:          users,
+		DVRDir:         filepath.Join(dir, "recordings"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.playlistInitialization(); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	c.routes(router.Group("/"))
+	c.httpServer = &http.Server{Handler: router}
+	c.dvr, err = dvr.New(c.DVRDir, dvr.Options{RetryDelay: 10 * time.Millisecond}, c.dvrRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.dvr.Start()
+	defer c.dvr.Close()
+
+	var channel string
+	for id := range c.playlist.get().catalog.tracks {
+		channel = fmt.Sprint(id)
+	}
+	now := time.Now()
+	body, _ := json.Marshal(dvrScheduleRequest{Channel: channel, Title: "Evening news", Start: now, Stop: now.Add(300 * time.Millisecond)})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dvr/recordings?username=carol&password=pass", bytes.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("schedule of a denied channel status = %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dvr/recordings?username=alice&password=secret", bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("schedule status = %d: %s", w.Code, w.Body)
+	}
+	var e dvr.Entry
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Status != dvr.Completed && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		e, _ = c.dvr.Get(e.ID)
+	}
+	if e.Status != dvr.Completed || e.Drops == 0 || e.Size != int64(len("chunk"))*int64(e.Drops) {
+		t.Fatalf("recording = %+v, want completed with a chunk per drop", e)
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	vodID := fmt.Sprint(dvrIDBase + e.ID)
+	if got := get("/player_api.php?username=alice&password=secret&action=get_vod_categories").Body.String(); !strings.Contains(got, `"category_name":"Recordings"`) {
+		t.Errorf("categories = %s", got)
+	}
+	if got := get("/player_api.php?username=alice&password=secret&action=get_vod_streams").Body.String(); !strings.Contains(got, `"stream_id":`+vodID) {
+		t.Errorf("vod streams = %s", got)
+	}
+	if got := get("/player_api.php?username=bob&password=pass&action=get_vod_streams").Body.String(); got != "[]" {
+		t.Errorf("vod streams of another user = %s", got)
+	}
+
+	w = get("/movie/alice/secret/" + vodID + ".ts")
+	if w.Code != http.StatusOK || w.Body.Len() != int(e.Size) || w.Header().Get("Content-Type") != "video/mp2t" {
+		t.Errorf("recording = %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	if w = get("/movie/bob/pass/" + vodID + ".ts"); w.Code != http.StatusNotFound {
+		t.Errorf("recording of another user status = %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/dvr/recordings/%d?username=alice&password=secret", e.ID), nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("delete status = %d", w.Code)
+	}
+	if _, err := os.Stat(c.dvr.Path(e)); !os.IsNotExist(err) {
+		t.Errorf("deleted recording file: %v", err)
+	}
+
+	// A rule records the upcoming programmes of the guide.
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	doc := fmt.Sprintf(`<tv><channel id="news.fr"><display-name>News</display-name></channel>
+<programme start="%s" stop="%s" channel="news.fr"><title>Le journal</title><episode-num system="onscreen">E12</episode-num></programme></tv>`,
+		start.Format(dvr.ProgrammeTimeLayout), start.Add(time.Hour).Format(dvr.ProgrammeTimeLayout))
+	c.epg, err = epg.NewStore(t.TempDir(), []epg.Source{{
+		Name: "test",
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(doc)), nil
+		},
+	}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.epg.Guide(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dvr/rules?username=alice&password=secret", strings.NewReader(`{"title": "le journal", "keep": 5}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add rule status = %d: %s", w.Code, w.Body)
+	}
+	var r dvr.Rule
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	recordings := c.dvr.Recordings("alice")
+	if len(recordings) != 1 || recordings[0].RuleID != r.ID || recordings[0].Channel != channel || !recordings[0].Start.Equal(start) {
+		t.Fatalf("recordings of the rule = %+v", recordings)
+	}
+	if got := get("/dvr/rules?username=bob&password=pass").Body.String(); got != "[]" {
+		t.Errorf("rules of another user = %s", got)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/dvr/rules/%d?username=alice&password=secret", r.ID), nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("delete rule status = %d", w.Code)
+	}
+	if recordings := c.dvr.Recordings("alice"); len(recordings) != 0 {
+		t.Errorf("scheduled recordings of the deleted rule = %+v", recordings)
+	}
+}
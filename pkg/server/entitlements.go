@@ -0,0 +1,318 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+const (
+	// catalogFetchTimeout bounds the fetch of the catalogue.
+	catalogFetchTimeout = 2 * time.Minute
+	// catalogRetryDelay is the wait before a failed fetch of the catalogue is retried.
+	catalogRetryDelay = time.Minute
+	// episodeCacheTTL is how long an indexed episode is kept in the cache,
+	// the episode IDs of a series don't change.
+	episodeCacheTTL = 30 * 24 * time.Hour
+)
+
+// catalogIndex is a cached index of the xtream catalogue,
+// it gives the category and the name of a requested stream ID.
+type catalogIndex struct {
+	lock     sync.Mutex
+	updated  time.Time
+	contents map[string]map[int]config.Content
+	// closed when the running fetch of the catalogue ends, nil without fetch
+	loading chan struct{}
+	failed  time.Time
+
+	// episodes of the series info requested by the players, by episode ID
+	episodesLock sync.RWMutex
+	episodes     map[int]config.Content
+}
+
+func newCatalogIndex() *catalogIndex {
+	return &catalogIndex{episodes: map[int]config.Content{}}
+}
+
+// catalogContent returns the catalogue entry of a stream ID, or a series ID for series.
+func (c *Config) catalogContent(ctx *gin.Context, contentType string, id int) (config.Content, bool) {
+	contents, ok := c.catalogContents(ctx, ctx.Request.UserAgent())
+	if !ok {
+		return config.Content{}, false
+	}
+	content, ok := contents[contentType][id]
+
+	return content, ok
+}
+
+// catalogContents returns the catalogue, it is fetched again in the background once expired.
+// Only the first fetch is waited for. The returned maps are never modified.
+func (c *Config) catalogContents(ctx context.Context, userAgent string) (map[string]map[int]config.Content, bool) {
+	contents, loading := c.cachedCatalogContents(userAgent)
+	if contents != nil {
+		return contents, true
+	}
+	if loading == nil {
+		return nil, false
+	}
+
+	select {
+	case <-loading:
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	c.catalog.lock.Lock()
+	defer c.catalog.lock.Unlock()
+
+	return c.catalog.contents, c.catalog.contents != nil
+}
+
+// cachedCatalogContents returns the current catalogue, nil before its first fetch,
+// and the running fetch started if it is expired.
+func (c *Config) cachedCatalogContents(userAgent string) (map[string]map[int]config.Content, chan struct{}) {
+	c.catalog.lock.Lock()
+	defer c.catalog.lock.Unlock()
+
+	contents, loading := c.catalog.contents, c.catalog.loading
+	expired := contents == nil || time.Since(c.catalog.updated).Hours() >= float64(c.M3UCacheExpiration)
+	if expired && loading == nil && time.Since(c.catalog.failed) >= catalogRetryDelay {
+		loading = make(chan struct{})
+		c.catalog.loading = loading
+		go c.fetchCatalog(userAgent, loading)
+	}
+
+	return contents, loading
+}
+
+// fetchCatalog fetches the catalogue, loading is closed once it is fetched.
+func (c *Config) fetchCatalog(userAgent string, loading chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), catalogFetchTimeout)
+	defer cancel()
+
+	clients, err := xtreamapi.NewClients(c.XtreamSources(), userAgent)
+	var contents map[string]map[int]config.Content
+	if err == nil {
+		contents, err = clients.Contents(ctx)
+	}
+
+	c.catalog.lock.Lock()
+	c.catalog.loading = nil
+	if err != nil {
+		c.catalog.failed = time.Now()
+	} else {
+		c.catalog.contents = contents
+		c.catalog.updated = time.Now()
+	}
+	c.catalog.lock.Unlock()
+	close(loading)
+
+	if err != nil {
+		utils.PrintErrorAndReturn(err) // nolint: errcheck
+	}
+}
+
+// episodeContent returns the series of an episode ID.
+// The xtream API only lists the episodes in the series info, they are indexed
+// from the get_series_info responses instead of fetching the info of every series.
+// The index is kept in the cache so it outlives a restart with a shared cache, and is shared by the replicas.
+func (c *Config) episodeContent(ctx context.Context, id int) (config.Content, bool) {
+	c.catalog.episodesLock.RLock()
+	content, ok := c.catalog.episodes[id]
+	c.catalog.episodesLock.RUnlock()
+	if ok {
+		return content, ok
+	}
+
+	b, err := c.cache.Get(ctx, episodeCacheKey(id))
+	if err != nil {
+		if !errors.Is(err, cache.ErrMiss) {
+			utils.PrintErrorAndReturn(err) // nolint: errcheck
+		}
+		return config.Content{}, false
+	}
+	if err := json.Unmarshal(b, &content); err != nil {
+		utils.PrintErrorAndReturn(err) // nolint: errcheck
+		return config.Content{}, false
+	}
+
+	c.catalog.episodesLock.Lock()
+	c.catalog.episodes[id] = content
+	c.catalog.episodesLock.Unlock()
+
+	return content, true
+}
+
+func episodeCacheKey(id int) string {
+	return "episode|" + strconv.Itoa(id)
+}
+
+// indexEpisodes records the episodes of a series for the entitlements of the series streams.
+func (c *Config) indexEpisodes(ctx context.Context, seriesID string, series *xtream.Series) {
+	id, err := strconv.Atoi(seriesID)
+	if err != nil {
+		return
+	}
+
+	c.catalog.lock.Lock()
+	content, ok := c.catalog.contents[config.ContentSeries][id]
+	c.catalog.lock.Unlock()
+	if !ok {
+		content = config.Content{Type: config.ContentSeries, StreamID: id, Name: series.Info.Name}
+		if series.Info.CategoryID != nil {
+			content.CategoryID = *series.Info.CategoryID
+		}
+	}
+
+	c.setEpisodes(ctx, content, series)
+}
+
+// setEpisodes records the episodes of the series content, in memory and in the cache.
+func (c *Config) setEpisodes(ctx context.Context, content config.Content, series *xtream.Series) {
+	var ids []int
+	c.catalog.episodesLock.Lock()
+	for _, episodes := range series.Episodes {
+		for _, episode := range episodes {
+			if known, ok := c.catalog.episodes[episode.ID]; !ok || known != content {
+				ids = append(ids, episode.ID)
+			}
+			c.catalog.episodes[episode.ID] = content
+		}
+	}
+	c.catalog.episodesLock.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+	b, err := json.Marshal(content)
+	if err != nil {
+		utils.PrintErrorAndReturn(err) // nolint: errcheck
+		return
+	}
+	for _, id := range ids {
+		if err := c.cache.Set(ctx, episodeCacheKey(id), b, episodeCacheTTL); err != nil {
+			utils.PrintErrorAndReturn(err) // nolint: errcheck
+			return
+		}
+	}
+}
+
+// xtreamEntitled reports whether the request user can access the stream id (e.g "1234.ts"),
+// the id of a series stream is an episode ID. A restricted user can't access an unknown stream.
+func (c *Config) xtreamEntitled(ctx *gin.Context, contentType, id string, episode bool) bool {
+	e := &contextUser(ctx).Entitlements
+	if !e.IsRestricted() {
+		return true
+	}
+
+	streamID, err := strconv.Atoi(strings.TrimSuffix(id, path.Ext(id)))
+	if err != nil {
+		return false
+	}
+
+	var (
+		content config.Content
+		ok      bool
+	)
+	if episode {
+		content, ok = c.episodeContent(ctx.Request.Context(), streamID)
+	} else {
+		content, ok = c.catalogContent(ctx, contentType, streamID)
+	}
+
+	return ok && e.Allows(content)
+}
+
+// entitle returns a middleware rejecting the stream IDs of the param
+// the request user is not entitled to.
+func (c *Config) entitle(contentType, param string) gin.HandlerFunc {
+	episode := contentType == config.ContentSeries
+	return func(ctx *gin.Context) {
+		if !c.xtreamEntitled(ctx, contentType, ctx.Param(param), episode) {
+			ctx.AbortWithStatus(http.StatusForbidden)
+		}
+	}
+}
+
+// actionEntitled checks the IDs given to the player_api.php info actions.
+func (c *Config) actionEntitled(ctx *gin.Context, action string, q url.Values) bool {
+	var contentType, param string
+	switch action {
+	case "get_vod_info":
+		contentType, param = config.ContentVOD, "vod_id"
+	case "get_series_info":
+		contentType, param = config.ContentSeries, "series_id"
+	case "get_short_epg", "get_simple_data_table":
+		contentType, param = config.ContentLive, "stream_id"
+	default:
+		return true
+	}
+
+	id := q.Get(param)
+	if id == "" {
+		// Let the action report the missing parameter.
+		return true
+	}
+
+	return c.xtreamEntitled(ctx, contentType, id, false)
+}
+
+// xtreamTrackAllowed reports whether user is entitled to a live track of an xtream m3u,
+// contents is the catalogue, it is only needed for the restricted users.
+func xtreamTrackAllowed(user *config.User, contents map[string]map[int]config.Content, track *m3u.Track) bool {
+	if !user.Entitlements.IsRestricted() {
+		return true
+	}
+	id, ok := xtreamTrackID(track)
+	if !ok {
+		return false
+	}
+	content, ok := contents[config.ContentLive][id]
+
+	return ok && user.Entitlements.Allows(content)
+}
+
+// xtreamTrackID returns the proxyfied stream ID of a live track of an xtream m3u.
+func xtreamTrackID(track *m3u.Track) (int, bool) {
+	u, err := url.Parse(track.URI)
+	if err != nil {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path)))
+
+	return id, err == nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestXtreamEntitled(t *testing.T) {
+	var seriesInfos int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch q.Get("action") {
+		case "get_live_categories", "get_vod_categories":
+			fmt.Fprint(w, `[{"category_id":"1","category_name":"News","parent_id":0}]`)
+		case "get_live_streams":
+			fmt.Fprint(w, `[{"num":1,"name":"News","stream_type":"live","stream_id":10,"category_id":"1"}]`)
+		case "get_vod_streams":
+			fmt.Fprint(w, `[]`)
+		case "get_series_categories":
+			fmt.Fprint(w, `[{"category_id":"1","category_name":"Kids","parent_id":0},{"category_id":"2","category_name":"Drama","parent_id":0}]`)
+		case "get_series":
+			fmt.Fprint(w, `[{"num":1,"name":"Cartoon","series_id":1,"category_id":"1"},{"num":2,"name":"Dark","series_id":2,"category_id":"2"}]`)
+		case "get_series_info":
+			atomic.AddInt32(&seriesInfos, 1)
+			fmt.Fprintf(w, `{"info":{"name":"Series %[1]s"},"episodes":{"1":[{"id":"%[1]s01","episode_num":1,"title":"Pilot","container_extension":"mkv","season":1}]}}`, q.Get("series_id"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	sources, err := config.NewSources(config.Source{Name: "first", XtreamBaseURL: upstream.URL, XtreamUser: "u", XtreamPassword: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := config.User{Username: "alice", Password: "pass", Entitlements: config.Entitlements{Deny: []config.EntitlementRule{{Group: "Kids"}}}}
+	users, err := config.NewUserStore(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: sources, Users: users, M3UCacheExpiration: 1},
+		catalog:     newCatalogIndex(),
+		cache:       cache.NewMemory(),
+	}
+	restricted := users.Users()[0]
+	request := func() *gin.Context {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx.Set(userContextKey, restricted)
+		return ctx
+	}
+
+	// The episodes are unknown until the player asks the info of their series.
+	if c.xtreamEntitled(request(), config.ContentSeries, "201.mkv", true) {
+		t.Error("episode allowed before the info of its series")
+	}
+	for _, id := range []string{"1", "2"} {
+		c.xtreamPlayerAPI(request(), url.Values{"action": {"get_series_info"}, "series_id": {id}})
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		id          string
+		want        bool
+	}{
+		{"allowed live", config.ContentLive, "10.ts", true},
+		{"unknown live", config.ContentLive, "11.ts", false},
+		{"episode of a denied series", config.ContentSeries, "101.mkv", false},
+		{"episode of an allowed series", config.ContentSeries, "201.mkv", true},
+		{"unknown episode", config.ContentSeries, "301.mkv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.xtreamEntitled(request(), tt.contentType, tt.id, tt.contentType == config.ContentSeries); got != tt.want {
+				t.Errorf("xtreamEntitled(%s) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+
+	// Only the requested series info are fetched, the catalogue isn't crawled.
+	if n := atomic.LoadInt32(&seriesInfos); n != 1 {
+		t.Errorf("get_series_info requests = %d, want 1", n)
+	}
+
+	// The indexed episodes are kept in the cache across restarts.
+	restarted := &Config{ProxyConfig: c.ProxyConfig, catalog: newCatalogIndex(), cache: c.cache}
+	if !restarted.xtreamEntitled(request(), config.ContentSeries, "201.mkv", true) {
+		t.Error("indexed episode refused after a restart")
+	}
+
+	// Nothing is allowed to a restricted user without catalogue.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	sources, err = config.NewSources(config.Source{Name: "first", XtreamBaseURL: down.URL, XtreamUser: "u", XtreamPassword: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: sources, Users: users, M3UCacheExpiration: 1},
+		catalog:     newCatalogIndex(),
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx.Set(userContextKey, restricted)
+	if c.xtreamEntitled(ctx, config.ContentLive, "10.ts", false) {
+		t.Error("stream allowed without catalogue")
+	}
+}
+
+func TestMarshallIntoEntitlements(t *testing.T) {
+	c := &Config{ProxyConfig: &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080}}
+
+	// The m3u tracks are described by the catalogue, whatever the case of their tags.
+	tracks := []m3u.Track{
+		{Name: "Cartoon", URI: "http://a/cartoon.ts", Tags: []m3u.Tag{{Name: "Group-Title", Value: "Kids"}}},
+		{Name: "News", URI: "http://a/news.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Info"}}},
+		{Name: "Weather", URI: "http://a/weather.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Info"}}},
+	}
+	catalog := newM3UCatalog(tracks, nil)
+	user := &config.User{Username: "alice", Password: "pass", Entitlements: config.Entitlements{Deny: []config.EntitlementRule{{Group: "Kids"}, {StreamID: catalog.ids[2]}}}}
+	var b strings.Builder
+	if err := c.marshallInto(&b, &m3u.Playlist{Tracks: tracks}, catalog, nil, user); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(b.String(), "#EXTINF"); got != 1 || !strings.Contains(b.String(), ", News\n") {
+		t.Errorf("m3u playlist = %q, want only News", b.String())
+	}
+
+	// The xtream tracks are described by the catalogue contents of their stream ID.
+	tracks = []m3u.Track{
+		{Name: "Cartoon", URI: "http://up/live/u/p/10.ts"},
+		{Name: "News", URI: "http://up/live/u/p/11.ts"},
+		{Name: "Unknown", URI: "http://up/live/u/p/12.ts"},
+	}
+	contents := map[string]map[int]config.Content{config.ContentLive: {
+		10: {Type: config.ContentLive, CategoryID: 1, StreamID: 10, Name: "Cartoon"},
+		11: {Type: config.ContentLive, CategoryID: 2, StreamID: 11, Name: "News"},
+	}}
+	user = &config.User{Username: "alice", Password: "pass", Entitlements: config.Entitlements{Deny: []config.EntitlementRule{{CategoryID: 1}}}}
+	b.Reset()
+	if err := c.marshallInto(&b, &m3u.Playlist{Tracks: tracks}, nil, contents, user); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(b.String(), "#EXTINF"); got != 1 || !strings.Contains(b.String(), ", News\n") {
+		t.Errorf("xtream playlist = %q, want only News", b.String())
+	}
+}
@@ -0,0 +1,555 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+// epgRefreshTimeout bounds the download and the processing of the guide.
+const epgRefreshTimeout = 30 * time.Minute
+
+// shortEPGLimit is the number of programmes of get_short_epg without limit, as the xtream panels.
+const shortEPGLimit = 4
+
+// epgSyncInterval is how often a replica looks for a guide shared by another one.
+const epgSyncInterval = 5 * time.Minute
+
+// epgCacheKey is the cache key of the last guide shared by a replica,
+// the gzipped guide is under epgCacheKey|<etag>.
+const epgCacheKey = "epg-guide"
+
+// epgCacheEntry describes the guide shared in the cache.
+type epgCacheEntry struct {
+	ETag    string    `json:"etag"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// m3uHeaderEPGPattern matches the guide urls of an #EXTM3U header.
+var m3uHeaderEPGPattern = regexp.MustCompile(`(?:url-tvg|x-tvg-url)="([^"]*)"`)
+
+// newEPGStore returns the guide store of the sources, nil if none has a guide.
+// headerEPGURLs are the guide urls of the header of the m3u sources, by source name.
+func newEPGStore(conf *config.ProxyConfig, headerEPGURLs map[string][]string) (*epg.Store, error) {
+	sources := epgSources(conf, headerEPGURLs)
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	return epg.NewStore(epgCacheDir(conf), sources, epgRefreshTimeout)
+}
+
+func epgCacheDir(conf *config.ProxyConfig) string {
+	if conf.EPGCacheDir != "" {
+		return conf.EPGCacheDir
+	}
+
+	return filepath.Join(os.TempDir(), "iptv-proxy-epg")
+}
+
+// epgSources returns the guides of the epg file, then of the xtream accounts and of the m3u playlists.
+// The m3u sources without guide urls use those of their header in headerEPGURLs, by source name.
+func epgSources(conf *config.ProxyConfig, headerEPGURLs map[string][]string) []epg.Source {
+	var sources []epg.Source
+	if conf.EPG != nil {
+		for i := range conf.EPG.Sources {
+			s := &conf.EPG.Sources[i]
+			src := epg.URLSource(s.Name, s.URL)
+			src.ChannelIDs = conf.EPG.ChannelIDs(s)
+			src.Shift = s.ShiftOf
+			sources = append(sources, src)
+		}
+	}
+
+	channelIDs := conf.EPG.ChannelIDs(nil)
+	for _, s := range conf.XtreamSources() {
+		s := s
+		sources = append(sources, epg.Source{
+			Name: s.Name,
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				client, err := xtreamapi.New(s, "")
+				if err != nil {
+					return nil, err
+				}
+				return client.OpenXMLTV(ctx)
+			},
+			ChannelIDs: channelIDs,
+			Shift:      s.EPGShiftOf,
+		})
+	}
+
+	seen := map[string]bool{}
+	for _, s := range m3uSources(conf) {
+		urls := s.EPGURLs
+		if len(urls) == 0 {
+			urls = headerEPGURLs[s.Name]
+		}
+		for _, u := range urls {
+			if !seen[u] {
+				seen[u] = true
+				src := epg.URLSource(s.Name, u)
+				src.ChannelIDs = channelIDs
+				src.Shift = s.EPGShiftOf
+				sources = append(sources, src)
+			}
+		}
+	}
+
+	return sources
+}
+
+// m3uHeaderEPGURLs returns the url-tvg and x-tvg-url urls of the header of an m3u file,
+// only its first line is read.
+func m3uHeaderEPGURLs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var urls []string
+	for _, m := range m3uHeaderEPGPattern.FindAllStringSubmatch(header, -1) {
+		for _, u := range strings.Split(m[1], ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+
+	return urls, nil
+}
+
+// epgURL returns the guide url of a user, written in the header of the proxyfied playlists.
+func (c *Config) epgURL(user *config.User) string {
+	q := url.Values{}
+	q.Set("username", user.Username.String())
+	q.Set("password", user.Password.String())
+
+	return c.baseURL() + "/xmltv.php?" + q.Encode()
+}
+
+// baseURL returns the advertised url of the proxy endpoints, without trailing slash.
+func (c *Config) baseURL() string {
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+
+	customEnd := strings.Trim(c.CustomEndpoint, "/")
+	if customEnd != "" {
+		customEnd = fmt.Sprintf("/%s", customEnd)
+	}
+
+	return fmt.Sprintf("%s://%s:%d%s", protocol, c.HostConfig.Hostname, c.AdvertisedPort, customEnd)
+}
+
+func (c *Config) epgRefreshLoop(interval time.Duration) {
+	if guide := c.epg.Current(); guide == nil || time.Since(guide.ModTime) >= interval {
+		c.refreshEPG()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.refreshEPG()
+		}
+	}
+}
+
+// epgSyncLoop installs the guides shared by the other replicas, see syncEPG.
+func (c *Config) epgSyncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), epgRefreshTimeout)
+		if err := c.syncEPG(ctx); err != nil {
+			log.Printf("[iptv-proxy] ERROR: epg shared guide: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Config) refreshEPG() {
+	ctx := context.Background()
+
+	// Another replica may have refreshed the guide already.
+	if err := c.syncEPG(ctx); err != nil {
+		log.Printf("[iptv-proxy] ERROR: epg shared guide: %v", err)
+	}
+
+	interval := time.Duration(c.EPGRefreshInterval) * time.Hour
+	if guide := c.epg.Current(); guide != nil && time.Since(guide.ModTime) < interval/2 {
+		log.Printf("[iptv-proxy] %v | epg guide shared by a replica: %s\n", time.Now().Format("2006/01/02 - 15:04:05"), guide.ETag)
+	} else {
+		guide, err := c.epg.Refresh(ctx)
+		if err != nil {
+			log.Printf("[iptv-proxy] ERROR: epg refresh: %v", err)
+			return
+		}
+		if err := c.shareEPG(ctx, guide); err != nil {
+			log.Printf("[iptv-proxy] ERROR: epg share guide: %v", err)
+		}
+
+		log.Printf("[iptv-proxy] %v | epg guide refreshed: %s\n", time.Now().Format("2006/01/02 - 15:04:05"), guide.ETag)
+	}
+
+	// The m3u playlist is published with the tvg-ids matched with the new guide.
+	if c.tvgIDs != nil {
+		if err := c.reloadPlaylist(); err != nil {
+			log.Printf("[iptv-proxy] ERROR: reload playlist with the new guide: %v", err)
+		}
+	}
+
+	// The recording rules are matched with the programmes of the new guide.
+	c.applyDVRRules()
+}
+
+// epgCacheTTL is the lifetime of the guide shared in the cache.
+func (c *Config) epgCacheTTL() time.Duration {
+	if c.EPGRefreshInterval <= 0 {
+		return 24 * time.Hour
+	}
+
+	return 2 * time.Duration(c.EPGRefreshInterval) * time.Hour
+}
+
+// shareEPG stores the guide in the cache for the other replicas, see syncEPG.
+func (c *Config) shareEPG(ctx context.Context, guide *epg.Guide) error {
+	b, err := os.ReadFile(guide.Path)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(epgCacheEntry{ETag: guide.ETag, ModTime: guide.ModTime})
+	if err != nil {
+		return err
+	}
+
+	ttl := c.epgCacheTTL()
+	if err := c.cache.Set(ctx, epgCacheKey+"|"+guide.ETag, b, ttl); err != nil {
+		return err
+	}
+
+	return c.cache.Set(ctx, epgCacheKey, entry, ttl)
+}
+
+// syncEPG installs the guide shared in the cache by another replica when it is newer than the current one,
+// so the replicas serve the same guide with the same ETag.
+func (c *Config) syncEPG(ctx context.Context) error {
+	b, err := c.cache.Get(ctx, epgCacheKey)
+	if errors.Is(err, cache.ErrMiss) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entry epgCacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return err
+	}
+
+	if current := c.epg.Current(); current != nil && (current.ETag == entry.ETag || !entry.ModTime.After(current.ModTime)) {
+		return nil
+	}
+
+	b, err = c.cache.Get(ctx, epgCacheKey+"|"+entry.ETag)
+	if errors.Is(err, cache.ErrMiss) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.epg.Install(ctx, bytes.NewReader(b), entry.ModTime)
+
+	return err
+}
+
+// epgXMLTV serves the cached guide, gzipped to the clients accepting it.
+func (c *Config) epgXMLTV(ctx *gin.Context) {
+	c.serveEPG(ctx, false)
+}
+
+// epgDownload serves the cached guide as an epg.xml.gz file.
+func (c *Config) epgDownload(ctx *gin.Context) {
+	c.serveEPG(ctx, true)
+}
+
+// serveEPG serves the whole guide, or only the channels of the user playlist with filter=playlist.
+// The guides shared by the other replicas are installed in background by epgSyncLoop.
+func (c *Config) serveEPG(ctx *gin.Context, download bool) {
+	var (
+		guide *epg.Guide
+		err   error
+	)
+	if ctx.Query("filter") == "playlist" {
+		var channels []string
+		channels, err = c.epgChannels(ctx)
+		if err == nil {
+			guide, err = c.epg.Filtered(ctx.Request.Context(), channels)
+		}
+	} else {
+		guide, err = c.epg.Guide(ctx.Request.Context())
+	}
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	f, err := os.Open(guide.Path)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	defer f.Close()
+
+	// A whole guide takes longer than the server write timeout on slow links.
+	http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{}) // nolint: errcheck
+
+	etag := guide.ETag
+	if !download {
+		// The same guide is served gzipped or not.
+		etag = "W/" + etag
+		ctx.Header("Vary", "Accept-Encoding")
+	}
+	ctx.Header("ETag", etag)
+	ctx.Header("Last-Modified", guide.ModTime.UTC().Format(http.TimeFormat))
+	if notModified(ctx.Request, etag, guide.ModTime) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
+	if download {
+		ctx.Header("Content-Disposition", `attachment; filename="epg.xml.gz"`)
+		ctx.DataFromReader(http.StatusOK, -1, "application/gzip", f, nil)
+		return
+	}
+
+	if acceptsGzip(ctx.Request) {
+		ctx.DataFromReader(http.StatusOK, -1, "application/xml", f, map[string]string{"Content-Encoding": "gzip"})
+		return
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	ctx.DataFromReader(http.StatusOK, -1, "application/xml", zr, nil)
+}
+
+// epgChannels returns the tvg-ids of the live channels in the playlist of the request user.
+func (c *Config) epgChannels(ctx *gin.Context) ([]string, error) {
+	user := contextUser(ctx)
+	key := "epg-channels|" + user.Username.String()
+
+	v, err, _ := c.m3uFlight.Do(key, func() (interface{}, error) {
+		var channels []string
+		if b, err := c.cache.Get(ctx.Request.Context(), key); err == nil && json.Unmarshal(b, &channels) == nil {
+			return channels, nil
+		}
+
+		var tracks []m3u.Track
+		if len(c.XtreamSources()) > 0 {
+			playlist, err := c.xtreamLiveM3u(ctx.Request.UserAgent(), "")
+			if err != nil {
+				return nil, err
+			}
+			var contents map[string]map[int]config.Content
+			if user.Entitlements.IsRestricted() {
+				contents, _ = c.catalogContents(ctx, ctx.Request.UserAgent())
+			}
+			for _, track := range playlist.Tracks {
+				if xtreamTrackAllowed(user, contents, &track) {
+					tracks = append(tracks, track)
+				}
+			}
+		}
+		snapshot := c.playlist.get()
+		for i, track := range snapshot.playlist.Tracks {
+			if user.Entitlements.Allows(snapshot.catalog.trackContent(snapshot.playlist.Tracks, i)) {
+				tracks = append(tracks, track)
+			}
+		}
+
+		for _, track := range tracks {
+			for _, tag := range track.Tags {
+				if tag.Name == "tvg-id" && tag.Value != "" {
+					channels = append(channels, tag.Value)
+				}
+			}
+		}
+
+		b, err := json.Marshal(channels)
+		if err != nil {
+			return nil, err
+		}
+		c.cacheSet(ctx, key, b, time.Duration(c.M3UCacheExpiration)*time.Hour)
+
+		return channels, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]string), nil
+}
+
+// localEPG answers get_short_epg and get_simple_data_table from the cached guide,
+// it reports false when the guide has no programme of the stream channel.
+func (c *Config) localEPG(ctx *gin.Context, action string, q url.Values) ([]byte, bool) {
+	id, err := strconv.Atoi(q.Get("stream_id"))
+	if err != nil {
+		return nil, false
+	}
+	content, ok := c.catalogContent(ctx, config.ContentLive, id)
+	if !ok {
+		return nil, false
+	}
+
+	return c.guideListings(content, id, action, q)
+}
+
+// guideListings returns the get_short_epg or get_simple_data_table response of a live stream from the cached guide,
+// it reports false when the guide has no programme of the stream channel.
+func (c *Config) guideListings(content config.Content, id int, action string, q url.Values) ([]byte, bool) {
+	if c.epg == nil || content.EPGChannelID == "" {
+		return nil, false
+	}
+
+	channelID := content.EPGChannelID
+	if mapped, ok := c.EPG.ChannelIDs(nil)[channelID]; ok {
+		channelID = mapped
+	}
+	listings := c.epg.Listings(channelID)
+	if len(listings) == 0 {
+		return nil, false
+	}
+
+	now := time.Now()
+	if action == "get_short_epg" {
+		limit := shortEPGLimit
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+			limit = n
+		}
+		i := sort.Search(len(listings), func(i int) bool { return listings[i].Stop.After(now) })
+		listings = listings[i:min(i+limit, len(listings))]
+	}
+
+	archivedSince := now.AddDate(0, 0, -content.CatchupDays)
+	resp := &xtream.EPG{EPGListings: make([]xtream.EPGListing, 0, len(listings))}
+	for _, l := range listings {
+		nowPlaying := !l.Start.After(now) && l.Stop.After(now)
+		hasArchive := content.CatchupDays > 0 && !l.Stop.After(now) && !l.Start.Before(archivedSince)
+		resp.EPGListings = append(resp.EPGListings, xtream.EPGListing{
+			ID:             int(l.Start.Unix()),
+			ChannelID:      content.EPGChannelID,
+			StreamID:       &id,
+			Title:          l.Title,
+			Description:    l.Description,
+			Language:       l.Language,
+			StartDateTime:  l.Start.Local(),
+			EndDateTime:    l.Stop.Local(),
+			StartTimestamp: l.Start,
+			StopTimestamp:  l.Stop,
+			NowPlaying:     &nowPlaying,
+			HasArchive:     &hasArchive,
+		})
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		utils.PrintErrorAndReturn(err) // nolint: errcheck
+		return nil, false
+	}
+
+	return b, true
+}
+
+// notModified reports whether the conditional headers of r match the served guide.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !modTime.Truncate(time.Second).After(ims)
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+
+	return false
+}
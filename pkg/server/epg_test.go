@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/rules"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+func TestServeEPG(t *testing.T) {
+	doc := `<tv><channel id="one"><display-name>One</display-name></channel></tv>`
+	store, err := epg.NewStore(t.TempDir(), []epg.Source{{
+		Name: "test",
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(doc)), nil
+		},
+	}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guide, err := store.Guide(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{epg: store, cache: cache.NewMemory()}
+	router := gin.New()
+	router.GET("/xmltv.php", c.epgXMLTV)
+	router.GET("/epg.xml.gz", c.epgDownload)
+
+	tests := []struct {
+		name         string
+		path         string
+		header       map[string]string
+		wantStatus   int
+		wantEncoding string
+		wantBody     string
+	}{
+		{"plain", "/xmltv.php", nil, http.StatusOK, "", `<channel id="one">`},
+		{"gzip", "/xmltv.php", map[string]string{"Accept-Encoding": "gzip, deflate"}, http.StatusOK, "gzip", ""},
+		{"etag", "/xmltv.php", map[string]string{"If-None-Match": guide.ETag}, http.StatusNotModified, "", ""},
+		{"last modified", "/epg.xml.gz", map[string]string{"If-Modified-Since": guide.ModTime.Add(time.Second).UTC().Format(http.TimeFormat)}, http.StatusNotModified, "", ""},
+		{"changed", "/epg.xml.gz", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("%s: Content-Encoding = %q, want %q", tt.name, got, tt.wantEncoding)
+		}
+		if !strings.Contains(w.Body.String(), tt.wantBody) {
+			t.Errorf("%s: body = %q, want %q", tt.name, w.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestShareEPG(t *testing.T) {
+	shared := cache.NewMemory()
+	replica := func(doc string, downloads *int) *Config {
+		store, err := epg.NewStore(t.TempDir(), []epg.Source{{
+			Name: "test",
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				*downloads++
+				return io.NopCloser(strings.NewReader(doc)), nil
+			},
+		}}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Config{ProxyConfig: &config.ProxyConfig{EPGRefreshInterval: 12}, epg: store, cache: shared}
+	}
+
+	var downloadsA, downloadsB int
+	a := replica(`<tv><channel id="one"><display-name>One</display-name></channel></tv>`, &downloadsA)
+	b := replica(`<tv><channel id="two"><display-name>Two</display-name></channel></tv>`, &downloadsB)
+
+	a.refreshEPG()
+	guide := a.epg.Current()
+	if guide == nil || downloadsA != 1 {
+		t.Fatalf("replica a: guide = %+v after %d downloads, want a guide after 1", guide, downloadsA)
+	}
+
+	// The other replica takes the guide shared instead of downloading it.
+	b.refreshEPG()
+	if got := b.epg.Current(); got == nil || got.ETag != guide.ETag || !got.ModTime.Equal(guide.ModTime) {
+		t.Errorf("replica b: guide = %+v, want %+v", got, guide)
+	}
+	if downloadsB != 0 {
+		t.Errorf("replica b downloaded the guide %d times, want 0", downloadsB)
+	}
+
+	router := gin.New()
+	router.GET("/xmltv.php", b.epgXMLTV)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/xmltv.php", nil))
+	if !strings.Contains(w.Body.String(), `<channel id="one">`) || w.Header().Get("ETag") != "W/"+guide.ETag {
+		t.Errorf("replica b serves %s %q, want the guide of replica a", w.Header().Get("ETag"), w.Body.String())
+	}
+}
+
+func TestM3UHeaderEPGURLs(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{`#EXTM3U url-tvg="http://a/epg.xml.gz"`, []string{"http://a/epg.xml.gz"}},
+		{"\ufeff#EXTM3U x-tvg-url=\"http://a/1.xml, http://b/2.xml\" tvg-shift=\"0\"", []string{"http://a/1.xml", "http://b/2.xml"}},
+		{"#EXTM3U", nil},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "list.m3u")
+		if err := os.WriteFile(path, []byte(tt.header+"\n#EXTINF:-1,One\nhttp://a/1.ts\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := m3uHeaderEPGURLs(path)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("m3uHeaderEPGURLs(%q) = %q, %v, want %q", tt.header, got, err, tt.want)
+		}
+	}
+}
+
+func TestFillTvgIDs(t *testing.T) {
+	doc := `<tv>
+<channel id="TF1.fr"><display-name>TF1</display-name></channel>
+<channel id="France2.fr"><display-name>France 2</display-name></channel>
+<channel id="France3.fr"><display-name>France 3</display-name></channel>
+</tv>`
+	dir := t.TempDir()
+	store, err := epg.NewStore(dir, []epg.Source{{
+		Name: "test",
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(doc)), nil
+		},
+	}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Guide(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{
+			EPGCacheDir: dir,
+			EPG:         &config.EPGConfig{TvgIDs: map[string]string{"France": "France3.fr"}},
+		},
+		epg:    store,
+		tvgIDs: &tvgIDMatcher{},
+	}
+	tracks := []m3u.Track{
+		{Name: "FR: TF1 HD"},
+		{Name: "France"},
+		{Name: "FR | France"},
+		{Name: "Kept", Tags: []m3u.Tag{{Name: "tvg-id", Value: "kept"}}},
+		{Name: "TF1", Tags: []m3u.Tag{{Name: "TVG-ID", Value: "upper"}}},
+	}
+	c.fillTvgIDs(tracks)
+
+	want := []string{"TF1.fr", "France3.fr", "", "kept", "upper"}
+	for i, track := range tracks {
+		if got := rules.Tag(&track, rules.TagTvgID); got != want[i] {
+			t.Errorf("%s: tvg-id = %q, want %q", track.Name, got, want[i])
+		}
+	}
+	if len(tracks[4].Tags) != 1 {
+		t.Errorf("%s: tags = %v, want its only tvg-id", tracks[4].Name, tracks[4].Tags)
+	}
+
+	report, err := os.ReadFile(filepath.Join(dir, tvgIDReportFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "name: FR | France") {
+		t.Errorf("report = %s, want FR | France", report)
+	}
+}
+
+func TestLocalEPG(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	programme := func(start time.Time, title string) string {
+		return fmt.Sprintf(`<programme start="%s" stop="%s" channel="one"><title>%s</title></programme>`,
+			start.Format("20060102150405 -0700"), start.Add(time.Hour).Format("20060102150405 -0700"), title)
+	}
+	doc := `<tv><channel id="one"><display-name>One</display-name></channel>` +
+		programme(now.Add(-2*time.Hour), "Past") + programme(now, "Now") + programme(now.Add(time.Hour), "Next") + programme(now.Add(2*time.Hour), "Later") +
+		`</tv>`
+	store, err := epg.NewStore(t.TempDir(), []epg.Source{{
+		Name: "test",
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(doc)), nil
+		},
+	}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Guide(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{M3UCacheExpiration: 1},
+		epg:         store,
+		catalog: &catalogIndex{updated: time.Now(), contents: map[string]map[int]config.Content{
+			config.ContentLive: {
+				1: {Type: config.ContentLive, StreamID: 1, EPGChannelID: "one", CatchupDays: 1},
+				2: {Type: config.ContentLive, StreamID: 2, EPGChannelID: "unknown"},
+			},
+		}},
+	}
+
+	tests := []struct {
+		action     string
+		query      string
+		wantOK     bool
+		wantTitles []string
+	}{
+		{"get_short_epg", "stream_id=1&limit=2", true, []string{"Now", "Next"}},
+		{"get_simple_data_table", "stream_id=1", true, []string{"Past", "Now", "Next", "Later"}},
+		{"get_short_epg", "stream_id=2", false, nil},
+		{"get_short_epg", "stream_id=3", false, nil},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/player_api.php", nil)
+
+		b, ok := c.localEPG(ctx, tt.action, q)
+		if ok != tt.wantOK {
+			t.Errorf("%s %s: ok = %v, want %v", tt.action, tt.query, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		var resp xtream.EPG
+		if err := json.Unmarshal(b, &resp); err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, l := range resp.EPGListings {
+			titles = append(titles, l.Title)
+			wantArchive := l.Title == "Past"
+			if l.HasArchive == nil || *l.HasArchive != wantArchive {
+				t.Errorf("%s: has_archive = %v, want %v", l.Title, l.HasArchive, wantArchive)
+			}
+			wantPlaying := l.Title == "Now"
+			if l.NowPlaying == nil || *l.NowPlaying != wantPlaying {
+				t.Errorf("%s: now_playing = %v, want %v", l.Title, l.NowPlaying, wantPlaying)
+			}
+		}
+		if !reflect.DeepEqual(titles, tt.wantTitles) {
+			t.Errorf("%s %s: titles = %v, want %v", tt.action, tt.query, titles, tt.wantTitles)
+		}
+	}
+}
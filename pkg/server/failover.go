@@ -0,0 +1,214 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/rules"
+)
+
+var errFirstByteTimeout = errors.New("no data before the failover timeout")
+
+// failoverGroup identifies the tracks of a same channel.
+type failoverGroup struct {
+	// index of the failover channel, -1 for a tvg-id group
+	channel int
+	tvgID   string
+}
+
+// failoverURIs returns the alternative uris of the tracks having some, by track index.
+// Tracks are grouped by failover channel, or by tvg-id.
+func failoverURIs(tracks []m3u.Track, channels []config.FailoverChannel) map[int][]string {
+	groups := map[failoverGroup][]int{}
+	trackGroups := map[int]failoverGroup{}
+	for i := range tracks {
+		group := failoverGroup{channel: -1, tvgID: rules.Tag(&tracks[i], rules.TagTvgID)}
+		for n := range channels {
+			if channels[n].Matches(group.tvgID, tracks[i].Name) {
+				group = failoverGroup{channel: n}
+				break
+			}
+		}
+		if group.channel < 0 && group.tvgID == "" {
+			continue
+		}
+		trackGroups[i] = group
+		groups[group] = append(groups[group], i)
+	}
+
+	alternatives := map[int][]string{}
+	for i, group := range trackGroups {
+		var uris []string
+		for _, j := range groups[group] {
+			if j != i {
+				uris = append(uris, tracks[j].URI)
+			}
+		}
+		if group.channel >= 0 {
+			uris = append(uris, channels[group.channel].URLs...)
+		}
+
+		if len(uris) > 0 {
+			alternatives[i] = uris
+		}
+	}
+
+	return alternatives
+}
+
+// xtreamURLs returns the urls of the path on the xtream base url of the source, then on its backup urls.
+func xtreamURLs(s *config.Source, format string, a ...interface{}) ([]*url.URL, error) {
+	p := fmt.Sprintf(format, a...)
+
+	var urls []*url.URL
+	for _, baseURL := range s.XtreamBaseURLs() {
+		u, err := url.Parse(baseURL + p)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+
+	return urls, nil
+}
+
+// xtreamAlternativeURLs returns the live urls of the other streams of the catalogue with the guide channel
+// of the live stream id, by stream ID. The catalogue isn't waited for, there are none before its first fetch.
+func (c *Config) xtreamAlternativeURLs(ctx *gin.Context, id string) []*url.URL {
+	ext := path.Ext(id)
+	streamID, err := strconv.Atoi(strings.TrimSuffix(id, ext))
+	if err != nil {
+		return nil
+	}
+
+	contents, _ := c.cachedCatalogContents(ctx.Request.UserAgent())
+	live := contents[config.ContentLive]
+	channel := live[streamID].EPGChannelID
+	if channel == "" {
+		return nil
+	}
+
+	user := contextUser(ctx)
+	var ids []int
+	for otherID, content := range live {
+		if otherID == streamID || content.EPGChannelID != channel {
+			continue
+		}
+		if user.Entitlements.IsRestricted() && !user.Entitlements.Allows(content) {
+			continue
+		}
+		ids = append(ids, otherID)
+	}
+	sort.Ints(ids)
+
+	var urls []*url.URL
+	for _, otherID := range ids {
+		s, upstreamID, err := c.XtreamSource(otherID)
+		if err != nil {
+			continue
+		}
+		us, err := xtreamURLs(s, "/live/%s/%s/%d%s", s.XtreamUser, s.XtreamPassword, upstreamID, ext)
+		if err != nil {
+			continue
+		}
+		urls = append(urls, us...)
+	}
+
+	return urls
+}
+
+// cancelBody cancels the upstream request context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// openUpstream requests u and reads the first bytes of a successful response.
+// Unless it is the last url to try, it gives up when they don't arrive before the failover timeout.
+func (c *Config) openUpstream(ctx context.Context, header http.Header, u *url.URL, last bool) (*http.Response, []byte, error) {
+	reqCtx, cancel := context.WithCancel(ctx)
+
+	req, err := http.NewRequestWithContext(reqCtx, "GET", u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	mergeHttpHeader(req.Header, header)
+
+	var timer *time.Timer
+	if !last && c.FailoverTimeout > 0 {
+		timer = time.AfterFunc(time.Duration(c.FailoverTimeout)*time.Second, cancel)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		if timer != nil && !timer.Stop() {
+			return nil, nil, errFirstByteTimeout
+		}
+		return nil, nil, err
+	}
+
+	var first []byte
+	if resp.StatusCode < http.StatusBadRequest {
+		buf := make([]byte, 32*1024)
+		n, err := io.ReadAtLeast(resp.Body, buf, 1)
+		if err != nil && err != io.EOF {
+			resp.Body.Close()
+			cancel()
+			if timer != nil && !timer.Stop() {
+				return nil, nil, errFirstByteTimeout
+			}
+			return nil, nil, err
+		}
+		first = buf[:n]
+	}
+
+	if timer != nil && !timer.Stop() {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, errFirstByteTimeout
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, first, nil
+}
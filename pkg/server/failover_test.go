@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestStreamFailover(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer stalled.Close()
+
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stream")) // nolint: errcheck
+	}))
+	defer working.Close()
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{FailoverTimeout: 1},
+		httpClient:  &http.Client{},
+	}
+
+	var urls []*url.URL
+	for _, s := range []*httptest.Server{broken, stalled, working} {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+
+	router := gin.New()
+	router.GET("/", func(ctx *gin.Context) { c.stream(ctx, urls...) })
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(body) != "stream" {
+		t.Errorf("stream() = %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "stream")
+	}
+}
+
+func TestFailoverURIs(t *testing.T) {
+	track := func(name, tvgID, uri string) m3u.Track {
+		return m3u.Track{Name: name, URI: uri, Tags: []m3u.Tag{{Name: "tvg-id", Value: tvgID}}}
+	}
+	tracks := []m3u.Track{
+		track("TF1", "tf1.fr", "http://a/1.ts"),
+		track("BBC One", "bbc1.uk", "http://a/2.ts"),
+		track("TF1 HD", "tf1.fr", "http://b/1.ts"),
+		track("France 2", "", "http://a/3.ts"),
+		track("FR: France 2", "", "http://b/3.ts"),
+	}
+	channels := []config.FailoverChannel{
+		{Names: []string{"France 2", "FR: France 2"}, URLs: []string{"http://backup/3.ts"}},
+	}
+
+	got := failoverURIs(tracks, channels)
+	want := map[int][]string{
+		0: {"http://b/1.ts"},
+		2: {"http://a/1.ts"},
+		3: {"http://b/3.ts", "http://backup/3.ts"},
+		4: {"http://a/3.ts", "http://backup/3.ts"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("failoverURIs() = %v, want %v", got, want)
+	}
+	for i, uris := range want {
+		if len(got[i]) != len(uris) {
+			t.Fatalf("failoverURIs()[%d] = %v, want %v", i, got[i], uris)
+		}
+		for j := range uris {
+			if got[i][j] != uris[j] {
+				t.Errorf("failoverURIs()[%d] = %v, want %v", i, got[i], uris)
+			}
+		}
+	}
+}
+
+func TestOpenStreamConnections(t *testing.T) {
+	var upstreams []*httptest.Server
+	var sources []config.Source
+	for _, name := range []string{"a", "b"} {
+		name := name
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name)) // nolint: errcheck
+		}))
+		defer s.Close()
+		upstreams = append(upstreams, s)
+		sources = append(sources, config.Source{Name: name, M3UURL: s.URL + "/list.m3u", MaxConnections: 1})
+	}
+	list, err := config.NewSources(sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: list},
+		connections: newConnectionAccountant(),
+		httpClient:  &http.Client{},
+	}
+
+	var urls []*url.URL
+	for _, s := range upstreams {
+		u, err := url.Parse(s.URL + "/1.ts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+
+	// The account of the first url is full, the stream fails over to the second one.
+	holdA, err := c.acquireConnection(context.Background(), list[0], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holdA()
+
+	resp, first, release, err := c.openStream(context.Background(), "test", http.Header{}, urls, c.upstreamConnections(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if body := string(first) + string(rest); body != "b" {
+		t.Errorf("openStream() = %q, want %q", body, "b")
+	}
+
+	// The connection is charged to the account of the opened url.
+	var limitErr *connectionLimitError
+	if _, err := c.acquireConnection(context.Background(), list[1], false); !errors.As(err, &limitErr) {
+		t.Errorf("acquireConnection(b) while streaming = %v, want a connection limit error", err)
+	}
+	release()
+	releaseB, err := c.acquireConnection(context.Background(), list[1], false)
+	if err != nil {
+		t.Errorf("acquireConnection(b) after release = %v", err)
+	} else {
+		releaseB()
+	}
+}
+
+func TestXtreamAlternativeURLs(t *testing.T) {
+	sources, err := config.NewSources(
+		config.Source{Name: "provider1", XtreamBaseURL: "http://provider1.example.com", XtreamUser: "user1", XtreamPassword: "pass1"},
+		config.Source{Name: "provider2", XtreamBaseURL: "http://provider2.example.com", XtreamUser: "user2", XtreamPassword: "pass2", XtreamBackupURLs: []string{"http://backup2.example.com"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sources[1].ProxyID(7)
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: sources, M3UCacheExpiration: 1},
+		catalog: &catalogIndex{updated: time.Now(), contents: map[string]map[int]config.Content{
+			config.ContentLive: {
+				1:     {Type: config.ContentLive, Group: "FR", StreamID: 1, EPGChannelID: "tf1.fr"},
+				2:     {Type: config.ContentLive, Group: "UK", StreamID: 2, EPGChannelID: "bbc1.uk"},
+				other: {Type: config.ContentLive, Group: "FR", StreamID: other, EPGChannelID: "tf1.fr"},
+			},
+		}},
+	}
+
+	alternatives := func(user *config.User, id string) []string {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx.Set(userContextKey, user)
+		var uris []string
+		for _, u := range c.xtreamAlternativeURLs(ctx, id) {
+			uris = append(uris, u.String())
+		}
+		return uris
+	}
+
+	got := alternatives(&config.User{}, "1.ts")
+	want := []string{"http://provider2.example.com/live/user2/pass2/7.ts", "http://backup2.example.com/live/user2/pass2/7.ts"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("xtreamAlternativeURLs(1.ts) = %v, want %v", got, want)
+	}
+	if got := alternatives(&config.User{}, "2.ts"); len(got) != 0 {
+		t.Errorf("xtreamAlternativeURLs(2.ts) = %v, want none", got)
+	}
+
+	// The alternatives a user isn't entitled to are not tried.
+	restricted := &config.User{Entitlements: config.Entitlements{Deny: []config.EntitlementRule{{Group: "FR"}}}}
+	if got := alternatives(restricted, "1.ts"); len(got) != 0 {
+		t.Errorf("restricted xtreamAlternativeURLs(1.ts) = %v, want none", got)
+	}
+}
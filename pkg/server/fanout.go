@@ -0,0 +1,149 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/fanout"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+)
+
+// upstreamStatusError is an error status of the upstream of a shared stream.
+type upstreamStatusError struct {
+	code   int
+	status string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream answered %s", e.status)
+}
+
+// releaseBody releases the upstream connection of a shared stream once closed.
+type releaseBody struct {
+	io.Reader
+	body    io.Closer
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.body.Close()
+	b.once.Do(b.release)
+
+	return err
+}
+
+// isLiveTS reports whether the uri is a live MPEG-TS stream.
+func isLiveTS(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasSuffix(path.Base(u.Path), ".ts")
+}
+
+// liveStream proxyfies a live MPEG-TS stream, its upstream connection is shared
+// with the other viewers of the same channel when the fan-out is enabled.
+func (c *Config) liveStream(ctx *gin.Context, urls ...*url.URL) {
+	if c.fanout == nil {
+		c.stream(ctx, urls...)
+		return
+	}
+
+	utils.DebugLog("-> Incoming URL: %s", ctx.Request.URL)
+	clearDeadlines(ctx)
+
+	clientIP := ctx.ClientIP()
+	header := ctx.Request.Header.Clone()
+	// Viewers join the shared stream from its buffered packets, up to the buffer size behind live,
+	// a byte range of the upstream is meaningless to them.
+	header.Del("Range")
+
+	viewer, err := c.fanout.Subscribe(urls[0].String(), func() (*fanout.Upstream, error) {
+		// The upstream outlives the request of its first viewer, which only bounds the wait for a connection.
+		resp, first, release, err := c.openStream(context.Background(), clientIP, header, urls, c.upstreamConnections(ctx.Request.Context()))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			resp.Body.Close()
+			release()
+			return nil, &upstreamStatusError{code: resp.StatusCode, status: resp.Status}
+		}
+
+		log.Printf("[iptv-proxy] %v | %s | opened shared upstream for %s\n", time.Now().Format("2006/01/02 - 15:04:05"), clientIP, ctx.Request.URL.Path)
+
+		return &fanout.Upstream{
+			Header: resp.Header,
+			Body: &releaseBody{
+				Reader:  io.MultiReader(bytes.NewReader(first), resp.Body),
+				body:    resp.Body,
+				release: release,
+			},
+		}, nil
+	})
+	if err != nil {
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) {
+			ctx.AbortWithStatus(statusErr.code)
+			return
+		}
+		var limitErr *connectionLimitError
+		if errors.As(err, &limitErr) {
+			refuseStream(ctx, err)
+			return
+		}
+		if ctx.Request.Context().Err() != nil {
+			return
+		}
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	defer viewer.Close()
+
+	// Unblock the viewer when the client leaves while the upstream stalls.
+	stop := context.AfterFunc(ctx.Request.Context(), func() { viewer.Close() }) // nolint: errcheck
+	defer stop()
+
+	respHeader := viewer.Header().Clone()
+	respHeader.Del("Content-Length")
+	respHeader.Del("Content-Range")
+	mergeHttpHeader(ctx.Writer.Header(), respHeader)
+	ctx.Status(http.StatusOK)
+
+	buf := make([]byte, 32*1024)
+	ctx.Stream(func(w io.Writer) bool {
+		io.CopyBuffer(w, viewer, buf) // nolint: errcheck
+		return false
+	})
+}
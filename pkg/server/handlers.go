@@ -28,11 +28,11 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"path"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
 )
 
@@ -40,57 +40,85 @@ func (c *Config) getM3U(ctx *gin.Context) {
 	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
 	ctx.Header("Content-Type", "application/octet-stream")
 
-	ctx.File(c.proxyfiedM3UPath)
+	ctx.File(c.playlist.get().paths[contextUser(ctx).Username.String()])
 }
 
-func (c *Config) reverseProxy(ctx *gin.Context) {
-	rpURL, err := url.Parse(c.track.URI)
+func (c *Config) m3uTrackHandler(ctx *gin.Context) {
+	snapshot := c.playlist.get()
+	track, alternatives, err := snapshot.track(ctx.Param("track"))
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	c.stream(ctx, rpURL)
-}
-
-func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
-	id := ctx.Param("id")
-
-	rpURL, err := url.Parse(strings.ReplaceAll(c.track.URI, path.Base(c.track.URI), id))
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	if !contextUser(ctx).Entitlements.Allows(snapshot.content(ctx.Param("track"))) {
+		ctx.AbortWithStatus(http.StatusForbidden)
 		return
 	}
 
-	c.stream(ctx, rpURL)
+	uris := append([]string{track.URI}, alternatives...)
+	c.reverseProxy(ctx, ctx.Param("track"), uris)
 }
 
-func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
-	utils.DebugLog("-> Incoming URL: %s", ctx.Request.URL) // Or use c.Request.URL.Path for exact request path
+// reverseProxy proxyfies the track of a stream ID of the playlist from the first of its uris answering.
+func (c *Config) reverseProxy(ctx *gin.Context, trackID string, uris []string) {
+	rpURLs := make([]*url.URL, 0, len(uris))
+	for _, uri := range uris {
+		rpURL, err := url.Parse(uri)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		rpURLs = append(rpURLs, rpURL)
+	}
 
-	// Use context from the request to ensure cancellation is propagated
-	req, err := http.NewRequestWithContext(ctx.Request.Context(), "GET", oriURL.String(), nil)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	if strings.HasSuffix(rpURLs[0].Path, ".m3u8") {
+		c.hlsPlaylist(ctx, trackID, rpURLs)
 		return
 	}
 
-	mergeHttpHeader(req.Header, ctx.Request.Header)
+	if isLiveTS(uris[0]) {
+		c.liveStream(ctx, rpURLs...)
+		return
+	}
+
+	c.stream(ctx, rpURLs...)
+}
 
-	resp, err := c.httpClient.Do(req)
+// stream proxyfies the first of the upstream urls answering without error,
+// the next url is tried when the connection fails, returns an error status or stalls.
+func (c *Config) stream(ctx *gin.Context, urls ...*url.URL) {
+	c.streamURLs(ctx, c.upstreamConnections(ctx.Request.Context()), urls)
+}
+
+// streamURLs is stream reserving the connections of the upstream urls with acquire, see openStream.
+func (c *Config) streamURLs(ctx *gin.Context, acquire func(u *url.URL, wait bool) (func(), error), urls []*url.URL) {
+	utils.DebugLog("-> Incoming URL: %s", ctx.Request.URL) // Or use c.Request.URL.Path for exact request path
+	clearDeadlines(ctx)
+
+	resp, first, release, err := c.openStream(ctx.Request.Context(), ctx.ClientIP(), ctx.Request.Header, urls, acquire)
 	if err != nil {
 		// Check if error is due to context cancellation
-		if errors.Is(err, context.Canceled) {
+		if errors.Is(ctx.Request.Context().Err(), context.Canceled) {
+			return
+		}
+		var limitErr *connectionLimitError
+		if errors.As(err, &limitErr) {
+			refuseStream(ctx, err)
 			return
 		}
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
+	defer release()
 	defer resp.Body.Close()
 
 	mergeHttpHeader(ctx.Writer.Header(), resp.Header)
 	ctx.Status(resp.StatusCode)
-	
+	if _, err := ctx.Writer.Write(first); err != nil {
+		return
+	}
+
 	// Create a 32KB buffer for copying to reduce GC pressure
 	buf := make([]byte, 32*1024)
 	ctx.Stream(func(w io.Writer) bool {
@@ -103,14 +131,71 @@ func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
 	})
 }
 
-func (c *Config) xtreamStream(ctx *gin.Context, oriURL *url.URL) {
-	id := ctx.Param("id")
+// clearDeadlines lifts the server read and write timeouts of a stream request,
+// a stream lasts as long as it is watched.
+func clearDeadlines(ctx *gin.Context) {
+	rc := http.NewResponseController(ctx.Writer)
+	rc.SetReadDeadline(time.Time{})  // nolint: errcheck
+	rc.SetWriteDeadline(time.Time{}) // nolint: errcheck
+}
+
+// openStream opens the first of the upstream urls answering without error, see stream.
+// The response of the last url is returned whatever its status.
+// Unless acquire is nil, the connection of the account of each url is reserved before it is tried,
+// a full account is skipped and only the last url waits for a connection to be released.
+// The returned func releases the connection of the opened url.
+func (c *Config) openStream(reqCtx context.Context, clientIP string, header http.Header, urls []*url.URL, acquire func(u *url.URL, wait bool) (func(), error)) (*http.Response, []byte, func(), error) {
+	var lastErr error
+	for i, u := range urls {
+		last := i == len(urls)-1
+
+		release := func() {}
+		if acquire != nil {
+			r, err := acquire(u, last)
+			if err != nil {
+				var limitErr *connectionLimitError
+				if !errors.As(err, &limitErr) {
+					return nil, nil, nil, err
+				}
+				lastErr = err
+				log.Printf("[iptv-proxy] %v | %s | upstream %d/%d skipped: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), clientIP, i+1, len(urls), err)
+				continue
+			}
+			release = r
+		}
+
+		resp, first, err := c.openUpstream(reqCtx, header, u, last)
+		if err != nil {
+			release()
+			if reqCtx.Err() != nil {
+				return nil, nil, nil, reqCtx.Err()
+			}
+			lastErr = err
+			log.Printf("[iptv-proxy] %v | %s | upstream %d/%d failed: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), clientIP, i+1, len(urls), err)
+			continue
+		}
+
+		if resp.StatusCode >= http.StatusBadRequest && !last {
+			resp.Body.Close()
+			release()
+			log.Printf("[iptv-proxy] %v | %s | upstream %d/%d failed: %s\n", time.Now().Format("2006/01/02 - 15:04:05"), clientIP, i+1, len(urls), resp.Status)
+			continue
+		}
+
+		return resp, first, release, nil
+	}
+
+	return nil, nil, nil, lastErr
+}
+
+// xtreamStream proxyfies the urls of the upstream stream id of source.
+func (c *Config) xtreamStream(ctx *gin.Context, source *config.Source, id string, urls []*url.URL) {
 	if strings.HasSuffix(id, ".m3u8") {
-		c.hlsXtreamStream(ctx, oriURL)
+		c.hlsXtreamStream(ctx, source, id, urls)
 		return
 	}
 
-	c.stream(ctx, oriURL)
+	c.stream(ctx, urls...)
 }
 
 type values []string
@@ -150,8 +235,30 @@ func (c *Config) authenticate(ctx *gin.Context) {
 		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
 		return
 	}
-	if c.ProxyConfig.User.String() != authReq.Username || c.ProxyConfig.Password.String() != authReq.Password {
-		ctx.AbortWithStatus(http.StatusUnauthorized)
+
+	c.authorize(ctx, authReq.Username, authReq.Password)
+}
+
+// streamAuthenticate authenticates the credentials of the stream url path.
+func (c *Config) streamAuthenticate(ctx *gin.Context) {
+	utils.DebugLog("-> Incoming URL: %s", ctx.Request.URL) // Or use c.Request.URL.Path for exact request path
+
+	c.authorize(ctx, ctx.Param("username"), ctx.Param("password"))
+}
+
+// queryAuthenticate authenticates the credentials of the url query, the body is left to the handler.
+func (c *Config) queryAuthenticate(ctx *gin.Context) {
+	c.authorize(ctx, ctx.Query("username"), ctx.Query("password"))
+}
+
+func notFound(ctx *gin.Context) {
+	ctx.AbortWithStatus(http.StatusNotFound)
+}
+
+// requireAdmin refuses the requests of the accounts that aren't admin, after an authentication.
+func requireAdmin(ctx *gin.Context) {
+	if !contextUser(ctx).Admin {
+		ctx.AbortWithStatus(http.StatusForbidden)
 	}
 }
 
@@ -174,9 +281,31 @@ func (c *Config) appAuthenticate(ctx *gin.Context) {
 		return
 	}
 	log.Printf("[iptv-proxy] %v | %s |App Auth\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-	if c.ProxyConfig.User.String() != q["username"][0] || c.ProxyConfig.Password.String() != q["password"][0] {
-		ctx.AbortWithStatus(http.StatusUnauthorized)
-	}
+	c.authorize(ctx, q["username"][0], q["password"][0])
 
 	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(contents))
 }
+
+const userContextKey = "iptv-proxy-user"
+
+// authorize aborts the request if the credentials don't match a usable account,
+// otherwise the account is stored in the request context.
+func (c *Config) authorize(ctx *gin.Context, username, password string) {
+	user, err := c.Users.Authenticate(username, password)
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, config.ErrInvalidCredentials) {
+			status = http.StatusUnauthorized
+		}
+		utils.DebugLog("%s | %q: %v", ctx.ClientIP(), username, err)
+		ctx.AbortWithStatus(status)
+		return
+	}
+
+	ctx.Set(userContextKey, user)
+}
+
+// contextUser returns the account authenticated for the request.
+func contextUser(ctx *gin.Context) *config.User {
+	return ctx.MustGet(userContextKey).(*config.User)
+}
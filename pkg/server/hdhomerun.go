@@ -0,0 +1,390 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/rules"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/ssdp"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/sync/singleflight"
+)
+
+const hdhrFriendlyName = "iptv-proxy"
+
+// hdhomerun is the HDHomeRun tuner of the playlist.
+type hdhomerun struct {
+	// streams in use, one per tuner
+	tuners chan struct{}
+
+	lock sync.Mutex
+	// playlist snapshot and xtream generation of the lineup
+	snapshot *playlistSnapshot
+	updated  time.Time
+	channels []hdhrChannel
+
+	// builds the lineup once at a time, outside the lock
+	flight singleflight.Group
+}
+
+func newHDHomeRun(tuners int) *hdhomerun {
+	if tuners < 1 {
+		tuners = 1
+	}
+
+	return &hdhomerun{tuners: make(chan struct{}, tuners)}
+}
+
+// hdhrChannel is a channel of the tuner lineup.
+type hdhrChannel struct {
+	number string
+	track  m3u.Track
+	// stream ID of the track in the m3u playlist and its uris, 0 for an xtream stream
+	trackID int
+	uris    []string
+	// proxyfied stream ID of an xtream live stream
+	streamID int
+}
+
+// hdhrDeviceID returns the ID of the tuner, the same for a given advertised url.
+func (c *Config) hdhrDeviceID() string {
+	h := fnv.New32a()
+	h.Write([]byte(c.baseURL())) // nolint: errcheck
+
+	return fmt.Sprintf("%08X", h.Sum32())
+}
+
+// hdhrUUID returns the UPnP UUID of the tuner, derived from its advertised url too.
+func (c *Config) hdhrUUID() string {
+	return uuid.NewV5(uuid.NamespaceURL, c.baseURL()).String()
+}
+
+// startSSDP advertises the tuner on the LAN so the media servers find it without its address,
+// the tuner is still served if the multicast group can't be joined.
+func (c *Config) startSSDP() {
+	r, err := ssdp.Listen(ssdp.Device{
+		Location: c.baseURL() + "/device.xml",
+		UUID:     c.hdhrUUID(),
+		Types:    []string{"urn:schemas-upnp-org:device:MediaServer:1"},
+		Server:   "Linux/1.0 UPnP/1.0 iptv-proxy/1.0",
+	}, ssdp.DefaultAddr, nil)
+	if err != nil {
+		log.Printf("[iptv-proxy] %v | SSDP responder disabled: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+		return
+	}
+
+	c.ssdp = r
+	log.Printf("[iptv-proxy] %v | SSDP responder advertising %s\n", time.Now().Format("2006/01/02 - 15:04:05"), c.baseURL()+"/device.xml")
+}
+
+// hdhrUser returns the HDHomeRun account, it must be named as the media servers don't send credentials.
+func hdhrUser(conf *config.ProxyConfig) (*config.User, error) {
+	if conf.HDHomeRunUser == "" {
+		return nil, errors.New("the HDHomeRun tuner requires an account, set --hdhomerun-user")
+	}
+	for _, user := range conf.Users.Users() {
+		if user.Username.String() == conf.HDHomeRunUser {
+			return user, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no hdhomerun account %q", conf.HDHomeRunUser)
+}
+
+// hdhrAuthenticate authenticates the requests of the tuner with the HDHomeRun account,
+// the media servers don't send credentials.
+func (c *Config) hdhrAuthenticate(ctx *gin.Context) {
+	user, err := hdhrUser(c.ProxyConfig)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	c.authorize(ctx, user.Username.String(), user.Password.String())
+}
+
+type hdhrDiscovery struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	BaseURL         string
+	LineupURL       string
+	TunerCount      int
+}
+
+func (c *Config) hdhrDiscover(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, hdhrDiscovery{
+		FriendlyName:    hdhrFriendlyName,
+		Manufacturer:    "Silicondust",
+		ModelNumber:     "HDTC-2US",
+		FirmwareName:    "hdhomeruntc_atsc",
+		FirmwareVersion: "20200101",
+		DeviceID:        c.hdhrDeviceID(),
+		DeviceAuth:      hdhrFriendlyName,
+		BaseURL:         c.baseURL(),
+		LineupURL:       c.baseURL() + "/lineup.json",
+		TunerCount:      cap(c.hdhomerun.tuners),
+	})
+}
+
+type hdhrLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+func (c *Config) hdhrLineupStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, hdhrLineupStatus{ScanPossible: 1, Source: "Cable", SourceList: []string{"Cable"}})
+}
+
+// hdhrLineupPost accepts the channel scans, the lineup is always up to date.
+func (c *Config) hdhrLineupPost(ctx *gin.Context) {
+	ctx.Status(http.StatusOK)
+}
+
+type hdhrLineupEntry struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+}
+
+func (c *Config) hdhrLineupJSON(ctx *gin.Context) {
+	channels, err := c.hdhrLineup(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	lineup := make([]hdhrLineupEntry, 0, len(channels))
+	for _, ch := range channels {
+		lineup = append(lineup, hdhrLineupEntry{
+			GuideNumber: ch.number,
+			GuideName:   ch.track.Name,
+			URL:         c.baseURL() + "/auto/v" + ch.number,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, lineup)
+}
+
+type hdhrDeviceDescription struct {
+	XMLName     xml.Name `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		DeviceType   string `xml:"deviceType"`
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+		ModelNumber  string `xml:"modelNumber"`
+		SerialNumber string `xml:"serialNumber"`
+		UDN          string `xml:"UDN"`
+	} `xml:"device"`
+}
+
+// hdhrDevice serves the UPnP description of the tuner.
+func (c *Config) hdhrDevice(ctx *gin.Context) {
+	d := hdhrDeviceDescription{URLBase: c.baseURL()}
+	d.SpecVersion.Major = 1
+	d.Device.DeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	d.Device.FriendlyName = hdhrFriendlyName
+	d.Device.Manufacturer = "Silicondust"
+	d.Device.ModelName = "HDTC-2US"
+	d.Device.ModelNumber = "HDTC-2US"
+	d.Device.SerialNumber = c.hdhrDeviceID()
+	d.Device.UDN = "uuid:" + c.hdhrUUID()
+
+	b, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	ctx.Data(http.StatusOK, "application/xml", append([]byte(xml.Header), b...))
+}
+
+// hdhrStream streams a channel of the lineup by its number, e.g /auto/v12,
+// while a tuner is free.
+func (c *Config) hdhrStream(ctx *gin.Context) {
+	// The media servers tune for hours.
+	clearDeadlines(ctx)
+
+	number := strings.TrimPrefix(ctx.Param("channel"), "v")
+	channels, err := c.hdhrLineup(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	var ch *hdhrChannel
+	for i := range channels {
+		if channels[i].number == number {
+			ch = &channels[i]
+			break
+		}
+	}
+	if ch == nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	select {
+	case c.hdhomerun.tuners <- struct{}{}:
+		defer func() { <-c.hdhomerun.tuners }()
+	default:
+		ctx.Header("X-HDHomeRun-Error", "805 All Tuners In Use")
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	if ch.trackID != 0 {
+		c.reverseProxy(ctx, strconv.Itoa(ch.trackID), ch.uris)
+		return
+	}
+
+	// The xtream streams are sent to their source as the live urls of the players.
+	c.xtreamLive(ctx, strconv.Itoa(ch.streamID)+".ts")
+}
+
+// hdhrLineup returns the channels of the tuner account: the m3u tracks then the xtream live streams.
+// It is built again when the playlist is reloaded, or when the xtream streams expire.
+func (c *Config) hdhrLineup(ctx *gin.Context) ([]hdhrChannel, error) {
+	h := c.hdhomerun
+	snapshot := c.playlist.get()
+	if channels, ok := c.hdhrCurrentLineup(snapshot); ok {
+		return channels, nil
+	}
+
+	user := contextUser(ctx)
+	userAgent := ctx.Request.UserAgent()
+	v, err, _ := h.flight.Do("lineup", func() (interface{}, error) {
+		// A lineup may have been built while this request was waiting.
+		if channels, ok := c.hdhrCurrentLineup(snapshot); ok {
+			return channels, nil
+		}
+
+		channels, err := c.buildHDHRLineup(snapshot, user, userAgent)
+		if err != nil {
+			return nil, err
+		}
+
+		h.lock.Lock()
+		h.snapshot = snapshot
+		h.updated = time.Now()
+		h.channels = channels
+		h.lock.Unlock()
+
+		return channels, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]hdhrChannel), nil
+}
+
+// hdhrCurrentLineup returns the lineup built from snapshot, it reports false when it has to be built again.
+func (c *Config) hdhrCurrentLineup(snapshot *playlistSnapshot) ([]hdhrChannel, bool) {
+	h := c.hdhomerun
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	expired := len(c.XtreamSources()) > 0 && time.Since(h.updated) >= time.Duration(c.M3UCacheExpiration)*time.Hour
+
+	return h.channels, h.channels != nil && h.snapshot == snapshot && !expired
+}
+
+// buildHDHRLineup returns the channels of snapshot and of the xtream live streams allowed to user.
+func (c *Config) buildHDHRLineup(snapshot *playlistSnapshot, user *config.User, userAgent string) ([]hdhrChannel, error) {
+	channels := []hdhrChannel{}
+	for i := range snapshot.playlist.Tracks {
+		track := &snapshot.playlist.Tracks[i]
+		if user.Entitlements.Allows(snapshot.catalog.trackContent(snapshot.playlist.Tracks, i)) {
+			uris := append([]string{track.URI}, snapshot.alternatives[i]...)
+			channels = append(channels, hdhrChannel{track: *track, trackID: snapshot.catalog.ids[i], uris: uris})
+		}
+	}
+
+	if len(c.XtreamSources()) > 0 {
+		playlist, err := c.xtreamLiveM3u(userAgent, "ts")
+		if err != nil {
+			return nil, err
+		}
+		var contents map[string]map[int]config.Content
+		if user.Entitlements.IsRestricted() {
+			contents, _ = c.catalogContents(context.Background(), userAgent)
+		}
+		for _, track := range playlist.Tracks {
+			id, ok := xtreamTrackID(&track)
+			if ok && xtreamTrackAllowed(user, contents, &track) {
+				channels = append(channels, hdhrChannel{track: track, streamID: id})
+			}
+		}
+	}
+	numberChannels(channels)
+
+	return channels, nil
+}
+
+// numberChannels numbers the channels with their tvg-chno,
+// the channels without one get the lowest free numbers in order.
+func numberChannels(channels []hdhrChannel) {
+	used := map[string]bool{}
+	for i := range channels {
+		if n := rules.Tag(&channels[i].track, rules.TagTvgChno); n != "" && !used[n] {
+			channels[i].number = n
+			used[n] = true
+		}
+	}
+
+	next := 1
+	for i := range channels {
+		if channels[i].number != "" {
+			continue
+		}
+		for used[strconv.Itoa(next)] {
+			next++
+		}
+		channels[i].number = strconv.Itoa(next)
+		used[channels[i].number] = true
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/fanout"
+)
+
+func TestHDHomeRunLineup(t *testing.T) {
+	users, err := config.NewUserStore(config.User{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := []m3u.Track{
+		{Name: "One", URI: "http://a/1.ts"},
+		{Name: "Two", URI: "http://a/2.ts", Tags: []m3u.Tag{{Name: "tvg-chno", Value: "1"}}},
+		{Name: "Three", URI: "http://a/3.ts", Tags: []m3u.Tag{{Name: "tvg-chno", Value: "5"}}},
+	}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080, Users: users, HDHomeRunUser: "alice"},
+		playlist:    &playlistStore{current: &playlistSnapshot{playlist: &m3u.Playlist{Tracks: tracks}, catalog: newM3UCatalog(tracks, nil)}},
+		hdhomerun:   newHDHomeRun(1),
+	}
+	router := gin.New()
+	c.hdhomerunRoutes(router.Group("/"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/lineup.json", nil))
+	var lineup []hdhrLineupEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &lineup); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"One": "2", "Two": "1", "Three": "5"}
+	if len(lineup) != len(want) {
+		t.Fatalf("lineup = %+v, want 3 channels", lineup)
+	}
+	for _, entry := range lineup {
+		if entry.GuideNumber != want[entry.GuideName] {
+			t.Errorf("%s: GuideNumber = %s, want %s", entry.GuideName, entry.GuideNumber, want[entry.GuideName])
+		}
+		if entry.URL != "http://proxy:8080/auto/v"+entry.GuideNumber {
+			t.Errorf("%s: URL = %s", entry.GuideName, entry.URL)
+		}
+	}
+
+	// The only tuner is in use.
+	c.hdhomerun.tuners <- struct{}{}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auto/v1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("busy tuner status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auto/v9", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown channel status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHDHomeRunStreamOutlivesWriteTimeout(t *testing.T) {
+	const chunks = 8
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			fmt.Fprintf(w, "chunk%d;", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	users, err := config.NewUserStore(config.User{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := []m3u.Track{{Name: "One", URI: upstream.URL + "/live/1.ts"}}
+	for _, hub := range []*fanout.Hub{nil, fanout.NewHub(1<<20, 0)} {
+		c := &Config{
+			ProxyConfig: &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080, Users: users, HDHomeRunUser: "alice"},
+			playlist:    &playlistStore{current: &playlistSnapshot{playlist: &m3u.Playlist{Tracks: tracks}, catalog: newM3UCatalog(tracks, nil)}},
+			hdhomerun:   newHDHomeRun(1),
+			fanout:      hub,
+			httpClient:  &http.Client{},
+		}
+		router := gin.New()
+		c.hdhomerunRoutes(router.Group("/"))
+		proxy := httptest.NewUnstartedServer(router)
+		// The stream lasts longer than the server timeouts.
+		proxy.Config.ReadTimeout = 100 * time.Millisecond
+		proxy.Config.WriteTimeout = 100 * time.Millisecond
+		proxy.Start()
+
+		resp, err := http.Get(proxy.URL + "/auto/v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		proxy.Close()
+
+		want := ""
+		for i := 0; i < chunks; i++ {
+			want += fmt.Sprintf("chunk%d;", i)
+		}
+		if err != nil || string(b) != want {
+			t.Errorf("fan-out %t: stream = %q, %v, want %q", hub != nil, b, err, want)
+		}
+	}
+}
+
+func TestHDHomeRunRequiresUser(t *testing.T) {
+	users, err := config.NewUserStore(config.User{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"", "bob"} {
+		if _, err := NewServer(&config.ProxyConfig{HDHomeRun: true, HDHomeRunUser: username, Users: users}); err == nil {
+			t.Errorf("NewServer() with the hdhomerun account %q succeeded, want an error", username)
+		}
+	}
+}
+
+func TestHDHomeRunXtreamSources(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/player_api.php" && r.URL.Query().Get("action") == "get_live_categories":
+				fmt.Fprint(w, `[{"category_id":"1","category_name":"News","parent_id":0}]`)
+			case r.URL.Path == "/player_api.php" && r.URL.Query().Get("action") == "get_live_streams":
+				fmt.Fprintf(w, `[{"num":1,"name":"News %s","stream_type":"live","stream_id":10,"category_id":"1"}]`, name)
+			case r.URL.Path == "/live/"+name+"/pass/10.ts":
+				fmt.Fprintf(w, "%s:10", name)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+	first, second := upstream("first"), upstream("second")
+	defer first.Close()
+	defer second.Close()
+
+	sources, err := config.NewSources(
+		config.Source{Name: "first", XtreamBaseURL: first.URL, XtreamUser: "first", XtreamPassword: "pass", MaxConnections: 1},
+		config.Source{Name: "second", XtreamBaseURL: second.URL, XtreamUser: "second", XtreamPassword: "pass", MaxConnections: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := config.NewUserStore(config.User{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080, Users: users, HDHomeRunUser: "alice", Sources: sources, M3UCacheExpiration: 1},
+		playlist:    &playlistStore{current: &playlistSnapshot{playlist: &m3u.Playlist{}}},
+		hdhomerun:   newHDHomeRun(2),
+		cache:       cache.NewMemory(),
+		catalog:     newCatalogIndex(),
+		connections: newConnectionAccountant(),
+		httpClient:  &http.Client{},
+	}
+	router := gin.New()
+	c.hdhomerunRoutes(router.Group("/"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/lineup.json", nil))
+	var lineup []hdhrLineupEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &lineup); err != nil {
+		t.Fatal(err)
+	}
+	if len(lineup) != 2 {
+		t.Fatalf("lineup = %+v, want the streams of both sources", lineup)
+	}
+
+	// Each stream is asked to its source with its upstream ID, holding a connection of the account.
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+	for _, entry := range lineup {
+		name := strings.TrimPrefix(entry.GuideName, "News ")
+		resp, err := http.Get(proxy.URL + "/auto/v" + entry.GuideNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || string(b) != name+":10" {
+			t.Errorf("%s: stream = %d %q, %v, want %q", entry.GuideName, resp.StatusCode, b, err, name+":10")
+		}
+
+		s := sources[0]
+		if name == "second" {
+			s = sources[1]
+		}
+		c.connections.lock.Lock()
+		_, reserved := c.connections.slots[s]
+		c.connections.lock.Unlock()
+		if !reserved {
+			t.Errorf("%s: no connection of source %s reserved", entry.GuideName, s.Name)
+		}
+	}
+}
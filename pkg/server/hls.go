@@ -0,0 +1,151 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/hls"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+)
+
+const (
+	// maxHlsPlaylistSize bounds the size of an upstream hls playlist.
+	maxHlsPlaylistSize = 8 << 20
+	// hlsTokenTTL is how long the proxy urls of a rewritten hls playlist are valid,
+	// long enough to play a VOD playlist fetched once.
+	hlsTokenTTL = 12 * time.Hour
+)
+
+// hlsScope returns the signature scope of the hls urls of a track of a user.
+func hlsScope(user *config.User, trackID string) string {
+	return user.Username.String() + "|" + trackID
+}
+
+// hlsProxyURI returns the sealed proxy uri of an upstream hls resource of a track.
+func (c *Config) hlsProxyURI(ctx *gin.Context, trackID string, ref *url.URL, kind hls.Kind) string {
+	user := contextUser(ctx)
+
+	name := path.Base(ref.Path)
+	if name == "." || name == "/" {
+		name = "index"
+	}
+	if kind == hls.KindPlaylist && !strings.HasSuffix(name, ".m3u8") {
+		name += ".m3u8"
+	}
+
+	return path.Join(
+		"/",
+		strings.Trim(c.CustomEndpoint, "/"),
+		c.endpointAntiColision,
+		user.Username.PathEscape(),
+		user.Password.PathEscape(),
+		trackID,
+		"hls",
+		c.hlsSigner.Sign(hlsScope(user, trackID), ref, time.Now()),
+		url.PathEscape(name),
+	)
+}
+
+// hlsPlaylist proxyfies the hls playlist of a track, every uri it references
+// is rewritten to a signed proxy url served by m3uHlsHandler.
+func (c *Config) hlsPlaylist(ctx *gin.Context, trackID string, urls []*url.URL) {
+	header := ctx.Request.Header.Clone()
+	// The playlist is rewritten, it must be a whole plain text.
+	header.Del("Accept-Encoding")
+	header.Del("Range")
+
+	// The hls playlists are short requests, they don't hold a connection of the account.
+	resp, first, _, err := c.openStream(ctx.Request.Context(), ctx.ClientIP(), header, urls, nil)
+	if err != nil {
+		if ctx.Request.Context().Err() != nil {
+			return
+		}
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		ctx.AbortWithStatus(resp.StatusCode)
+		return
+	}
+
+	rest, err := io.ReadAll(io.LimitReader(resp.Body, maxHlsPlaylistSize))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	body := append(first, rest...)
+
+	if !hls.IsPlaylist(body) {
+		// Not a playlist after all, relay it unchanged.
+		mergeHttpHeader(ctx.Writer.Header(), resp.Header)
+		ctx.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		return
+	}
+
+	b, err := hls.Rewrite(bytes.NewReader(body), resp.Request.URL, func(ref *url.URL, kind hls.Kind) (string, error) {
+		return c.hlsProxyURI(ctx, trackID, ref, kind), nil
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", b)
+}
+
+// m3uHlsHandler proxyfies a resource referenced by the hls playlist of a track.
+func (c *Config) m3uHlsHandler(ctx *gin.Context) {
+	trackID := ctx.Param("track")
+	snapshot := c.playlist.get()
+	if _, _, err := snapshot.track(trackID); err != nil {
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	user := contextUser(ctx)
+	if !user.Entitlements.Allows(snapshot.content(trackID)) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	u, err := c.hlsSigner.Verify(hlsScope(user, trackID), ctx.Param("token"), time.Now())
+	if err != nil {
+		ctx.AbortWithError(http.StatusForbidden, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	if strings.HasSuffix(ctx.Param("name"), ".m3u8") {
+		c.hlsPlaylist(ctx, trackID, []*url.URL{u})
+		return
+	}
+
+	c.stream(ctx, u)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/hls"
+)
+
+func TestHlsPlaylist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live/upuser/uppass/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nlow/index.m3u8\n") // nolint: errcheck
+	})
+	mux.HandleFunc("/live/upuser/uppass/low/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"/key\"\n#EXTINF:6,\nseg1.ts\n") // nolint: errcheck
+	})
+	mux.HandleFunc("/live/upuser/uppass/low/seg1.ts", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "segment") // nolint: errcheck
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	users, err := config.NewUserStore(config.User{Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := hls.NewSigner("", hlsTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := []m3u.Track{{Name: "hls", URI: upstream.URL + "/live/upuser/uppass/master.m3u8"}}
+	catalog := newM3UCatalog(tracks, nil)
+	c := &Config{
+		ProxyConfig:          &config.ProxyConfig{Users: users},
+		playlist:             &playlistStore{current: &playlistSnapshot{playlist: &m3u.Playlist{Tracks: tracks}, catalog: catalog}},
+		hlsSigner:            signer,
+		endpointAntiColision: "anti",
+		httpClient:           &http.Client{},
+	}
+
+	router := gin.New()
+	c.m3uRoutes(router.Group("/"))
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, resp.StatusCode)
+		}
+		return string(b)
+	}
+	lastLine := func(playlist string) string {
+		lines := strings.Split(strings.TrimSpace(playlist), "\n")
+		return lines[len(lines)-1]
+	}
+
+	base := fmt.Sprintf("/anti/user/pass/%d", catalog.ids[0])
+	master := get(base + "/master.m3u8")
+	variant := lastLine(master)
+	if !strings.HasPrefix(variant, base+"/hls/") || !strings.HasSuffix(variant, "/index.m3u8") {
+		t.Fatalf("variant uri = %q, want a signed proxy uri", variant)
+	}
+
+	media := get(variant)
+	if !strings.Contains(media, `URI="`+base+"/hls/") {
+		t.Errorf("media playlist key isn't proxyfied:\n%s", media)
+	}
+	// The upstream host and credentials are hidden in the tokens.
+	for _, leak := range []string{strings.TrimPrefix(upstream.URL, "http://"), "upuser", "uppass"} {
+		if strings.Contains(master+media, leak) {
+			t.Errorf("rewritten playlists reveal %q:\n%s\n%s", leak, master, media)
+		}
+	}
+	if body := get(lastLine(media)); body != "segment" {
+		t.Errorf("segment = %q, want %q", body, "segment")
+	}
+
+	// A forged token is refused.
+	resp, err := http.Get(proxy.URL + base + "/hls/aHR0cDovL2V2aWw.AAAA/seg.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("forged token status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
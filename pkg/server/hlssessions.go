@@ -0,0 +1,176 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+	uuid "github.com/satori/go.uuid"
+)
+
+// hlsSessionTTL is how long an xtream hls session lives after its last request.
+const hlsSessionTTL = 2 * time.Minute
+
+var errHlsSessionNotFound = errors.New("hls session not found or expired")
+
+// hlsTokenPattern matches the token of the chunk urls of an upstream xtream hls playlist.
+var hlsTokenPattern = regexp.MustCompile(`/(hlsr?)/([^/\s]+)/`)
+
+// hlsSession is the xtream hls stream of a channel watched by a user.
+// Its chunk urls carry the session token instead of the upstream one.
+// It holds a connection of the source account until it expires.
+type hlsSession struct {
+	token  string
+	user   *config.User
+	source *config.Source
+	// redirect is the upstream hls playlist url, its chunks are on the same host
+	redirect        url.URL
+	upstreamToken   string
+	upstreamChannel string
+	proxyChannel    string
+	expires         time.Time
+	// release releases the connection of the account, nil without connection
+	release func()
+}
+
+// hlsSessionStore holds the hls sessions by token.
+type hlsSessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*hlsSession
+	// token of the session of a user channel
+	streams map[string]string
+}
+
+func newHlsSessionStore() *hlsSessionStore {
+	return &hlsSessionStore{
+		sessions: map[string]*hlsSession{},
+		streams:  map[string]string{},
+	}
+}
+
+// hold extends the session of the user channel, it reports whether there is one holding its connection.
+func (s *hlsSessionStore) hold(user *config.User, proxyChannel string, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[s.streams[user.Username.String()+"|"+proxyChannel]]
+	if ok {
+		session.expires = now.Add(hlsSessionTTL)
+	}
+
+	return ok
+}
+
+// open starts or renews the session of the user channel after a playlist request, and returns it.
+// A renewed session keeps its connection, the one of session is released.
+// It reports false when session has no connection and the held session expired meanwhile.
+func (s *hlsSessionStore) open(session hlsSession, now time.Time) (hlsSession, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := session.user.Username.String() + "|" + session.proxyChannel
+	session.token = s.streams[key]
+	if current, ok := s.sessions[session.token]; ok {
+		if session.release != nil {
+			session.release()
+		}
+		session.release = current.release
+	} else {
+		if session.release == nil {
+			return hlsSession{}, false
+		}
+		session.token = uuid.NewV4().String()
+		s.streams[key] = session.token
+	}
+	session.expires = now.Add(hlsSessionTTL)
+	s.sessions[session.token] = &session
+
+	return session, true
+}
+
+// get returns the session of a token and extends it.
+func (s *hlsSessionStore) get(token string, now time.Time) (hlsSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[token]
+	if !ok || !now.Before(session.expires) {
+		return hlsSession{}, errHlsSessionNotFound
+	}
+	session.expires = now.Add(hlsSessionTTL)
+
+	return *session, nil
+}
+
+// sweep removes the sessions expired at now and releases their connections, it returns their number.
+func (s *hlsSessionStore) sweep(now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for token, session := range s.sessions {
+		if now.Before(session.expires) {
+			continue
+		}
+		delete(s.sessions, token)
+		delete(s.streams, session.user.Username.String()+"|"+session.proxyChannel)
+		if session.release != nil {
+			session.release()
+		}
+		n++
+	}
+
+	return n
+}
+
+func (c *Config) hlsSessionSweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if n := c.hlsSessions.sweep(now); n > 0 {
+				utils.DebugLog("%d expired hls sessions removed", n)
+			}
+		}
+	}
+}
+
+// hlsUpstreamToken returns the token of the chunk urls of an upstream hls playlist.
+func hlsUpstreamToken(body string) string {
+	if m := hlsTokenPattern.FindStringSubmatch(body); m != nil {
+		return m[2]
+	}
+
+	return ""
+}
+
+// proxyHlsTokens replaces the token of the chunk urls of an hls playlist by the session token.
+func proxyHlsTokens(body, token string) string {
+	return hlsTokenPattern.ReplaceAllString(body, "/$1/"+token+"/")
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestHlsSessionStore(t *testing.T) {
+	store := newHlsSessionStore()
+	alice := &config.User{Username: "alice"}
+	bob := &config.User{Username: "bob"}
+	now := time.Now()
+
+	released := map[string]bool{}
+	release := func(name string) func() {
+		return func() { released[name] = true }
+	}
+	first, _ := store.open(hlsSession{user: alice, proxyChannel: "1", upstreamToken: "a", release: release("a")}, now)
+	renewed, _ := store.open(hlsSession{user: alice, proxyChannel: "1", upstreamToken: "b", release: release("b")}, now.Add(time.Minute))
+	other, _ := store.open(hlsSession{user: bob, proxyChannel: "1", upstreamToken: "c", release: release("c")}, now)
+
+	if renewed.token != first.token {
+		t.Errorf("renewed session token = %q, want %q", renewed.token, first.token)
+	}
+	// The renewed session keeps the connection of the first one.
+	if released["a"] || !released["b"] {
+		t.Errorf("released connections = %v, want the one of the renewal", released)
+	}
+	if other.token == first.token {
+		t.Error("the sessions of two users share a token")
+	}
+
+	session, err := store.get(first.token, now.Add(time.Minute))
+	if err != nil || session.upstreamToken != "b" {
+		t.Errorf("get() = %+v, %v, want the renewed session", session, err)
+	}
+
+	if n := store.sweep(now.Add(hlsSessionTTL)); n != 1 {
+		t.Errorf("sweep() = %d, want 1", n)
+	}
+	if released["a"] {
+		t.Error("the connection of a live session is released")
+	}
+	if _, err := store.get(other.token, now.Add(hlsSessionTTL)); err != errHlsSessionNotFound {
+		t.Errorf("get() of a swept session = %v, want %v", err, errHlsSessionNotFound)
+	}
+	if _, err := store.get(first.token, now.Add(time.Minute+hlsSessionTTL)); err != errHlsSessionNotFound {
+		t.Errorf("get() of an expired session = %v, want %v", err, errHlsSessionNotFound)
+	}
+
+	// A session held then swept before its renewal isn't opened again without a connection.
+	if !store.hold(alice, "1", now.Add(time.Minute)) {
+		t.Fatal("hold() of a live session = false")
+	}
+	store.sweep(now.Add(time.Minute + 2*hlsSessionTTL))
+	if _, ok := store.open(hlsSession{user: alice, proxyChannel: "1", upstreamToken: "d"}, now.Add(time.Minute)); ok {
+		t.Error("open() of a swept session without connection = true, want false")
+	}
+}
+
+func TestHlsSessionConnection(t *testing.T) {
+	mux := http.NewServeMux()
+	var upstream *httptest.Server
+	mux.HandleFunc("/live/u/p/1.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, upstream.URL+"/play/1.m3u8", http.StatusFound)
+	})
+	mux.HandleFunc("/play/1.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "#EXTM3U\n#EXTINF:6,\n/hls/up/1_1.ts\n") // nolint: errcheck
+	})
+	mux.HandleFunc("/hls/up/1_1.ts", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "segment") // nolint: errcheck
+	})
+	mux.HandleFunc("/live/u/p/2.ts", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "live") // nolint: errcheck
+	})
+	upstream = httptest.NewServer(mux)
+	defer upstream.Close()
+
+	sources, err := config.NewSources(config.Source{Name: "provider", XtreamBaseURL: upstream.URL, XtreamUser: "u", XtreamPassword: "p", MaxConnections: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: sources},
+		connections: newConnectionAccountant(),
+		hlsSessions: newHlsSessionStore(),
+		httpClient:  &http.Client{},
+	}
+	alice := &config.User{Username: "alice", Password: "secret"}
+	bob := &config.User{Username: "bob", Password: "secret"}
+	request := func(user *config.User, params ...gin.Param) (*gin.Context, *streamRecorder) {
+		w := &streamRecorder{httptest.NewRecorder()}
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx.Params = params
+		ctx.Set(userContextKey, user)
+		return ctx, w
+	}
+	playlist := func() string {
+		t.Helper()
+		u, _ := url.Parse(upstream.URL + "/live/u/p/1.m3u8")
+		ctx, w := request(alice, gin.Param{Key: "id", Value: "1.m3u8"})
+		c.hlsXtreamStream(ctx, sources[0], "1.m3u8", []*url.URL{u})
+		if w.Code != http.StatusOK {
+			t.Fatalf("hls playlist status = %d, want %d", w.Code, http.StatusOK)
+		}
+		return w.Body.String()
+	}
+	live := func() int {
+		u, _ := url.Parse(upstream.URL + "/live/u/p/2.ts")
+		ctx, w := request(bob)
+		c.stream(ctx, u)
+		return w.Code
+	}
+
+	body := playlist()
+	if code := live(); code != http.StatusServiceUnavailable {
+		t.Errorf("stream status while an hls viewer holds the connection = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	// The playlist refreshes and the chunks of the viewer use the connection of its session.
+	if refreshed := playlist(); refreshed != body {
+		t.Errorf("refreshed playlist = %q, want %q", refreshed, body)
+	}
+	token := strings.Split(strings.TrimSpace(body), "/")[2]
+	ctx, w := request(alice, gin.Param{Key: "token", Value: token}, gin.Param{Key: "chunk", Value: "1_1.ts"})
+	c.xtreamHlsStream(ctx)
+	if w.Code != http.StatusOK || w.Body.String() != "segment" {
+		t.Errorf("chunk = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusOK, "segment")
+	}
+
+	// The connection is released once the session expires.
+	if n := c.hlsSessions.sweep(time.Now().Add(hlsSessionTTL)); n != 1 {
+		t.Fatalf("sweep() = %d, want 1", n)
+	}
+	if code := live(); code != http.StatusOK {
+		t.Errorf("stream status after the hls session = %d, want %d", code, http.StatusOK)
+	}
+}
+
+// streamRecorder is a response recorder supporting the streamed responses of gin.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *streamRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func TestProxyHlsTokens(t *testing.T) {
+	body := "#EXTM3U\n/hlsr/up/u2/p2/456/hash/1.ts\n/hls/up/456_2.ts\n"
+	want := "#EXTM3U\n/hlsr/session/u2/p2/456/hash/1.ts\n/hls/session/456_2.ts\n"
+
+	if got := hlsUpstreamToken(body); got != "up" {
+		t.Errorf("hlsUpstreamToken() = %q, want %q", got, "up")
+	}
+	if got := proxyHlsTokens(body, "session"); got != want {
+		t.Errorf("proxyHlsTokens() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/library"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+// libraryCatalog is the xtream catalogue seen by the library account, with the proxyfied IDs.
+type libraryCatalog struct {
+	conf    *config.ProxyConfig
+	clients xtreamapi.Clients
+	user    *config.User
+	// called with the series fetched, nil if unused
+	seen func(seriesID int, series *xtream.Series)
+}
+
+func (l *libraryCatalog) action(ctx context.Context, action string, q url.Values) (interface{}, error) {
+	resp, _, _, err := l.clients.Action(ctx, l.conf, l.user, action, q)
+	return resp, err
+}
+
+func (l *libraryCatalog) VODStreams(ctx context.Context) ([]xtream.VODStream, error) {
+	resp, err := l.action(ctx, "get_vod_streams", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	streams, _ := resp.([]xtream.VODStream)
+
+	return streams, nil
+}
+
+func (l *libraryCatalog) VODInfo(ctx context.Context, id int) (*xtream.VOD, error) {
+	resp, err := l.action(ctx, "get_vod_info", url.Values{"vod_id": {strconv.Itoa(id)}})
+	if err != nil {
+		return nil, err
+	}
+	vod, ok := resp.(*xtream.VOD)
+	if !ok {
+		return nil, fmt.Errorf("no info for vod %d", id)
+	}
+
+	return vod, nil
+}
+
+func (l *libraryCatalog) SeriesStreams(ctx context.Context) ([]xtream.SeriesStream, error) {
+	resp, err := l.action(ctx, "get_series", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	streams, _ := resp.([]xtream.SeriesStream)
+
+	return streams, nil
+}
+
+func (l *libraryCatalog) SeriesInfo(ctx context.Context, id int) (*xtream.Series, error) {
+	resp, err := l.action(ctx, "get_series_info", url.Values{"series_id": {strconv.Itoa(id)}})
+	if err != nil {
+		return nil, err
+	}
+	series, ok := resp.(*xtream.Series)
+	if !ok {
+		return nil, fmt.Errorf("no info for series %d", id)
+	}
+	if l.seen != nil {
+		l.seen(id, series)
+	}
+
+	return series, nil
+}
+
+// ExportLibrary writes the movies and the series of the library account as .strm and NFO files
+// in the library folder, the .strm files point at the movie and series urls of the proxy.
+func ExportLibrary(ctx context.Context, conf *config.ProxyConfig) (library.Stats, error) {
+	return exportLibrary(ctx, conf, nil)
+}
+
+func exportLibrary(ctx context.Context, conf *config.ProxyConfig, seen func(int, *xtream.Series)) (library.Stats, error) {
+	if conf.LibraryDir == "" {
+		return library.Stats{}, fmt.Errorf("no library folder")
+	}
+
+	var user *config.User
+	for _, u := range conf.Users.Users() {
+		if conf.LibraryUser == "" || u.Username.String() == conf.LibraryUser {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		return library.Stats{}, fmt.Errorf("no library account %q", conf.LibraryUser)
+	}
+
+	clients, err := xtreamapi.NewClients(conf.XtreamSources(), "")
+	if err != nil {
+		return library.Stats{}, err
+	}
+
+	base := (&Config{ProxyConfig: conf}).baseURL()
+	streamURL := func(kind string) func(int, string) string {
+		return func(id int, extension string) string {
+			return fmt.Sprintf("%s/%s/%s/%s/%d.%s", base, kind, url.PathEscape(user.Username.String()), url.PathEscape(user.Password.String()), id, extension)
+		}
+	}
+	l := &library.Library{Dir: conf.LibraryDir, MovieURL: streamURL("movie"), EpisodeURL: streamURL("series")}
+
+	return l.Export(ctx, &libraryCatalog{conf: conf, clients: clients, user: user, seen: seen})
+}
+
+func (c *Config) libraryRefreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.refreshLibrary()
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Config) refreshLibrary() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stats, err := exportLibrary(ctx, c.ProxyConfig, func(id int, series *xtream.Series) {
+		c.indexEpisodes(ctx, strconv.Itoa(id), series)
+	})
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: library export: %v", err)
+		return
+	}
+
+	log.Printf("[iptv-proxy] %v | library exported: %d written, %d unchanged, %d removed, %d failed\n", time.Now().Format("2006/01/02 - 15:04:05"), stats.Written, stats.Unchanged, stats.Removed, stats.Failed)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/library"
+)
+
+func TestExportLibrary(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("username") == "u1":
+			fmt.Fprint(w, `[]`)
+		case q.Get("action") == "get_vod_streams":
+			fmt.Fprint(w, `[{"stream_id":7,"name":"Corsicana (2022)","container_extension":"mkv","added":"1700000000"}]`)
+		case q.Get("action") == "get_vod_info" && q.Get("vod_id") == "7":
+			fmt.Fprint(w, `{"info":{"name":"Corsicana","tmdb_id":"778027","plot":"A man is abducted.","releasedate":"2022-08-26"},"movie_data":{"stream_id":7,"name":"Corsicana (2022)","container_extension":"mkv"}}`)
+		case q.Get("action") == "get_series":
+			fmt.Fprint(w, `[]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	sources, err := config.NewSources(
+		config.Source{Name: "first", XtreamBaseURL: upstream.URL, XtreamUser: "u1", XtreamPassword: "p1"},
+		config.Source{Name: "second", XtreamBaseURL: upstream.URL, XtreamUser: "u2", XtreamPassword: "p2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := config.NewUserStore(config.User{Username: "bob", Password: "secret"}, config.User{Username: "alice", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	stats, err := ExportLibrary(context.Background(), &config.ProxyConfig{
+		HostConfig:     &config.HostConfiguration{Hostname: "proxy.lan"},
+		AdvertisedPort: 8080,
+		Sources:        sources,
+		Users:          users,
+		LibraryDir:     dir,
+		LibraryUser:    "bob",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (library.Stats{Written: 2}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	movie := filepath.Join(dir, "Movies", "Corsicana (2022)", "Corsicana (2022)")
+	b, err := os.ReadFile(movie + ".strm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("http://proxy.lan:8080/movie/bob/secret/%d.mkv\n", sources[1].ProxyID(7)); string(b) != want {
+		t.Errorf("strm = %q, want %q", b, want)
+	}
+
+	b, err = os.ReadFile(movie + ".nfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `<uniqueid type="tmdb" default="true">778027</uniqueid>`) {
+		t.Errorf("nfo:\n%s", b)
+	}
+}
+
+func TestExportLibraryCancel(t *testing.T) {
+	// The upstream answers once the request is cancelled.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	sources, err := config.NewSources(config.Source{Name: "first", XtreamBaseURL: upstream.URL, XtreamUser: "u1", XtreamPassword: "p1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := config.NewUserStore(config.User{Username: "bob", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ExportLibrary(ctx, &config.ProxyConfig{
+			HostConfig: &config.HostConfiguration{Hostname: "proxy.lan"},
+			Sources:    sources,
+			Users:      users,
+			LibraryDir: t.TempDir(),
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("cancelled export succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("export not cancelled")
+	}
+}
@@ -0,0 +1,327 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/rules"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+// uncategorized is the category of the tracks without group-title.
+const uncategorized = "Uncategorized"
+
+// m3uCatalog is the xtream catalogue of the m3u playlist, its group-titles are the live categories.
+// The IDs are hashes of the group-titles, and of the source, group-title and name of the tracks,
+// they survive the playlist reloads.
+type m3uCatalog struct {
+	categories []xtream.Category
+	streams    []xtream.LiveStream
+	// track index by stream ID
+	tracks map[int]int
+	// stream ID by track index
+	ids []int
+}
+
+// newM3UCatalog returns the catalogue of the tracks, sources are the names of their m3u sources.
+func newM3UCatalog(tracks []m3u.Track, sources []string) *m3uCatalog {
+	catalog := &m3uCatalog{tracks: map[int]int{}}
+
+	groups := make([]string, len(tracks))
+	keys := make([]string, len(tracks))
+	usedKeys := map[string]bool{}
+	for i := range tracks {
+		groups[i] = rules.Tag(&tracks[i], rules.TagGroupTitle)
+		if groups[i] == "" {
+			groups[i] = uncategorized
+		}
+
+		var source string
+		if sources != nil {
+			source = sources[i]
+		}
+		// The tracks with the same source, group and name are told apart by their order.
+		base := source + "|" + groups[i] + "|" + tracks[i].Name
+		key := base
+		for n := 1; usedKeys[key]; n++ {
+			key = base + "|" + strconv.Itoa(n)
+		}
+		usedKeys[key] = true
+		keys[i] = key
+	}
+	categoryIDs := stableIDs(groups)
+	streamIDs := stableIDs(keys)
+
+	listed := map[string]bool{}
+	for i := range tracks {
+		track := &tracks[i]
+		group := groups[i]
+		categoryID := categoryIDs[group]
+		if !listed[group] {
+			listed[group] = true
+			catalog.categories = append(catalog.categories, xtream.Category{CategoryID: categoryID, CategoryName: group})
+		}
+
+		id := streamIDs[keys[i]]
+		catalog.tracks[id] = i
+		catalog.ids = append(catalog.ids, id)
+
+		stream := xtream.LiveStream{
+			Number:      i + 1,
+			Name:        track.Name,
+			StreamType:  "live",
+			StreamID:    id,
+			StreamIcon:  rules.Tag(track, rules.TagTvgLogo),
+			CategoryID:  &categoryID,
+			CategoryIDs: []int{categoryID},
+		}
+		if tvgID := rules.Tag(track, rules.TagTvgID); tvgID != "" {
+			stream.EPGChannelID = &tvgID
+		}
+		if days, _ := strconv.Atoi(rules.Tag(track, "catchup-days")); days > 0 {
+			stream.HasCatchup = true
+			stream.CatchupDurationDays = days
+		}
+		catalog.streams = append(catalog.streams, stream)
+	}
+
+	return catalog
+}
+
+// stableIDs returns positive hashes of the keys. The colliding keys take the next free IDs
+// in the keys order, so the IDs don't depend on the order of the playlist.
+func stableIDs(keys []string) map[string]int {
+	sorted := slices.Compact(slices.Sorted(slices.Values(keys)))
+
+	ids := make(map[string]int, len(sorted))
+	used := map[int]bool{}
+	for _, key := range sorted {
+		ids[key] = stableID(key, used)
+	}
+
+	return ids
+}
+
+// stableID returns a positive hash of key, the next free ID on collision.
+func stableID(key string, used map[int]bool) int {
+	h := fnv.New32a()
+	h.Write([]byte(key)) // nolint: errcheck
+	id := int(h.Sum32() & 0x7fffffff)
+	for id == 0 || used[id] {
+		id = (id + 1) & 0x7fffffff
+	}
+	used[id] = true
+
+	return id
+}
+
+// streamContent describes a stream of the catalogue for the entitlements and the guide.
+func (m *m3uCatalog) streamContent(tracks []m3u.Track, id int) (config.Content, bool) {
+	i, ok := m.tracks[id]
+	if !ok {
+		return config.Content{}, false
+	}
+
+	return m.trackContent(tracks, i), true
+}
+
+// trackContent describes the track of index i for the entitlements and the guide.
+func (m *m3uCatalog) trackContent(tracks []m3u.Track, i int) config.Content {
+	track := &tracks[i]
+	content := config.Content{
+		Type:         config.ContentLive,
+		Group:        rules.Tag(track, rules.TagGroupTitle),
+		CategoryID:   *m.streams[i].CategoryID,
+		StreamID:     m.ids[i],
+		Name:         track.Name,
+		EPGChannelID: rules.Tag(track, rules.TagTvgID),
+	}
+	content.CatchupDays, _ = strconv.Atoi(rules.Tag(track, "catchup-days"))
+
+	return content
+}
+
+func (c *Config) m3uPlayerAPIGET(ctx *gin.Context) {
+	c.m3uPlayerAPI(ctx, ctx.Request.URL.Query())
+}
+
+func (c *Config) m3uPlayerAPIPOST(ctx *gin.Context) {
+	c.playerAPIPOST(ctx, c.m3uPlayerAPI)
+}
+
+// m3uPlayerAPI answers the player_api.php actions of the xtream apps from the m3u playlist,
+// it only has live streams.
+func (c *Config) m3uPlayerAPI(ctx *gin.Context, q url.Values) {
+	action := q.Get("action")
+	user := contextUser(ctx)
+	snapshot := c.playlist.get()
+	catalog := snapshot.catalog
+	if catalog == nil {
+		catalog = newM3UCatalog(nil, nil)
+	}
+	tracks := snapshot.playlist.Tracks
+
+	if c.serveDVRPlayerAPI(ctx, action, q) {
+		return
+	}
+
+	var resp interface{}
+	switch action {
+	case "":
+		resp = c.m3uLogin(user)
+	case "get_live_categories":
+		allowed := map[int]bool{}
+		for _, s := range catalog.streams {
+			if content, _ := catalog.streamContent(tracks, s.StreamID); user.Entitlements.Allows(content) {
+				allowed[*s.CategoryID] = true
+			}
+		}
+		categories := []xtream.Category{}
+		for _, category := range catalog.categories {
+			if allowed[category.CategoryID] {
+				categories = append(categories, category)
+			}
+		}
+		resp = categories
+	case "get_live_streams":
+		categoryID, _ := strconv.Atoi(q.Get("category_id"))
+		streams := []xtream.LiveStream{}
+		for _, s := range catalog.streams {
+			if categoryID != 0 && *s.CategoryID != categoryID {
+				continue
+			}
+			if content, _ := catalog.streamContent(tracks, s.StreamID); user.Entitlements.Allows(content) {
+				streams = append(streams, s)
+			}
+		}
+		resp = streams
+	case "get_short_epg", "get_simple_data_table":
+		id, _ := strconv.Atoi(q.Get("stream_id"))
+		content, ok := catalog.streamContent(tracks, id)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if !user.Entitlements.Allows(content) {
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if b, ok := c.guideListings(content, id, action, q); ok {
+			ctx.Data(http.StatusOK, "application/json; charset=utf-8", b)
+			return
+		}
+		resp = &xtream.EPG{EPGListings: []xtream.EPGListing{}}
+	case "get_vod_categories":
+		resp = c.dvrCategories(user)
+	case "get_vod_streams":
+		resp = []xtream.VODStream{}
+		if q.Get("category_id") == "" {
+			resp = c.dvrVODStreams(user)
+		}
+	default:
+		// The playlist has no vod nor series, the recordings are its only vods.
+		resp = []interface{}{}
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
+
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", b)
+}
+
+// m3uLogin returns the account of the proxy user, the m3u sources have no account status.
+func (c *Config) m3uLogin(user *config.User) *xtream.AuthInfo {
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+
+	maxConnections := 0
+	for _, s := range m3uSources(c.ProxyConfig) {
+		if s.MaxConnections > 0 {
+			maxConnections += s.MaxConnections
+		}
+	}
+
+	now := time.Now()
+	return &xtream.AuthInfo{
+		UserInfo: xtream.UserInfo{
+			Username:             user.Username.String(),
+			Password:             user.Password.String(),
+			IsAuthorized:         true,
+			Status:               "Active",
+			ExpiresAt:            user.ExpiresAt,
+			MaxConnections:       maxConnections,
+			AllowedOutputFormats: []string{"ts", "m3u8"},
+		},
+		ServerInfo: xtream.ServerInfo{
+			URL:            protocol + "://" + c.HostConfig.Hostname,
+			HTTPPort:       c.AdvertisedPort,
+			HTTPSPort:      c.AdvertisedPort,
+			RTMPPort:       c.AdvertisedPort,
+			ServerProtocol: protocol,
+			Timezone:       now.Location().String(),
+			TimestampNow:   now,
+			TimeNow:        now,
+		},
+	}
+}
+
+// m3uXtreamStream serves the track of an xtream stream ID of the catalogue, e.g 1234.ts.
+func (c *Config) m3uXtreamStream(ctx *gin.Context) {
+	snapshot := c.playlist.get()
+	id, err := strconv.Atoi(strings.TrimSuffix(ctx.Param("id"), path.Ext(ctx.Param("id"))))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	track, alternatives, err := snapshot.track(strconv.Itoa(id))
+	if err != nil {
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	// The stream is checked as it is listed by get_live_streams.
+	content, _ := snapshot.catalog.streamContent(snapshot.playlist.Tracks, id)
+	if !contextUser(ctx).Entitlements.Allows(content) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	c.reverseProxy(ctx, strconv.Itoa(id), append([]string{track.URI}, alternatives...))
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+func TestM3UPlayerAPI(t *testing.T) {
+	news := m3u.Track{Name: "News", URI: "http://a/news.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Info"}, {Name: "tvg-id", Value: "news"}}}
+	sports := m3u.Track{Name: "Sports", URI: "http://a/sports.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Sport"}}}
+	other := m3u.Track{Name: "Other", URI: "http://a/other.ts"}
+
+	tracks := []m3u.Track{news, sports, other}
+	catalog := newM3UCatalog(tracks, nil)
+	reloaded := newM3UCatalog([]m3u.Track{other, news, sports}, nil)
+	for id, i := range catalog.tracks {
+		if j, ok := reloaded.tracks[id]; !ok || reloaded.streams[j].Name != tracks[i].Name {
+			t.Errorf("stream %d of %q changed after the reload", id, tracks[i].Name)
+		}
+	}
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{},
+		playlist:    &playlistStore{current: &playlistSnapshot{playlist: &m3u.Playlist{Tracks: tracks}, catalog: catalog}},
+	}
+	user := &config.User{Username: "alice", Entitlements: config.Entitlements{Deny: []config.EntitlementRule{{Group: "Sport"}}}}
+	call := func(query string, v interface{}) {
+		t.Helper()
+		q, _ := url.ParseQuery(query)
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/player_api.php?"+query, nil)
+		ctx.Set(userContextKey, user)
+		c.m3uPlayerAPI(ctx, q)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", query, w.Code)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	var categories []xtream.Category
+	call("action=get_live_categories", &categories)
+	var names []string
+	for _, category := range categories {
+		names = append(names, category.CategoryName)
+	}
+	if len(names) != 2 || names[0] != "Info" || names[1] != uncategorized {
+		t.Errorf("categories = %v, want [Info %s]", names, uncategorized)
+	}
+
+	var streams []xtream.LiveStream
+	call("action=get_live_streams&category_id="+strconv.Itoa(categories[0].CategoryID), &streams)
+	if len(streams) != 1 || streams[0].Name != "News" || streams[0].EPGChannelID == nil || *streams[0].EPGChannelID != "news" {
+		t.Errorf("streams of Info = %+v, want News", streams)
+	}
+
+	var vod []interface{}
+	call("action=get_vod_streams", &vod)
+	if len(vod) != 0 {
+		t.Errorf("vod streams = %v, want none", vod)
+	}
+}
+
+func TestM3UCatalogIDs(t *testing.T) {
+	news := m3u.Track{Name: "News", URI: "http://a/news.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Info"}}}
+	backup := m3u.Track{Name: "News", URI: "http://b/news.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Info"}}}
+	sports := m3u.Track{Name: "Sports", URI: "http://b/sports.ts"}
+
+	// The same channel in two sources has two IDs, kept when the playlist order changes.
+	catalog := newM3UCatalog([]m3u.Track{news, backup, sports}, []string{"first", "second", "second"})
+	reordered := newM3UCatalog([]m3u.Track{sports, backup, news}, []string{"second", "second", "first"})
+	if catalog.ids[0] == catalog.ids[1] {
+		t.Fatalf("the tracks of two sources share the ID %d", catalog.ids[0])
+	}
+	for i, j := range []int{2, 1, 0} {
+		if catalog.ids[i] != reordered.ids[j] {
+			t.Errorf("ID of track %d = %d after the reorder, want %d", i, reordered.ids[j], catalog.ids[i])
+		}
+	}
+
+	// Two colliding keys take the same IDs whatever their order.
+	hashes := map[int]string{}
+	var a, b string
+	for n := 0; a == ""; n++ {
+		key := "channel" + strconv.Itoa(n)
+		id := stableID(key, map[int]bool{})
+		if other, ok := hashes[id]; ok {
+			a, b = other, key
+		}
+		hashes[id] = key
+	}
+	ids := stableIDs([]string{b, a})
+	if ids[a] == ids[b] {
+		t.Fatalf("stableIDs() = %v, want two IDs", ids)
+	}
+	if got := stableIDs([]string{a, b}); got[a] != ids[a] || got[b] != ids[b] {
+		t.Errorf("stableIDs() = %v, want %v whatever the order", got, ids)
+	}
+}
+
+func TestM3UXtreamStreamEntitled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path) // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	tracks := []m3u.Track{{Name: "News", URI: upstream.URL + "/news.mp4"}, {Name: "Sports", URI: upstream.URL + "/sports.mp4"}}
+	catalog := newM3UCatalog(tracks, nil)
+	denied, allowed := catalog.ids[0], catalog.ids[1]
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{},
+		playlist:    &playlistStore{current: &playlistSnapshot{playlist: &m3u.Playlist{Tracks: tracks}, catalog: catalog}},
+		connections: newConnectionAccountant(),
+		httpClient:  &http.Client{},
+	}
+	user := &config.User{Username: "alice", Entitlements: config.Entitlements{Deny: []config.EntitlementRule{{StreamID: denied}}}}
+	router := gin.New()
+	router.GET("/live/:username/:password/:id", func(ctx *gin.Context) { ctx.Set(userContextKey, user) }, c.m3uXtreamStream)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	tests := []struct {
+		id         int
+		wantStatus int
+	}{
+		{denied, http.StatusForbidden},
+		{allowed, http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(proxy.URL + "/live/alice/secret/" + strconv.Itoa(tt.id) + ".ts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("stream %d status = %d, want %d", tt.id, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
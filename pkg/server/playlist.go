@@ -0,0 +1,356 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+)
+
+// m3uFetchTimeout bounds the download of an m3u source.
+const m3uFetchTimeout = 5 * time.Minute
+
+// playlistRefreshMinInterval is the minimum time between a reload and an on demand one.
+const playlistRefreshMinInterval = time.Minute
+
+// errRefreshTooSoon is returned by an on demand reload within playlistRefreshMinInterval of the last one.
+var errRefreshTooSoon = errors.New("the playlist was reloaded less than a minute ago")
+
+// playlistSnapshot is an immutable view of the proxyfied m3u playlist.
+// Handlers read the current snapshot once per request, so a reload never
+// changes the track of a stream that is already running.
+type playlistSnapshot struct {
+	playlist *m3u.Playlist
+	// path to the proxyfied m3u file of each user
+	paths map[string]string
+	// failover uris of the tracks, by track index
+	alternatives map[int][]string
+	// xtream catalogue of the tracks
+	catalog *m3uCatalog
+	// publication time, zero for the playlist parsed at start
+	published time.Time
+}
+
+// playlistStore holds the current playlist snapshot.
+type playlistStore struct {
+	lock    sync.RWMutex
+	current *playlistSnapshot
+
+	// serializes reloads
+	reloadLock sync.Mutex
+}
+
+func (s *playlistStore) get() *playlistSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.current
+}
+
+func (s *playlistStore) swap(snapshot *playlistSnapshot) *playlistSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.current
+	s.current = snapshot
+
+	return old
+}
+
+// track returns the track of a stream ID of the catalogue and its failover uris.
+// The IDs survive the reloads, a track url never switches to another channel.
+func (s *playlistSnapshot) track(id string) (*m3u.Track, []string, error) {
+	streamID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid track ID %q", id)
+	}
+
+	i, ok := 0, false
+	if s.catalog != nil {
+		i, ok = s.catalog.tracks[streamID]
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("track %d not found", streamID)
+	}
+
+	return &s.playlist.Tracks[i], s.alternatives[i], nil
+}
+
+// content describes the track of a stream ID for the entitlements, the track is expected to exist.
+func (s *playlistSnapshot) content(id string) config.Content {
+	streamID, _ := strconv.Atoi(id)
+	content, _ := s.catalog.streamContent(s.playlist.Tracks, streamID)
+
+	return content
+}
+
+// m3uSources returns the sources merged into the proxyfied m3u.
+func m3uSources(conf *config.ProxyConfig) []*config.Source {
+	// The m3u of an xtream only configuration is served from get.php.
+	if xtreamAuto(conf) {
+		return nil
+	}
+
+	var sources []*config.Source
+	for _, s := range conf.Sources {
+		if s.M3UURL != "" {
+			sources = append(sources, s)
+		}
+	}
+
+	return sources
+}
+
+// xtreamAuto reports whether the only source is an xtream account given by its get.php url.
+func xtreamAuto(conf *config.ProxyConfig) bool {
+	return len(conf.Sources) == 1 && conf.Sources[0].M3UIsXtreamGet()
+}
+
+// trackSourceTag names the source of a merged track until the playlist is published.
+const trackSourceTag = "x-iptv-proxy-source"
+
+// parsePlaylist parses the m3u of the sources and merges their tracks in order.
+func parsePlaylist(sources []*config.Source) (*m3u.Playlist, map[string][]string, error) {
+	p := &m3u.Playlist{}
+	headerEPGURLs := map[string][]string{}
+	for _, s := range sources {
+		tracks, urls, err := parseSourcePlaylist(s.M3UURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("source %q: %w", s.Name, err)
+		}
+		for i := range tracks {
+			tracks[i].Tags = append(tracks[i].Tags, m3u.Tag{Name: trackSourceTag, Value: s.Name})
+		}
+		p.Tracks = append(p.Tracks, tracks...)
+		headerEPGURLs[s.Name] = urls
+	}
+
+	return p, headerEPGURLs, nil
+}
+
+// parseSourcePlaylist returns the tracks of an m3u url or file and the guide urls of its header.
+// An m3u url is downloaded once to a temporary file.
+func parseSourcePlaylist(m3uURL string) ([]m3u.Track, []string, error) {
+	if strings.HasPrefix(m3uURL, "http://") || strings.HasPrefix(m3uURL, "https://") {
+		path, err := downloadM3U(m3uURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer os.Remove(path) // nolint: errcheck
+		m3uURL = path
+	}
+
+	p, err := m3u.Parse(m3uURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	urls, err := m3uHeaderEPGURLs(m3uURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return p.Tracks, urls, nil
+}
+
+// downloadM3U downloads an m3u url into a new temporary file.
+func downloadM3U(m3uURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m3uFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m3uURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("m3u request failed with status: %d", resp.StatusCode)
+	}
+
+	f, err := os.CreateTemp("", "*.iptv-proxy-source.m3u")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		os.Remove(f.Name()) // nolint: errcheck
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// reloadPlaylist parses the m3u sources again and publishes them.
+func (c *Config) reloadPlaylist() error {
+	sources := m3uSources(c.ProxyConfig)
+	if len(sources) == 0 {
+		return nil
+	}
+
+	c.playlist.reloadLock.Lock()
+	defer c.playlist.reloadLock.Unlock()
+
+	p, headerEPGURLs, err := parsePlaylist(sources)
+	if err != nil {
+		return err
+	}
+
+	if err := c.publishPlaylist(p); err != nil {
+		return err
+	}
+
+	// The guide urls of the m3u headers can change with the playlist.
+	if c.epg != nil {
+		c.epg.SetSources(epgSources(c.ProxyConfig, headerEPGURLs))
+	}
+
+	log.Printf("[iptv-proxy] %v | m3u playlist reloaded: %d tracks\n", time.Now().Format("2006/01/02 - 15:04:05"), len(p.Tracks))
+
+	return nil
+}
+
+// publishPlaylist applies the playlist rules to p, writes its proxyfied m3u files
+// and swaps them with the current snapshot.
+func (c *Config) publishPlaylist(p *m3u.Playlist) error {
+	p.Tracks = validTracks(c.applyPlaylistRules(p.Tracks))
+	sources := takeTrackSources(p.Tracks)
+
+	snapshot := &playlistSnapshot{
+		playlist:     p,
+		paths:        map[string]string{},
+		alternatives: failoverURIs(p.Tracks, c.FailoverChannels),
+		catalog:      newM3UCatalog(p.Tracks, sources),
+		published:    time.Now(),
+	}
+	for _, user := range c.Users.Users() {
+		path, err := c.writeM3U(p, snapshot.catalog, user)
+		if err != nil {
+			removeM3UFiles(snapshot.paths)
+			return err
+		}
+		snapshot.paths[user.Username.String()] = path
+	}
+
+	old := c.playlist.swap(snapshot)
+	if old != nil {
+		removeM3UFiles(old.paths)
+	}
+
+	return nil
+}
+
+// validTracks drops the tracks with an invalid URI.
+func validTracks(tracks []m3u.Track) []m3u.Track {
+	valid := tracks[:0]
+	for _, track := range tracks {
+		if _, err := url.Parse(track.URI); err != nil {
+			log.Printf("ERROR: track: %s: %s", track.Name, err)
+			continue
+		}
+		valid = append(valid, track)
+	}
+
+	return valid
+}
+
+// takeTrackSources removes the source tags of the tracks and returns their values.
+func takeTrackSources(tracks []m3u.Track) []string {
+	sources := make([]string, len(tracks))
+	for i := range tracks {
+		tags := make([]m3u.Tag, 0, len(tracks[i].Tags))
+		for _, tag := range tracks[i].Tags {
+			if tag.Name == trackSourceTag {
+				sources[i] = tag.Value
+				continue
+			}
+			tags = append(tags, tag)
+		}
+		tracks[i].Tags = tags
+	}
+
+	return sources
+}
+
+// removeM3UFiles removes proxyfied m3u files,
+// files being served keep their open descriptor.
+func removeM3UFiles(paths map[string]string) {
+	for _, path := range paths {
+		os.Remove(path) // nolint: errcheck
+	}
+}
+
+func (c *Config) playlistRefreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.reloadPlaylist(); err != nil {
+				log.Printf("[iptv-proxy] ERROR: m3u playlist reload: %v", err)
+			}
+		}
+	}
+}
+
+// refreshPlaylist reloads the playlist on demand, at most once per playlistRefreshMinInterval.
+func (c *Config) refreshPlaylist(ctx *gin.Context) {
+	// The concurrent refreshes share one reload.
+	_, err, _ := c.m3uFlight.Do("playlist-refresh", func() (interface{}, error) {
+		if time.Since(c.playlist.get().published) < playlistRefreshMinInterval {
+			return nil, errRefreshTooSoon
+		}
+		return nil, c.reloadPlaylist()
+	})
+	if errors.Is(err, errRefreshTooSoon) {
+		ctx.Header("Retry-After", strconv.Itoa(int(playlistRefreshMinInterval.Seconds())))
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"tracks": len(c.playlist.get().playlist.Tracks),
+	})
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/dvr"
+)
+
+func TestPublishPlaylistReload(t *testing.T) {
+	users, err := config.NewUserStore(config.User{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig:          &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080, Users: users},
+		playlist:             &playlistStore{},
+		endpointAntiColision: "anti",
+	}
+	defer func() { removeM3UFiles(c.playlist.get().paths) }()
+
+	// trackIDs returns the track ID of the proxyfied urls of the m3u file of alice by channel name.
+	trackIDs := func() map[string]string {
+		t.Helper()
+		p, err := m3u.Parse(c.playlist.get().paths["alice"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]string{}
+		for _, track := range p.Tracks {
+			u, err := url.Parse(track.URI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[track.Name] = path.Base(path.Dir(u.Path))
+		}
+		return ids
+	}
+
+	publish := func(names ...string) {
+		t.Helper()
+		p := &m3u.Playlist{}
+		for _, name := range names {
+			p.Tracks = append(p.Tracks, m3u.Track{Name: name, Length: -1, URI: "http://upstream/" + name + ".ts"})
+		}
+		if err := c.publishPlaylist(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish("One", "Two", "Three")
+	before := trackIDs()
+
+	// The reload shifts the tracks, the old urls keep their channel.
+	publish("Zero", "Two", "Three")
+	after := trackIDs()
+	for _, name := range []string{"Two", "Three"} {
+		if after[name] != before[name] {
+			t.Errorf("%s: track ID = %s after the reload, want %s", name, after[name], before[name])
+		}
+		track, _, err := c.playlist.get().track(before[name])
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if track.Name != name {
+			t.Errorf("track %s = %s, want %s", before[name], track.Name, name)
+		}
+	}
+
+	// A removed channel is not found, its url isn't given to another channel.
+	if track, _, err := c.playlist.get().track(before["One"]); err == nil {
+		t.Errorf("removed track %s = %s, want not found", before["One"], track.Name)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	scheduler, err := dvr.New(t.TempDir(), dvr.Options{}, func(ctx context.Context, e dvr.Entry, w io.Writer) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+
+	c := &Config{cache: cache.NewMemory(), done: make(chan struct{}), dvr: scheduler}
+	for i := 0; i < 2; i++ {
+		if err := c.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParsePlaylist(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list.m3u" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "#EXTM3U url-tvg=\"http://a/epg.xml\"\n#EXTINF:-1,One\nhttp://a/1.ts\n") // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	sources, err := config.NewSources(config.Source{Name: "provider", M3UURL: upstream.URL + "/list.m3u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, headerEPGURLs, err := parsePlaylist(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tracks) != 1 || p.Tracks[0].Name != "One" {
+		t.Errorf("parsePlaylist() tracks = %+v, want One", p.Tracks)
+	}
+	if urls := headerEPGURLs["provider"]; len(urls) != 1 || urls[0] != "http://a/epg.xml" {
+		t.Errorf("parsePlaylist() header epg urls = %v, want [http://a/epg.xml]", urls)
+	}
+
+	sources, err = config.NewSources(config.Source{Name: "missing", M3UURL: upstream.URL + "/missing.m3u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parsePlaylist(sources); err == nil {
+		t.Error("parsePlaylist() of a missing playlist succeeded, want an error")
+	}
+}
+
+func TestRefreshPlaylist(t *testing.T) {
+	var downloads int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		io.WriteString(w, "#EXTM3U\n#EXTINF:-1,One\nhttp://a/1.ts\n") // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	sources, err := config.NewSources(config.Source{Name: "provider", M3UURL: upstream.URL + "/list.m3u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := config.NewUserStore(config.User{Username: "alice", Password: "secret", Admin: true}, config.User{Username: "bob", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig:          &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080, Sources: sources, Users: users},
+		playlist:             &playlistStore{current: &playlistSnapshot{playlist: &m3u.Playlist{}}},
+		endpointAntiColision: "anti",
+	}
+	defer func() { removeM3UFiles(c.playlist.get().paths) }()
+
+	router := gin.New()
+	router.POST("/refresh", c.authenticate, requireAdmin, c.refreshPlaylist)
+	refresh := func(username string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/refresh?username="+username+"&password=secret", nil))
+		return w.Code
+	}
+
+	tests := []struct {
+		username      string
+		wantStatus    int
+		wantDownloads int
+	}{
+		{"bob", http.StatusForbidden, 0},
+		{"alice", http.StatusOK, 1},
+		// The playlist was just reloaded.
+		{"alice", http.StatusTooManyRequests, 1},
+	}
+	for _, tt := range tests {
+		if status := refresh(tt.username); status != tt.wantStatus || downloads != tt.wantDownloads {
+			t.Errorf("refresh as %s = %d after %d downloads, want %d after %d", tt.username, status, downloads, tt.wantStatus, tt.wantDownloads)
+		}
+	}
+}
@@ -20,10 +20,9 @@ package server
 
 import (
 	"fmt"
-	"path"
-	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
 )
 
 func (c *Config) routes(r *gin.RouterGroup) {
@@ -31,12 +30,23 @@ func (c *Config) routes(r *gin.RouterGroup) {
 
 	r = r.Group(c.CustomEndpoint)
 
+	if c.epg != nil {
+		r.GET("/xmltv.php", c.authenticate, c.epgXMLTV)
+		r.GET("/epg.xml.gz", c.authenticate, c.epgDownload)
+	}
+
+	if c.hdhomerun != nil {
+		c.hdhomerunRoutes(r)
+	}
+
+	if c.dvr != nil {
+		c.dvrRoutes(r)
+	}
+
 	//Xtream service endopoints
-	if c.ProxyConfig.XtreamBaseURL != "" {
+	if len(c.XtreamSources()) > 0 {
 		c.xtreamRoutes(r)
-		if strings.Contains(c.XtreamBaseURL, c.RemoteURL.Host) &&
-			c.XtreamUser.String() == c.RemoteURL.Query().Get("username") &&
-			c.XtreamPassword.String() == c.RemoteURL.Query().Get("password") {
+		if xtreamAuto(c.ProxyConfig) {
 
 			r.GET("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
 			// XXX Private need: for external Android app
@@ -44,6 +54,8 @@ func (c *Config) routes(r *gin.RouterGroup) {
 
 			return
 		}
+	} else if len(m3uSources(c.ProxyConfig)) > 0 {
+		c.m3uXtreamRoutes(r)
 	}
 
 	c.m3uRoutes(r)
@@ -59,32 +71,57 @@ func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	r.GET("/apiget", c.authenticate, c.xtreamApiGet)
 	r.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
 	r.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
-	r.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
-	r.GET(fmt.Sprintf("/%s/%s/:id", c.User, c.Password), c.xtreamStreamHandler)
-	r.GET(fmt.Sprintf("/live/%s/%s/:id", c.User, c.Password), c.xtreamStreamLive)
-	r.GET(fmt.Sprintf("/timeshift/%s/%s/:duration/:start/:id", c.User, c.Password), c.xtreamStreamTimeshift)
-	r.GET(fmt.Sprintf("/movie/%s/%s/:id", c.User, c.Password), c.xtreamStreamMovie)
-	r.GET(fmt.Sprintf("/series/%s/%s/:id", c.User, c.Password), c.xtreamStreamSeries)
-	r.GET(fmt.Sprintf("/hlsr/:token/%s/%s/:channel/:hash/:chunk", c.User, c.Password), c.xtreamHlsrStream)
+	r.GET("/:username/:password/:id", c.streamAuthenticate, c.entitle(config.ContentLive, "id"), c.xtreamStreamHandler)
+	r.GET("/live/:username/:password/:id", c.streamAuthenticate, c.entitle(config.ContentLive, "id"), c.xtreamStreamLive)
+	r.GET("/timeshift/:username/:password/:duration/:start/:id", c.streamAuthenticate, c.entitle(config.ContentLive, "id"), c.xtreamStreamTimeshift)
+	r.GET("/movie/:username/:password/:id", c.streamAuthenticate, c.dvrMovie, c.entitle(config.ContentVOD, "id"), c.xtreamStreamMovie)
+	r.GET("/series/:username/:password/:id", c.streamAuthenticate, c.entitle(config.ContentSeries, "id"), c.xtreamStreamSeries)
+	r.GET("/hlsr/:token/:username/:password/:channel/:hash/:chunk", c.streamAuthenticate, c.entitle(config.ContentLive, "channel"), c.xtreamHlsrStream)
 	r.GET("/hls/:token/:chunk", c.xtreamHlsStream)
-	r.GET("/play/:token/:type", c.xtreamStreamPlay)
+	r.GET("/play/:token/:type", c.authenticate, c.entitle(config.ContentLive, "token"), c.xtreamStreamPlay)
+}
+
+// hdhomerunRoutes serves the playlist as an HDHomeRun tuner, they have no credentials.
+func (c *Config) hdhomerunRoutes(r *gin.RouterGroup) {
+	r.GET("/discover.json", c.hdhrAuthenticate, c.hdhrDiscover)
+	r.GET("/lineup_status.json", c.hdhrAuthenticate, c.hdhrLineupStatus)
+	r.GET("/lineup.json", c.hdhrAuthenticate, c.hdhrLineupJSON)
+	r.GET("/lineup.post", c.hdhrAuthenticate, c.hdhrLineupPost)
+	r.POST("/lineup.post", c.hdhrAuthenticate, c.hdhrLineupPost)
+	r.GET("/device.xml", c.hdhrAuthenticate, c.hdhrDevice)
+	r.GET("/auto/:channel", c.hdhrAuthenticate, c.hdhrStream)
+}
+
+// m3uXtreamRoutes serves the m3u playlist to the xtream apps when there is no xtream source.
+func (c *Config) m3uXtreamRoutes(r *gin.RouterGroup) {
+	r.GET("/get.php", c.authenticate, c.getM3U)
+	r.POST("/get.php", c.authenticate, c.getM3U)
+	r.GET("/player_api.php", c.authenticate, c.m3uPlayerAPIGET)
+	r.POST("/player_api.php", c.appAuthenticate, c.m3uPlayerAPIPOST)
+	r.GET("/:username/:password/:id", c.streamAuthenticate, c.m3uXtreamStream)
+	r.GET("/live/:username/:password/:id", c.streamAuthenticate, c.m3uXtreamStream)
+	if c.dvr != nil {
+		r.GET("/movie/:username/:password/:id", c.streamAuthenticate, c.dvrMovie, notFound)
+	}
+}
+
+// dvrRoutes schedule the recordings, the credentials are in the url query.
+func (c *Config) dvrRoutes(r *gin.RouterGroup) {
+	r.GET("/dvr/recordings", c.queryAuthenticate, c.dvrList)
+	r.POST("/dvr/recordings", c.queryAuthenticate, c.dvrSchedule)
+	r.DELETE("/dvr/recordings/:id", c.queryAuthenticate, c.dvrDelete)
+	r.GET("/dvr/rules", c.queryAuthenticate, c.dvrRules)
+	r.POST("/dvr/rules", c.queryAuthenticate, c.dvrAddRule)
+	r.DELETE("/dvr/rules/:id", c.queryAuthenticate, c.dvrDeleteRule)
 }
 
 func (c *Config) m3uRoutes(r *gin.RouterGroup) {
 	r.GET("/"+c.M3UFileName, c.authenticate, c.getM3U)
 	// XXX Private need: for external Android app
 	r.POST("/"+c.M3UFileName, c.authenticate, c.getM3U)
+	r.POST("/refresh", c.authenticate, requireAdmin, c.refreshPlaylist)
 
-	for i, track := range c.playlist.Tracks {
-		trackConfig := &Config{
-			ProxyConfig: c.ProxyConfig,
-			track:       &c.playlist.Tracks[i],
-		}
-
-		if strings.HasSuffix(track.URI, ".m3u8") {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/:id", c.endpointAntiColision, c.User, c.Password, i), trackConfig.m3u8ReverseProxy)
-		} else {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/%s", c.endpointAntiColision, c.User, c.Password, i, path.Base(track.URI)), trackConfig.reverseProxy)
-		}
-	}
+	// Tracks are resolved at request time so the playlist can be reloaded.
+	r.GET(fmt.Sprintf("/%s/:username/:password/:track/:id", c.endpointAntiColision), c.streamAuthenticate, c.m3uTrackHandler)
+	r.GET(fmt.Sprintf("/%s/:username/:password/:track/hls/:token/:name", c.endpointAntiColision), c.streamAuthenticate, c.m3uHlsHandler)
 }
@@ -22,77 +22,167 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/dvr"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/fanout"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/hls"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/ssdp"
 	uuid "github.com/satori/go.uuid"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/gin-gonic/gin"
 )
 
-var defaultProxyfiedM3UPath = filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
 var endpointAntiColision = strings.Split(uuid.NewV4().String(), "-")[0]
 
 // Config represent the server configuration
 type Config struct {
 	*config.ProxyConfig
 
+	// generated playlists and API responses
+	cache cache.Cache
+	// keys of the cached API responses being revalidated
+	revalidating sync.Map
+	// m3u generations in progress by cache key
+	m3uFlight singleflight.Group
+
 	// M3U service part
-	playlist *m3u.Playlist
-	// this variable is set only for m3u proxy endpoints
-	track *m3u.Track
-	// path to the proxyfied m3u file
-	proxyfiedM3UPath string
+	playlist *playlistStore
+	// signs the upstream urls of the rewritten hls playlists
+	hlsSigner *hls.Signer
+
+	// Xtream service part
+	catalog *catalogIndex
+	// xtream hls streams by session token
+	hlsSessions *hlsSessionStore
+	// cached XMLTV guide, nil without guide source
+	epg *epg.Store
+	// fills the missing tvg-ids, nil when the matching is disabled
+	tvgIDs *tvgIDMatcher
+
+	// HDHomeRun tuner, nil when disabled
+	hdhomerun *hdhomerun
+	// advertises the tuner on the LAN, nil when disabled
+	ssdp *ssdp.Responder
+
+	// recordings of the live channels, nil when disabled
+	dvr *dvr.Scheduler
+
+	// shared live streams, nil when the fan-out is disabled
+	fanout *fanout.Hub
+	// active upstream connections by source account
+	connections *connectionAccountant
 
 	endpointAntiColision string
 
+	// httpClient streams the upstreams, it has no overall timeout
 	httpClient *http.Client
 	httpServer *http.Server
+
+	// closed on Shutdown to stop background jobs
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
 // NewServer initialize a new server configuration
 func NewServer(config *config.ProxyConfig) (*Config, error) {
-	var p m3u.Playlist
-	if config.RemoteURL.String() != "" {
-		var err error
-		p, err = m3u.Parse(config.RemoteURL.String())
-		if err != nil {
+	// The tuner is checked before the playlist is downloaded.
+	if config.HDHomeRun {
+		if _, err := hdhrUser(config); err != nil {
 			return nil, err
 		}
 	}
 
+	p, headerEPGURLs, err := parsePlaylist(m3uSources(config))
+	if err != nil {
+		return nil, err
+	}
+
 	if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
 		endpointAntiColision = trimmedCustomId
 	}
 
-	// Create a custom transport for better performance
+	// Create a custom transport for better performance.
+	// The streams last as long as they are watched, only the connection and the response headers time out.
 	t := &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
-		IdleConnTimeout:     90 * time.Second,
-	}
-
-	return &Config{
-		config,
-		&p,
-		nil,
-		defaultProxyfiedM3UPath,
-		endpointAntiColision,
-		&http.Client{
-			Transport: t,
-			Timeout:   30 * time.Second,
-		},
-		nil,
-	}, nil
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	responseCache, err := cache.New(config.CacheURL)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := hls.NewSigner(config.HLSSigningKey, hlsTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	guides, err := newEPGStore(config, headerEPGURLs)
+	if err != nil {
+		return nil, err
+	}
+
+	var hub *fanout.Hub
+	if config.LiveFanout {
+		hub = fanout.NewHub(config.FanoutBufferSize<<20, time.Duration(config.FanoutGracePeriod)*time.Second)
+	}
+
+	var tuner *hdhomerun
+	if config.HDHomeRun {
+		tuner = newHDHomeRun(config.HDHomeRunTuners)
+	}
+
+	var tvgIDs *tvgIDMatcher
+	if guides != nil && config.EPGMatchTvgIDs {
+		tvgIDs = &tvgIDMatcher{}
+	}
+
+	c := &Config{
+		ProxyConfig:          config,
+		cache:                responseCache,
+		playlist:             &playlistStore{current: &playlistSnapshot{playlist: p}},
+		hlsSigner:            signer,
+		catalog:              newCatalogIndex(),
+		hlsSessions:          newHlsSessionStore(),
+		epg:                  guides,
+		tvgIDs:               tvgIDs,
+		hdhomerun:            tuner,
+		fanout:               hub,
+		connections:          newConnectionAccountant(),
+		endpointAntiColision: endpointAntiColision,
+		httpClient:           &http.Client{Transport: t},
+		done:                 make(chan struct{}),
+	}
+
+	if config.DVRDir != "" {
+		if c.dvr, err = newDVR(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
 }
 
 // Serve the iptv-proxy api
@@ -101,11 +191,32 @@ func (c *Config) Serve() error {
 		return err
 	}
 
+	if len(c.XtreamSources()) > 0 {
+		go c.hlsSessionSweepLoop(hlsSessionTTL / 4)
+	}
+
+	if c.epg != nil {
+		go c.epgSyncLoop(epgSyncInterval)
+	}
+	if c.epg != nil && c.EPGRefreshInterval > 0 {
+		go c.epgRefreshLoop(time.Duration(c.EPGRefreshInterval) * time.Hour)
+	}
+
+	if c.LibraryDir != "" && c.LibraryRefreshInterval > 0 && len(c.XtreamSources()) > 0 {
+		go c.libraryRefreshLoop(time.Duration(c.LibraryRefreshInterval) * time.Hour)
+	}
+
 	router := gin.Default()
 	router.Use(cors.Default())
 	group := router.Group("/")
 	c.routes(group)
 
+	if c.SSDP && c.hdhomerun == nil {
+		log.Printf("[iptv-proxy] %v | SSDP responder disabled: the HDHomeRun tuner is disabled\n", time.Now().Format("2006/01/02 - 15:04:05"))
+	} else if c.SSDP {
+		c.startSSDP()
+	}
+
 	log.Printf("[iptv-proxy] Server is ready and listening on :%d", c.HostConfig.Port)
 
 	c.httpServer = &http.Server{
@@ -117,10 +228,24 @@ func (c *Config) Serve() error {
 		IdleTimeout:       120 * time.Second,
 	}
 
+	// The recordings pull their stream through the routes of the server.
+	if c.dvr != nil {
+		c.dvr.Start()
+		go c.applyDVRRules()
+	}
+
 	return c.httpServer.ListenAndServe()
 }
 
 func (c *Config) Shutdown(ctx context.Context) error {
+	c.doneOnce.Do(func() { close(c.done) })
+	c.cache.Close() // nolint: errcheck
+	if c.ssdp != nil {
+		c.ssdp.Close() // nolint: errcheck
+	}
+	if c.dvr != nil {
+		c.dvr.Close() // nolint: errcheck
+	}
 	if c.httpServer != nil {
 		return c.httpServer.Shutdown(ctx)
 	}
@@ -128,26 +253,72 @@ func (c *Config) Shutdown(ctx context.Context) error {
 }
 
 func (c *Config) playlistInitialization() error {
-	if len(c.playlist.Tracks) == 0 {
+	if c.M3URefreshInterval > 0 && len(m3uSources(c.ProxyConfig)) > 0 {
+		go c.playlistRefreshLoop(time.Duration(c.M3URefreshInterval) * time.Minute)
+	}
+
+	p := c.playlist.get().playlist
+	if len(p.Tracks) == 0 {
 		return nil
 	}
 
-	f, err := os.Create(c.proxyfiedM3UPath)
+	return c.publishPlaylist(p)
+}
+
+// writeM3U writes the playlist proxyfied for user into a new temporary file,
+// ids are the stream IDs of the tracks.
+func (c *Config) writeM3U(playlist *m3u.Playlist, catalog *m3uCatalog, user *config.User) (string, error) {
+	path := filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
+	f, err := os.Create(path)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer f.Close()
 
-	return c.marshallInto(f, false)
+	if err := c.marshallInto(f, playlist, catalog, nil, user); err != nil {
+		os.Remove(path) // nolint: errcheck
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(path) // nolint: errcheck
+		return "", err
+	}
+
+	return path, nil
 }
 
 // MarshallInto a *bufio.Writer a Playlist.
-func (c *Config) marshallInto(into *os.File, xtream bool) error {
-	filteredTrack := make([]m3u.Track, 0, len(c.playlist.Tracks))
+// Tracks with an invalid URI are skipped, the playlist is left as is.
+// The m3u tracks are proxyfied with their stream ID in catalog, an xtream playlist has no catalog
+// and its tracks are entitled with the xtream catalogue contents.
+func (c *Config) marshallInto(into io.StringWriter, playlist *m3u.Playlist, catalog *m3uCatalog, contents map[string]map[int]config.Content, user *config.User) error {
+	xtream := catalog == nil
+
+	if c.epg != nil {
+		epgURL := c.epgURL(user)
+		into.WriteString(fmt.Sprintf("#EXTM3U url-tvg=%q x-tvg-url=%q\n", epgURL, epgURL)) // nolint: errcheck
+	} else {
+		into.WriteString("#EXTM3U\n") // nolint: errcheck
+	}
+	for i, track := range playlist.Tracks {
+		trackID := 0
+		if !xtream {
+			trackID = catalog.ids[i]
+		}
+		uri, err := c.replaceURL(track.URI, trackID, xtream, user)
+		if err != nil {
+			log.Printf("ERROR: track: %s: %s", track.Name, err)
+			continue
+		}
+
+		// Filtered tracks keep their ID so the track urls are the same for every user.
+		if xtream && !xtreamTrackAllowed(user, contents, &track) {
+			continue
+		}
+		if !xtream && !user.Entitlements.Allows(catalog.trackContent(playlist.Tracks, i)) {
+			continue
+		}
 
-	ret := 0
-	into.WriteString("#EXTM3U\n") // nolint: errcheck
-	for i, track := range c.playlist.Tracks {
 		var buffer bytes.Buffer
 
 		buffer.WriteString("#EXTINF:")                       // nolint: errcheck
@@ -160,24 +331,14 @@ func (c *Config) marshallInto(into *os.File, xtream bool) error {
 			buffer.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
 		}
 
-		uri, err := c.replaceURL(track.URI, i-ret, xtream)
-		if err != nil {
-			ret++
-			log.Printf("ERROR: track: %s: %s", track.Name, err)
-			continue
-		}
-
 		into.WriteString(fmt.Sprintf("%s, %s\n%s\n", buffer.String(), track.Name, uri)) // nolint: errcheck
-
-		filteredTrack = append(filteredTrack, track)
 	}
-	c.playlist.Tracks = filteredTrack
 
-	return into.Sync()
+	return nil
 }
 
 // ReplaceURL replace original playlist url by proxy url
-func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, error) {
+func (c *Config) replaceURL(uri string, trackID int, xtream bool, user *config.User) (string, error) {
 	oriURL, err := url.Parse(uri)
 	if err != nil {
 		return "", err
@@ -195,10 +356,12 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 
 	uriPath := oriURL.EscapedPath()
 	if xtream {
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamUser.PathEscape(), c.User.PathEscape())
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamPassword.PathEscape(), c.Password.PathEscape())
+		for _, s := range c.XtreamSources() {
+			uriPath = strings.ReplaceAll(uriPath, s.XtreamUser.PathEscape(), user.Username.PathEscape())
+			uriPath = strings.ReplaceAll(uriPath, s.XtreamPassword.PathEscape(), user.Password.PathEscape())
+		}
 	} else {
-		uriPath = path.Join("/", c.endpointAntiColision, c.User.PathEscape(), c.Password.PathEscape(), fmt.Sprintf("%d", trackIndex), path.Base(uriPath))
+		uriPath = path.Join("/", c.endpointAntiColision, user.Username.PathEscape(), user.Password.PathEscape(), fmt.Sprintf("%d", trackID), path.Base(uriPath))
 	}
 
 	basicAuth := oriURL.User.String()
@@ -0,0 +1,68 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// xtreamStreamSource returns the source and the upstream stream id
+// of a proxyfied stream id e.g "1000000123.ts" -> "123.ts".
+func (c *Config) xtreamStreamSource(id string) (*config.Source, string, error) {
+	ext := path.Ext(id)
+	n, err := strconv.Atoi(strings.TrimSuffix(id, ext))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid stream id %q", id)
+	}
+
+	s, upstreamID, err := c.XtreamSource(n)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return s, strconv.Itoa(upstreamID) + ext, nil
+}
+
+// proxyStreamURI replaces the upstream stream id of an xtream stream url by the proxyfied one.
+func proxyStreamURI(s *config.Source, uri string) string {
+	if s.ProxyID(0) == 0 {
+		return uri
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	id := path.Base(u.Path)
+	ext := path.Ext(id)
+	n, err := strconv.Atoi(strings.TrimSuffix(id, ext))
+	if err != nil {
+		return uri
+	}
+	u.Path = path.Join(path.Dir(u.Path), strconv.Itoa(s.ProxyID(n))+ext)
+
+	return u.String()
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestXtreamSourceIDs(t *testing.T) {
+	sources, err := config.NewSources(
+		config.Source{Name: "free", M3UURL: "http://free.example.com/list.m3u"},
+		config.Source{Name: "first", XtreamBaseURL: "http://first.example.com", XtreamUser: "u1", XtreamPassword: "p1"},
+		config.Source{Name: "second", XtreamBaseURL: "http://second.example.com/", XtreamUser: "u2", XtreamPassword: "p2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{ProxyConfig: &config.ProxyConfig{Sources: sources}}
+
+	tests := []struct {
+		name       string
+		index      int
+		uri        string
+		proxyURI   string
+		source     string
+		upstreamID string
+	}{
+		{
+			name:       "first source IDs are unchanged",
+			index:      1,
+			uri:        "http://first.example.com/live/u1/p1/123.ts",
+			proxyURI:   "http://first.example.com/live/u1/p1/123.ts",
+			source:     "first",
+			upstreamID: "123.ts",
+		},
+		{
+			name:       "second source IDs are prefixed",
+			index:      2,
+			uri:        "http://second.example.com/movie/u2/p2/456.mkv",
+			proxyURI:   "http://second.example.com/movie/u2/p2/100000456.mkv",
+			source:     "second",
+			upstreamID: "456.mkv",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURI := proxyStreamURI(sources[tt.index], tt.uri)
+			if proxyURI != tt.proxyURI {
+				t.Fatalf("proxyStreamURI() = %q, want %q", proxyURI, tt.proxyURI)
+			}
+
+			got, upstreamID, err := c.xtreamStreamSource(path.Base(proxyURI))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.source || upstreamID != tt.upstreamID {
+				t.Errorf("xtreamStreamSource() = %q, %q, want %q, %q", got.Name, upstreamID, tt.source, tt.upstreamID)
+			}
+		})
+	}
+
+	if _, _, err := c.xtreamStreamSource("2000000001.ts"); err == nil {
+		t.Error("xtreamStreamSource() of an unknown source: want an error")
+	}
+}
+
+func TestSingleXtreamSourceIDs(t *testing.T) {
+	sources, err := config.NewSources(
+		config.Source{Name: "free", M3UURL: "http://free.example.com/list.m3u"},
+		config.Source{Name: "first", XtreamBaseURL: "http://first.example.com", XtreamUser: "u1", XtreamPassword: "p1"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{ProxyConfig: &config.ProxyConfig{Sources: sources}}
+
+	// The IDs of a single xtream source aren't bounded by the source ID stride.
+	uri := "http://first.example.com/live/u1/p1/123456789.ts"
+	if got := proxyStreamURI(sources[1], uri); got != uri {
+		t.Fatalf("proxyStreamURI() = %q, want %q", got, uri)
+	}
+	got, upstreamID, err := c.xtreamStreamSource("123456789.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "first" || upstreamID != "123456789.ts" {
+		t.Errorf("xtreamStreamSource() = %q, %q, want %q, %q", got.Name, upstreamID, "first", "123456789.ts")
+	}
+}
+
+func TestXtreamStreamPlay(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/play/unknown/ts" && name == "first" {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, name+" "+r.URL.Path) // nolint: errcheck
+		}))
+	}
+	first, second := upstream("first"), upstream("second")
+	defer first.Close()
+	defer second.Close()
+
+	sources, err := config.NewSources(
+		config.Source{Name: "first", XtreamBaseURL: first.URL, XtreamUser: "u1", XtreamPassword: "p1", MaxConnections: -1},
+		config.Source{Name: "second", XtreamBaseURL: second.URL, XtreamUser: "u2", XtreamPassword: "p2", MaxConnections: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Sources: sources},
+		connections: newConnectionAccountant(),
+		httpClient:  &http.Client{},
+	}
+
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"123", "first /play/123/ts"},
+		{"100000456", "second /play/456/ts"},
+		// A token without source is tried on every source.
+		{"unknown", "second /play/unknown/ts"},
+	}
+	for _, tt := range tests {
+		w := &streamRecorder{httptest.NewRecorder()}
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/play/"+tt.token+"/ts", nil)
+		ctx.Params = gin.Params{{Key: "token", Value: tt.token}, {Key: "type", Value: "ts"}}
+		c.xtreamStreamPlay(ctx)
+		if w.Body.String() != tt.want {
+			t.Errorf("play %s = %q, want %q", tt.token, w.Body.String(), tt.want)
+		}
+	}
+
+	// The play urls are charged to the account of their source.
+	release, err := c.acquireConnection(context.Background(), sources[1], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	w := &streamRecorder{httptest.NewRecorder()}
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/play/100000456/ts", nil)
+	ctx.Params = gin.Params{{Key: "token", Value: "100000456"}, {Key: "type", Value: "ts"}}
+	c.xtreamStreamPlay(ctx)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("play on a full account status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// The play urls are authenticated and entitled as the other stream urls.
+	users, err := config.NewUserStore(
+		config.User{Username: "alice", Password: "secret"},
+		config.User{Username: "kids", Password: "secret", Entitlements: config.Entitlements{Allow: []config.EntitlementRule{{Group: "Kids"}}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Users = users
+	c.catalog = newCatalogIndex()
+	c.cache = cache.NewMemory()
+	router := gin.New()
+	c.xtreamRoutes(router.Group("/"))
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	routeTests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{"", http.StatusBadRequest},
+		{"?username=alice&password=wrong", http.StatusUnauthorized},
+		{"?username=kids&password=secret", http.StatusForbidden},
+		{"?username=alice&password=secret", http.StatusOK},
+	}
+	for _, tt := range routeTests {
+		resp, err := http.Get(proxy.URL + "/play/123/ts" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("play%s status = %d, want %d", tt.query, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
+
+func TestProxyHlsBody(t *testing.T) {
+	source := &config.Source{XtreamUser: "u2", XtreamPassword: "p2"}
+	user := &config.User{Username: "alice", Password: "secret"}
+
+	body := "#EXTM3U\n/hlsr/token/u2/p2/456/hash/1.ts\n/hls/token/456_2.ts\n"
+	want := "#EXTM3U\n/hlsr/token/alice/secret/100000456/hash/1.ts\n/hls/token/100000456_2.ts\n"
+	if got := proxyHlsBody(body, source, user, "456", "100000456"); got != want {
+		t.Errorf("proxyHlsBody() = %q, want %q", got, want)
+	}
+}
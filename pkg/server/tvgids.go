@@ -0,0 +1,128 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/epg"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/rules"
+	"go.yaml.in/yaml/v3"
+)
+
+// tvgIDReportFile lists the playlist channels left without tvg-id, in the guide cache directory.
+const tvgIDReportFile = "tvg-id-report.yaml"
+
+// tvgIDMatcher matches the playlist channels without tvg-id with the channels of the current guide.
+type tvgIDMatcher struct {
+	lock sync.Mutex
+	// ETag of the guide of the matcher
+	guide   string
+	matcher *epg.Matcher
+	// matches by channel name, reported when not confident
+	matches map[string]epg.Match
+}
+
+// applyPlaylistRules fills the missing tvg-ids of the tracks, then applies the playlist rules to them.
+func (c *Config) applyPlaylistRules(tracks []m3u.Track) []m3u.Track {
+	c.fillTvgIDs(tracks)
+
+	return c.PlaylistRules.Apply(tracks)
+}
+
+// fillTvgIDs sets the tvg-id of the tracks without one, from the tvg_ids pins of the epg file
+// or from the guide channel of the same name. The unmatched channels are written to the report.
+func (c *Config) fillTvgIDs(tracks []m3u.Track) {
+	if c.tvgIDs == nil {
+		return
+	}
+	guide := c.epg.Current()
+	if guide == nil {
+		return
+	}
+
+	t := c.tvgIDs
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.guide != guide.ETag {
+		t.guide = guide.ETag
+		t.matcher = epg.NewMatcher(c.epg.Channels())
+		t.matches = map[string]epg.Match{}
+	}
+
+	var matched, added int
+	for i := range tracks {
+		track := &tracks[i]
+		if rules.Tag(track, rules.TagTvgID) != "" {
+			continue
+		}
+
+		id, ok := c.EPG.PinnedTvgID(track.Name)
+		if !ok {
+			m, seen := t.matches[track.Name]
+			if !seen {
+				m = t.matcher.Match(track.Name)
+				t.matches[track.Name] = m
+				added++
+			}
+			id, _ = m.ChannelID()
+		}
+		if id != "" {
+			rules.SetTag(track, rules.TagTvgID, id)
+			matched++
+		}
+	}
+
+	if added > 0 {
+		path := filepath.Join(epgCacheDir(c.ProxyConfig), tvgIDReportFile)
+		unmatched, err := t.writeReport(path)
+		if err != nil {
+			log.Printf("[iptv-proxy] ERROR: tvg-id report: %v", err)
+			return
+		}
+		log.Printf("[iptv-proxy] %v | tvg-ids matched: %d, unmatched: %d, see %s\n", time.Now().Format("2006/01/02 - 15:04:05"), matched, unmatched, path)
+	}
+}
+
+// writeReport writes the channels without confident match with their candidates,
+// it returns their number.
+func (t *tvgIDMatcher) writeReport(path string) (int, error) {
+	report := []epg.Match{}
+	for _, m := range t.matches {
+		if _, ok := m.ChannelID(); !ok {
+			report = append(report, m)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+
+	b, err := yaml.Marshal(report)
+	if err != nil {
+		return 0, err
+	}
+	header := "# Playlist channels without a confident guide channel, pin them in the tvg_ids of the epg file.\n"
+
+	return len(report), os.WriteFile(path, append([]byte(header), b...), 0o644) // nolint: gosec
+}
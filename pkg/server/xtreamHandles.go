@@ -19,65 +19,133 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
 	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
-	uuid "github.com/satori/go.uuid"
+	xtream "github.com/sherif-fanous/xtreamcodes"
 )
 
-type cacheMeta struct {
-	string
-	time.Time
-}
+// cachedXtreamM3u serves the m3u cacheName proxyfied for the request user,
+// generate is called when it is not in the cache.
+func (c *Config) cachedXtreamM3u(ctx *gin.Context, cacheName string, generate func(ctx context.Context) (*m3u.Playlist, error)) {
+	playlist, err := c.sharedXtreamM3u(cacheName, generate)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
 
-var hlsChannelsRedirectURL map[string]url.URL = map[string]url.URL{}
-var hlsChannelsRedirectURLLock = sync.RWMutex{}
+	user := contextUser(ctx)
+	var contents map[string]map[int]config.Content
+	if user.Entitlements.IsRestricted() {
+		contents, _ = c.catalogContents(ctx, ctx.Request.UserAgent())
+	}
 
-// XXX Use key/value storage e.g: etcd, redis...
-// and remove that dirty globals
-var xtreamM3uCache map[string]cacheMeta = map[string]cacheMeta{}
-var xtreamM3uCacheLock = sync.RWMutex{}
+	var buf bytes.Buffer
+	if err := c.marshallInto(&buf, playlist, nil, contents, user); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
 
-func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string) error {
-	xtreamM3uCacheLock.Lock()
-	defer xtreamM3uCacheLock.Unlock()
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
+	ctx.Data(http.StatusOK, "application/octet-stream", buf.Bytes())
+}
 
-	tmp := *c
-	tmp.playlist = playlist
+// sharedXtreamM3u returns the upstream m3u cacheName with the playlist rules applied,
+// it is generated once for every user and proxyfied per user by the callers.
+// Concurrent requests of the same m3u share one generation and its error.
+func (c *Config) sharedXtreamM3u(cacheName string, generate func(ctx context.Context) (*m3u.Playlist, error)) (*m3u.Playlist, error) {
+	key := "m3u|" + cacheName
+
+	v, err, _ := c.m3uFlight.Do(key, func() (interface{}, error) {
+		// The generation is shared with the coalesced requests, it outlives the one that started it.
+		ctx, cancel := context.WithTimeout(context.Background(), m3uFetchTimeout)
+		defer cancel()
+
+		b, err := c.cache.Get(ctx, key)
+		if err == nil {
+			var playlist m3u.Playlist
+			if err := json.Unmarshal(b, &playlist); err == nil {
+				return &playlist, nil
+			}
+		} else if !errors.Is(err, cache.ErrMiss) {
+			utils.PrintErrorAndReturn(err) // nolint: errcheck
+		}
+		log.Printf("[iptv-proxy] %v | xtream cache m3u file %s\n", time.Now().Format("2006/01/02 - 15:04:05"), cacheName)
 
-	path := filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
-	f, err := os.Create(path)
+		playlist, err := generate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		playlist.Tracks = c.applyPlaylistRules(playlist.Tracks)
+
+		if ttl := time.Duration(c.M3UCacheExpiration) * time.Hour; ttl > 0 {
+			b, err := json.Marshal(playlist)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.cache.Set(ctx, key, b, ttl); err != nil {
+				utils.PrintErrorAndReturn(err) // nolint: errcheck
+			}
+		}
+
+		return playlist, nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
 
-	if err := tmp.marshallInto(f, true); err != nil {
-		return err
+	return v.(*m3u.Playlist), nil
+}
+
+// xtreamLiveM3u returns the shared live m3u of the xtream sources, the one of apiget.php.
+func (c *Config) xtreamLiveM3u(userAgent, extension string) (*m3u.Playlist, error) {
+	return c.sharedXtreamM3u("apiget"+extension, func(ctx context.Context) (*m3u.Playlist, error) {
+		return c.xtreamGenerateM3u(ctx, userAgent, extension)
+	})
+}
+
+// cacheSet caches a response for ttl, nothing is cached if ttl is zero.
+func (c *Config) cacheSet(ctx *gin.Context, key string, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	if err := c.cache.Set(ctx.Request.Context(), key, value, ttl); err != nil {
+		utils.PrintErrorAndReturn(err) // nolint: errcheck
+	}
+}
+
+// xtreamGenerateM3u generates the live m3u of every xtream source.
+func (c *Config) xtreamGenerateM3u(ctx context.Context, userAgent, extension string) (*m3u.Playlist, error) {
+	var playlist = new(m3u.Playlist)
+	for _, s := range c.XtreamSources() {
+		p, err := c.xtreamGenerateSourceM3u(ctx, userAgent, s, extension)
+		if err != nil {
+			return nil, err
+		}
+		playlist.Tracks = append(playlist.Tracks, p.Tracks...)
 	}
-	xtreamM3uCache[cacheName] = cacheMeta{path, time.Now()}
 
-	return nil
+	return playlist, nil
 }
 
-func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Playlist, error) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+func (c *Config) xtreamGenerateSourceM3u(ctx context.Context, userAgent string, source *config.Source, extension string) (*m3u.Playlist, error) {
+	client, err := xtreamapi.New(source, userAgent)
 	if err != nil {
 		return nil, utils.PrintErrorAndReturn(err)
 	}
@@ -115,6 +183,9 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 		}
 
 		for _, stream := range live {
+			if !source.ValidID(stream.StreamID) {
+				continue
+			}
 			track := m3u.Track{Name: stream.Name, Length: -1, URI: "", Tags: nil}
 
 			//TODO: Add more tag if needed.
@@ -131,7 +202,7 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category.CategoryName})
 			}
 
-			track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", c.XtreamBaseURL, prefix, c.XtreamUser, c.XtreamPassword, fmt.Sprint(stream.StreamID), extension)
+			track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", source.XtreamBaseURL, prefix, source.XtreamUser, source.XtreamPassword, fmt.Sprint(source.ProxyID(stream.StreamID)), extension)
 			playlist.Tracks = append(playlist.Tracks, track)
 		}
 	}
@@ -140,8 +211,14 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 }
 
 func (c *Config) xtreamGetAuto(ctx *gin.Context) {
+	remoteURL, err := url.Parse(c.Sources[0].M3UURL)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
 	newQuery := ctx.Request.URL.Query()
-	q := c.RemoteURL.Query()
+	q := remoteURL.Query()
 	for k, v := range q {
 		if k == "username" || k == "password" {
 			continue
@@ -155,7 +232,7 @@ func (c *Config) xtreamGetAuto(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamGet(ctx *gin.Context) {
-	rawURL := fmt.Sprintf("%s/get.php?username=%s&password=%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword)
+	var query string
 
 	q := ctx.Request.URL.Query()
 
@@ -164,41 +241,37 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 			continue
 		}
 
-		rawURL = fmt.Sprintf("%s&%s=%s", rawURL, k, strings.Join(v, ","))
+		query = fmt.Sprintf("%s&%s=%s", query, k, strings.Join(v, ","))
 	}
 
-	m3uURL, err := url.Parse(rawURL)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-		return
-	}
+	// The upstream playlist is shared by the users, it is proxyfied with their credentials when served.
+	c.cachedXtreamM3u(ctx, "get.php"+query, func(context.Context) (*m3u.Playlist, error) {
+		return c.xtreamGetPlaylist(query)
+	})
+}
 
-	xtreamM3uCacheLock.RLock()
-	meta, ok := xtreamM3uCache[m3uURL.String()]
-	d := time.Since(meta.Time)
-	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
-		log.Printf("[iptv-proxy] %v | %s | xtream cache m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-		xtreamM3uCacheLock.RUnlock()
-		playlist, err := m3u.Parse(m3uURL.String())
+// xtreamGetPlaylist merges the get.php m3u of the xtream sources,
+// query is appended to their get.php url.
+func (c *Config) xtreamGetPlaylist(query string) (*m3u.Playlist, error) {
+	playlist := &m3u.Playlist{}
+	for _, s := range c.XtreamSources() {
+		m3uURL, err := url.Parse(fmt.Sprintf("%s/get.php?username=%s&password=%s%s", s.XtreamBaseURL, s.XtreamUser, s.XtreamPassword, query))
 		if err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-			return
+			return nil, err
 		}
-		if err := c.cacheXtreamM3u(&playlist, m3uURL.String()); err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-			return
+
+		p, err := m3u.Parse(m3uURL.String())
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", s.Name, err)
 		}
-	} else {
-		xtreamM3uCacheLock.RUnlock()
-	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
-	xtreamM3uCacheLock.RLock()
-	path := xtreamM3uCache[m3uURL.String()].string
-	xtreamM3uCacheLock.RUnlock()
-	ctx.Header("Content-Type", "application/octet-stream")
+		for _, track := range p.Tracks {
+			track.URI = proxyStreamURI(s, track.URI)
+			playlist.Tracks = append(playlist.Tracks, track)
+		}
+	}
 
-	ctx.File(path)
+	return playlist, nil
 }
 
 func (c *Config) xtreamApiGet(ctx *gin.Context) {
@@ -208,36 +281,12 @@ func (c *Config) xtreamApiGet(ctx *gin.Context) {
 
 	var (
 		extension = ctx.Query("output")
-		cacheName = apiGet + extension
+		userAgent = ctx.Request.UserAgent()
 	)
 
-	xtreamM3uCacheLock.RLock()
-	meta, ok := xtreamM3uCache[cacheName]
-	d := time.Since(meta.Time)
-	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
-		log.Printf("[iptv-proxy] %v | %s | xtream cache API m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-		xtreamM3uCacheLock.RUnlock()
-		playlist, err := c.xtreamGenerateM3u(ctx, extension)
-		if err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-			return
-		}
-		if err := c.cacheXtreamM3u(playlist, cacheName); err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-			return
-		}
-	} else {
-		xtreamM3uCacheLock.RUnlock()
-	}
-
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
-	xtreamM3uCacheLock.RLock()
-	path := xtreamM3uCache[cacheName].string
-	xtreamM3uCacheLock.RUnlock()
-	ctx.Header("Content-Type", "application/octet-stream")
-
-	ctx.File(path)
-
+	c.cachedXtreamM3u(ctx, apiGet+extension, func(genCtx context.Context) (*m3u.Playlist, error) {
+		return c.xtreamGenerateM3u(genCtx, userAgent, extension)
+	})
 }
 
 func (c *Config) xtreamPlayerAPIGET(ctx *gin.Context) {
@@ -245,6 +294,11 @@ func (c *Config) xtreamPlayerAPIGET(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamPlayerAPIPOST(ctx *gin.Context) {
+	c.playerAPIPOST(ctx, c.xtreamPlayerAPI)
+}
+
+// playerAPIPOST calls handle with the query of a player_api.php form body.
+func (c *Config) playerAPIPOST(ctx *gin.Context, handle func(ctx *gin.Context, q url.Values)) {
 	contents, err := ioutil.ReadAll(ctx.Request.Body)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
@@ -257,7 +311,7 @@ func (c *Config) xtreamPlayerAPIPOST(ctx *gin.Context) {
 		return
 	}
 
-	c.xtreamPlayerAPI(ctx, q)
+	handle(ctx, q)
 }
 
 func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
@@ -266,28 +320,81 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 		action = q["action"][0]
 	}
 
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+	clients, err := xtreamapi.NewClients(c.XtreamSources(), ctx.Request.UserAgent())
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	resp, httpcode, contentType, err := client.Action(c.ProxyConfig, action, q)
+	// The recordings are the VODs of the proxy, they aren't in the catalogue of the entitlements.
+	if c.serveDVRPlayerAPI(ctx, action, q) {
+		return
+	}
+
+	if !c.actionEntitled(ctx, action, q) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	// The guide screens ask the programmes of every channel, they are answered from the cached guide.
+	if c.epg != nil && (action == "get_short_epg" || action == "get_simple_data_table") {
+		if b, ok := c.localEPG(ctx, action, q); ok {
+			ctx.Data(http.StatusOK, "application/json; charset=utf-8", b)
+			return
+		}
+	}
+
+	user := contextUser(ctx)
+	fetch := func() ([]byte, int, error) {
+		// The response is shared with the coalesced requests, it outlives this one.
+		return c.playerAPIResponse(context.Background(), clients, user, action, q)
+	}
+
+	// The login response is never cached, it tells the account status.
+	var (
+		b    []byte
+		code int
+	)
+	if action == "" {
+		b, code, err = fetch()
+	} else {
+		b, code, err = c.cachedAPIResponse(ctx, playerAPICacheKey(user, action, q), c.apiCacheTTL(action), c.apiCacheStale(action), fetch)
+	}
 	if err != nil {
-		ctx.AbortWithError(httpcode, utils.PrintErrorAndReturn(err))
+		ctx.AbortWithError(code, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
+	b = c.appendRecordings(user, action, q, b)
 
-	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
+	if action == "get_series_info" {
+		var series xtream.Series
+		if err := json.Unmarshal(b, &series); err == nil {
+			c.indexEpisodes(ctx.Request.Context(), q.Get("series_id"), &series)
+		}
+	}
 
-	processedResp := ProcessResponse(resp)
+	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
 
 	if config.CacheFolder != "" {
-		readableJSON, _ := json.Marshal(processedResp)
-		utils.WriteResponseToFile(ctx, readableJSON, contentType)
+		utils.WriteResponseToFile(ctx, b, "application/json")
 	}
 
-	ctx.JSON(http.StatusOK, processedResp)
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", b)
+}
+
+// playerAPIResponse calls the action on the upstream and returns its JSON response.
+func (c *Config) playerAPIResponse(ctx context.Context, clients xtreamapi.Clients, user *config.User, action string, q url.Values) ([]byte, int, error) {
+	resp, httpcode, _, err := clients.Action(ctx, c.ProxyConfig, user, action, q)
+	if err != nil {
+		return nil, httpcode, err
+	}
+
+	b, err := json.Marshal(ProcessResponse(resp))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return b, http.StatusOK, nil
 }
 
 // ProcessResponse processes various types of xtream-codes responses
@@ -303,125 +410,169 @@ func processXtreamArray(arr interface{}) interface{} {
 // ... remove other legacy reflection functions ...
 */
 
-func (c *Config) xtreamXMLTV(ctx *gin.Context) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
+	s, id, err := c.xtreamStreamSource(ctx.Param("id"))
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	resp, err := client.GetXMLTV(ctx)
+	rpURLs, err := xtreamURLs(s, "/%s/%s/%s", s.XtreamUser, s.XtreamPassword, id)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	// Write response to file
-	// utils.WriteResponseToFile(ctx, resp)
-
-	b, err := xml.Marshal(resp)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+	if !strings.HasSuffix(id, ".m3u8") {
+		// The streams of the same guide channel are tried after the source urls.
+		c.liveStream(ctx, append(rpURLs, c.xtreamAlternativeURLs(ctx, ctx.Param("id"))...)...)
 		return
 	}
 
-	ctx.Data(http.StatusOK, "application/xml", b)
+	c.xtreamStream(ctx, s, id, rpURLs)
 }
 
-func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
+func (c *Config) xtreamStreamLive(ctx *gin.Context) {
+	c.xtreamLive(ctx, ctx.Param("id"))
+}
+
+// xtreamLive proxyfies the live stream of a proxyfied stream id e.g "1000000123.ts" from its source.
+func (c *Config) xtreamLive(ctx *gin.Context, proxyID string) {
+	s, id, err := c.xtreamStreamSource(proxyID)
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
-}
-
-func (c *Config) xtreamStreamLive(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/live/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
+	rpURLs, err := xtreamURLs(s, "/live/%s/%s/%s", s.XtreamUser, s.XtreamPassword, id)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	if !strings.HasSuffix(id, ".m3u8") {
+		// The streams of the same guide channel are tried after the source urls.
+		c.liveStream(ctx, append(rpURLs, c.xtreamAlternativeURLs(ctx, proxyID)...)...)
+		return
+	}
+
+	c.xtreamStream(ctx, s, id, rpURLs)
 }
 
+// xtreamStreamPlay proxyfies a play url, a proxyfied stream ID token is sent to its source.
+// Other tokens don't tell their source, the sources are tried in order.
 func (c *Config) xtreamStreamPlay(ctx *gin.Context) {
 	token := ctx.Param("token")
 	t := ctx.Param("type")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/play/%s/%s", c.XtreamBaseURL, token, t))
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-		return
+
+	sources := c.XtreamSources()
+	if _, err := strconv.Atoi(token); err == nil {
+		s, id, err := c.xtreamStreamSource(token)
+		if err != nil {
+			ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+			return
+		}
+		sources, token = []*config.Source{s}, id
+	}
+
+	// The play urls have no account, their connections are charged to the source they are built from.
+	var rpURLs []*url.URL
+	urlSources := map[string]*config.Source{}
+	for _, s := range sources {
+		urls, err := xtreamURLs(s, "/play/%s/%s", token, t)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+			return
+		}
+		for _, u := range urls {
+			urlSources[u.String()] = s
+		}
+		rpURLs = append(rpURLs, urls...)
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	c.streamURLs(ctx, c.sourceConnections(ctx.Request.Context(), urlSources), rpURLs)
 }
 
 func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
 	duration := ctx.Param("duration")
 	start := ctx.Param("start")
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/timeshift/%s/%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, duration, start, id))
+	s, id, err := c.xtreamStreamSource(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	rpURLs, err := xtreamURLs(s, "/timeshift/%s/%s/%s/%s/%s", s.XtreamUser, s.XtreamPassword, duration, start, id)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	c.stream(ctx, rpURL)
+	c.stream(ctx, rpURLs...)
 }
 
 func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/movie/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
+	s, id, err := c.xtreamStreamSource(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	rpURLs, err := xtreamURLs(s, "/movie/%s/%s/%s", s.XtreamUser, s.XtreamPassword, id)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	c.xtreamStream(ctx, s, id, rpURLs)
 }
 
 func (c *Config) xtreamStreamSeries(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/series/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
+	s, id, err := c.xtreamStreamSource(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+
+	rpURLs, err := xtreamURLs(s, "/series/%s/%s/%s", s.XtreamUser, s.XtreamPassword, id)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	c.xtreamStream(ctx, s, id, rpURLs)
 }
 
 func (c *Config) xtreamHlsStream(ctx *gin.Context) {
+	session, err := c.hlsSessions.get(ctx.Param("token"), time.Now())
+	if err != nil {
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	// The chunk url has no credentials, the session token authenticates it.
+	if !session.user.IsEnabled() || session.user.IsExpired(time.Now()) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
 	chunk := ctx.Param("chunk")
 	s := strings.Split(chunk, "_")
-	if len(s) != 2 {
+	if len(s) != 2 || s[0] != session.proxyChannel {
 		ctx.AbortWithError( // nolint: errcheck
-			http.StatusInternalServerError,
+			http.StatusNotFound,
 			utils.PrintErrorAndReturn(errors.New("HSL malformed chunk")),
 		)
 		return
 	}
-	channel := s[0]
-
-	url, err := getHlsRedirectURL(channel)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-		return
-	}
 
 	req, err := url.Parse(
 		fmt.Sprintf(
-			"%s://%s/hls/%s/%s",
-			url.Scheme,
-			url.Host,
-			ctx.Param("token"),
-			ctx.Param("chunk"),
+			"%s://%s/hls/%s/%s_%s",
+			session.redirect.Scheme,
+			session.redirect.Host,
+			session.upstreamToken,
+			session.upstreamChannel,
+			s[1],
 		),
 	)
 
@@ -430,27 +581,30 @@ func (c *Config) xtreamHlsStream(ctx *gin.Context) {
 		return
 	}
 
-	c.xtreamStream(ctx, req)
+	// The session holds the connection of the account.
+	c.streamURLs(ctx, nil, []*url.URL{req})
 }
 
 func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
-	channel := ctx.Param("channel")
-
-	url, err := getHlsRedirectURL(channel)
+	session, err := c.hlsSessions.get(ctx.Param("token"), time.Now())
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		ctx.AbortWithError(http.StatusNotFound, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+		return
+	}
+	if session.user.Username != contextUser(ctx).Username || session.proxyChannel != ctx.Param("channel") {
+		ctx.AbortWithStatus(http.StatusForbidden)
 		return
 	}
 
 	req, err := url.Parse(
 		fmt.Sprintf(
 			"%s://%s/hlsr/%s/%s/%s/%s/%s/%s",
-			url.Scheme,
-			url.Host,
-			ctx.Param("token"),
-			c.XtreamUser,
-			c.XtreamPassword,
-			ctx.Param("channel"),
+			session.redirect.Scheme,
+			session.redirect.Host,
+			session.upstreamToken,
+			session.source.XtreamUser,
+			session.source.XtreamPassword,
+			session.upstreamChannel,
 			ctx.Param("hash"),
 			ctx.Param("chunk"),
 		),
@@ -461,40 +615,68 @@ func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
 		return
 	}
 
-	c.xtreamStream(ctx, req)
+	// The session holds the connection of the account.
+	c.streamURLs(ctx, nil, []*url.URL{req})
 }
 
-func getHlsRedirectURL(channel string) (*url.URL, error) {
-	hlsChannelsRedirectURLLock.RLock()
-	defer hlsChannelsRedirectURLLock.RUnlock()
-
-	url, ok := hlsChannelsRedirectURL[channel+".m3u8"]
-	if !ok {
-		return nil, utils.PrintErrorAndReturn(errors.New("HSL redirect url not found"))
+// hlsXtreamStream proxyfies the hls playlist of the upstream stream id of source.
+// The upstream urls are tried in order until one redirects to the hls playlist.
+// The session of the viewer holds a connection of the account until it expires.
+func (c *Config) hlsXtreamStream(ctx *gin.Context, source *config.Source, id string, urls []*url.URL) {
+	user := contextUser(ctx)
+	upstreamChannel, proxyChannel := strings.TrimSuffix(id, ".m3u8"), strings.TrimSuffix(ctx.Param("id"), ".m3u8")
+
+	var release func()
+	if !c.hlsSessions.hold(user, proxyChannel, time.Now()) {
+		var err error
+		release, err = c.acquireConnection(ctx.Request.Context(), source, true)
+		if err != nil {
+			var limitErr *connectionLimitError
+			if errors.As(err, &limitErr) {
+				refuseStream(ctx, err)
+			}
+			return
+		}
+		// Handed over to the session once it is opened.
+		defer func() {
+			if release != nil {
+				release()
+			}
+		}()
 	}
 
-	return &url, nil
-}
-
-func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 	client := &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
 
-	req, err := http.NewRequest("GET", oriURL.String(), nil)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-		return
-	}
+	var resp *http.Response
+	for i, oriURL := range urls {
+		last := i == len(urls)-1
 
-	mergeHttpHeader(req.Header, ctx.Request.Header)
+		req, err := http.NewRequest("GET", oriURL.String(), nil)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+			return
+		}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
-		return
+		mergeHttpHeader(req.Header, ctx.Request.Header)
+
+		r, err := client.Do(req)
+		if err != nil {
+			if last {
+				ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
+				return
+			}
+			utils.PrintErrorAndReturn(err) // nolint: errcheck
+			continue
+		}
+		resp = r
+		if resp.StatusCode == http.StatusFound || last {
+			break
+		}
+		resp.Body.Close()
 	}
 	defer resp.Body.Close()
 
@@ -504,12 +686,7 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 			ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 			return
 		}
-		id := ctx.Param("id")
 		if strings.Contains(location.String(), id) {
-			hlsChannelsRedirectURLLock.Lock()
-			hlsChannelsRedirectURL[id] = *location
-			hlsChannelsRedirectURLLock.Unlock()
-
 			hlsReq, err := http.NewRequest("GET", location.String(), nil)
 			if err != nil {
 				ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
@@ -530,8 +707,31 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 				ctx.AbortWithError(http.StatusInternalServerError, utils.PrintErrorAndReturn(err)) // nolint: errcheck
 				return
 			}
-			body := string(b)
-			body = strings.ReplaceAll(body, "/"+c.XtreamUser.String()+"/"+c.XtreamPassword.String()+"/", "/"+c.User.String()+"/"+c.Password.String()+"/")
+			opened := hlsSession{
+				user:            user,
+				source:          source,
+				redirect:        *location,
+				upstreamToken:   hlsUpstreamToken(string(b)),
+				upstreamChannel: upstreamChannel,
+				proxyChannel:    proxyChannel,
+				release:         release,
+			}
+			session, ok := c.hlsSessions.open(opened, time.Now())
+			if !ok {
+				// The held session expired meanwhile, the new one needs its own connection.
+				if opened.release, err = c.acquireConnection(ctx.Request.Context(), source, true); err != nil {
+					var limitErr *connectionLimitError
+					if errors.As(err, &limitErr) {
+						refuseStream(ctx, err)
+					}
+					return
+				}
+				session, _ = c.hlsSessions.open(opened, time.Now())
+			}
+			release = nil
+
+			body := proxyHlsTokens(string(b), session.token)
+			body = proxyHlsBody(body, source, user, upstreamChannel, proxyChannel)
 
 			mergeHttpHeader(ctx.Writer.Header(), hlsResp.Header)
 
@@ -544,3 +744,17 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 
 	ctx.Status(resp.StatusCode)
 }
+
+// proxyHlsBody replaces the source credentials and the upstream channel ID
+// of the chunk urls of an hls playlist by the user credentials and the proxyfied channel ID.
+func proxyHlsBody(body string, source *config.Source, user *config.User, upstreamChannel, proxyChannel string) string {
+	sourceCreds := "/" + source.XtreamUser.String() + "/" + source.XtreamPassword.String() + "/"
+	userCreds := "/" + user.Username.String() + "/" + user.Password.String() + "/"
+
+	if upstreamChannel != proxyChannel {
+		body = strings.ReplaceAll(body, sourceCreds+upstreamChannel+"/", userCreds+proxyChannel+"/")
+		body = strings.ReplaceAll(body, "/"+upstreamChannel+"_", "/"+proxyChannel+"_")
+	}
+
+	return strings.ReplaceAll(body, sourceCreds, userCreds)
+}
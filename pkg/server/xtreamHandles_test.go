@@ -1,10 +1,108 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/cache"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
 )
 
 // TestPlaceholder prevents "testing imported but not used" error
 func TestPlaceholder(t *testing.T) {
 	// This test does nothing; it's here to keep the file valid until we add more tests.
 }
+
+func TestCachedXtreamM3uCoalesces(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"generated", nil},
+		{"failed", errors.New("upstream down")},
+	}
+
+	sources, err := config.NewSources(config.Source{Name: "provider", XtreamBaseURL: "http://upstream", XtreamUser: "u", XtreamPassword: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 10
+	for _, tt := range tests {
+		// Nothing is cached, a request missing the flight would generate again.
+		c := &Config{
+			ProxyConfig: &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080, Sources: sources},
+			cache:       cache.NewMemory(),
+		}
+
+		// The upstream is blocked until every request waits for the generation.
+		var calls int32
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		generate := func(context.Context) (*m3u.Playlist, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(entered)
+			}
+			<-release
+			return &m3u.Playlist{Tracks: []m3u.Track{{Name: "News", Length: -1, URI: "http://upstream/live/u/p/1.ts"}}}, tt.err
+		}
+
+		var wg, waiting sync.WaitGroup
+		errs := make([]error, requests)
+		call := func(i int) {
+			defer wg.Done()
+			waiting.Done()
+			_, errs[i] = c.sharedXtreamM3u("get.php", generate)
+		}
+		wg.Add(requests)
+		waiting.Add(requests)
+		go call(0)
+		<-entered
+		for i := 1; i < requests; i++ {
+			go call(i)
+		}
+		waiting.Wait()
+		// Let the last requests reach the flight.
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if calls != 1 {
+			t.Errorf("%s: generate called %d times, want 1", tt.name, calls)
+		}
+		for i, err := range errs {
+			if err != tt.err {
+				t.Errorf("%s: request %d error = %v, want %v", tt.name, i, err, tt.err)
+			}
+		}
+	}
+
+	// The shared m3u is proxyfied with the credentials of each user.
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{HostConfig: &config.HostConfiguration{Hostname: "proxy", Port: 8080}, AdvertisedPort: 8080, Sources: sources, M3UCacheExpiration: 1},
+		cache:       cache.NewMemory(),
+	}
+	generate := func(context.Context) (*m3u.Playlist, error) {
+		return &m3u.Playlist{Tracks: []m3u.Track{{Name: "News", Length: -1, URI: "http://upstream/live/u/p/1.ts"}}}, nil
+	}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/get.php", nil)
+		ctx.Set(userContextKey, &config.User{Username: config.CredentialString(fmt.Sprintf("user%d", i)), Password: "secret"})
+		c.cachedXtreamM3u(ctx, "get.php", generate)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), fmt.Sprintf("/user%d/secret/", i)) {
+			t.Errorf("request %d = %d %q, want the user credentials", i, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package ssdp advertises a UPnP device on the local network, so it is found without typing its address.
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// DefaultAddr is the SSDP multicast group.
+var DefaultAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// maxAge is how long, in seconds, the device is known after an advertisement,
+// it is advertised again twice as often.
+const maxAge = 1800
+
+// Device is an advertised UPnP device.
+type Device struct {
+	// Location is the url of the device description.
+	Location string
+	// UUID identifies the device.
+	UUID string
+	// Types are the device and service types, e.g urn:schemas-upnp-org:device:MediaServer:1.
+	Types []string
+	// Server is the SERVER header, e.g "Linux/1.0 UPnP/1.0 iptv-proxy/1.0".
+	Server string
+}
+
+// targets returns the search targets the device answers.
+func (d *Device) targets() []string {
+	return append([]string{"upnp:rootdevice", "uuid:" + d.UUID}, d.Types...)
+}
+
+func (d *Device) usn(target string) string {
+	if target == "uuid:"+d.UUID {
+		return target
+	}
+
+	return "uuid:" + d.UUID + "::" + target
+}
+
+// Responder answers the M-SEARCH requests of a device and notifies its presence on the group.
+type Responder struct {
+	device Device
+	group  *net.UDPAddr
+	ifaces []*net.Interface
+
+	conn *net.UDPConn
+	pc   *ipv4.PacketConn
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Listen joins the multicast group on the interfaces, on every multicast interface if none,
+// and starts advertising the device until Close.
+func Listen(device Device, group *net.UDPAddr, ifaces []*net.Interface) (*Responder, error) {
+	if len(ifaces) == 0 {
+		ifaces = multicastInterfaces()
+	}
+
+	var first *net.Interface
+	if len(ifaces) > 0 {
+		first = ifaces[0]
+	}
+	conn, err := net.ListenMulticastUDP("udp4", first, group)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := ipv4.NewPacketConn(conn)
+	var joined []*net.Interface
+	if first != nil {
+		joined = append(joined, first)
+		for _, ifi := range ifaces[1:] {
+			if err := pc.JoinGroup(ifi, group); err != nil {
+				log.Printf("[iptv-proxy] ERROR: ssdp: join %s: %v", ifi.Name, err)
+				continue
+			}
+			joined = append(joined, ifi)
+		}
+	}
+	pc.SetMulticastLoopback(true) // nolint: errcheck
+
+	r := &Responder{device: device, group: group, ifaces: joined, conn: conn, pc: pc, done: make(chan struct{})}
+	r.wg.Add(2)
+	go r.serve()
+	go r.advertise()
+
+	return r, nil
+}
+
+// multicastInterfaces returns the interfaces up with multicast.
+func multicastInterfaces() []*net.Interface {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var ifaces []*net.Interface
+	for i := range all {
+		if all[i].Flags&net.FlagUp != 0 && all[i].Flags&net.FlagMulticast != 0 {
+			ifaces = append(ifaces, &all[i])
+		}
+	}
+
+	return ifaces
+}
+
+// Close notifies the departure of the device and stops the responder.
+// It can be called more than once.
+func (r *Responder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.notify("ssdp:byebye")
+		r.closeErr = r.conn.Close()
+		r.wg.Wait()
+	})
+
+	return r.closeErr
+}
+
+// serve answers the M-SEARCH requests.
+func (r *Responder) serve() {
+	defer r.wg.Done()
+
+	b := make([]byte, 2048)
+	for {
+		n, src, err := r.conn.ReadFromUDP(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[iptv-proxy] ERROR: ssdp: %v", err)
+			continue
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+
+		st := req.Header.Get("St")
+		for _, target := range r.device.targets() {
+			if st != "ssdp:all" && st != target {
+				continue
+			}
+			resp := fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=%d\r\nEXT:\r\nLOCATION: %s\r\nSERVER: %s\r\nST: %s\r\nUSN: %s\r\n\r\n",
+				maxAge, r.device.Location, r.device.Server, target, r.device.usn(target))
+			if _, err := r.conn.WriteToUDP([]byte(resp), src); err != nil {
+				log.Printf("[iptv-proxy] ERROR: ssdp: answer %s: %v", src, err)
+			}
+		}
+	}
+}
+
+// advertise notifies the presence of the device now, then before it expires.
+func (r *Responder) advertise() {
+	defer r.wg.Done()
+
+	r.notify("ssdp:alive")
+
+	ticker := time.NewTicker(maxAge / 2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.notify("ssdp:alive")
+		}
+	}
+}
+
+// notify sends a NOTIFY of every target on every interface.
+func (r *Responder) notify(nts string) {
+	ifaces := r.ifaces
+	if len(ifaces) == 0 {
+		// The default multicast interface.
+		ifaces = []*net.Interface{nil}
+	}
+
+	for _, ifi := range ifaces {
+		if ifi != nil {
+			if err := r.pc.SetMulticastInterface(ifi); err != nil {
+				continue
+			}
+		}
+		for _, target := range r.device.targets() {
+			var msg strings.Builder
+			fmt.Fprintf(&msg, "NOTIFY * HTTP/1.1\r\nHOST: %s\r\nNT: %s\r\nNTS: %s\r\nUSN: %s\r\n", r.group, target, nts, r.device.usn(target))
+			if nts == "ssdp:alive" {
+				fmt.Fprintf(&msg, "CACHE-CONTROL: max-age=%d\r\nLOCATION: %s\r\nSERVER: %s\r\n", maxAge, r.device.Location, r.device.Server)
+			}
+			msg.WriteString("\r\n")
+
+			if _, err := r.conn.WriteToUDP([]byte(msg.String()), r.group); err != nil {
+				log.Printf("[iptv-proxy] ERROR: ssdp: notify: %v", err)
+			}
+		}
+	}
+}
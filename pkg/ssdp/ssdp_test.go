@@ -0,0 +1,119 @@
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// loopbackGroup returns the loopback interface and a multicast group on a free port.
+func loopbackGroup(t *testing.T) (*net.Interface, *net.UDPAddr) {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo *net.Interface
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 && ifaces[i].Flags&net.FlagUp != 0 {
+			lo = &ifaces[i]
+			break
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface")
+	}
+
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	c.Close()
+
+	return lo, &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: port}
+}
+
+// read returns the next message of conn accepted by keep.
+func read(t *testing.T, conn net.PacketConn, keep func(msg string) bool) string {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second)) // nolint: errcheck
+	b := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if msg := string(b[:n]); keep(msg) {
+			return msg
+		}
+	}
+}
+
+func TestResponder(t *testing.T) {
+	lo, group := loopbackGroup(t)
+
+	listener, err := net.ListenMulticastUDP("udp4", lo, group)
+	if err != nil {
+		t.Skipf("no multicast on %s: %v", lo.Name, err)
+	}
+	defer listener.Close()
+
+	device := Device{
+		Location: "http://192.168.1.2:8080/device.xml",
+		UUID:     "2f402f80-da50-11e1-9b23-001788255acc",
+		Types:    []string{"urn:schemas-upnp-org:device:MediaServer:1"},
+		Server:   "Linux/1.0 UPnP/1.0 iptv-proxy/1.0",
+	}
+	r, err := Listen(device, group, []*net.Interface{lo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alive := read(t, listener, func(msg string) bool {
+		return strings.Contains(msg, "NTS: ssdp:alive") && strings.Contains(msg, "NT: upnp:rootdevice")
+	})
+	if !strings.Contains(alive, "LOCATION: "+device.Location) {
+		t.Errorf("alive = %q, want location %s", alive, device.Location)
+	}
+
+	client, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	pc := ipv4.NewPacketConn(client)
+	if err := pc.SetMulticastInterface(lo); err != nil {
+		t.Fatal(err)
+	}
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: urn:schemas-upnp-org:device:MediaServer:1\r\n\r\n"
+	if _, err := client.WriteTo([]byte(search), group); err != nil {
+		t.Fatal(err)
+	}
+
+	answer := read(t, client, func(string) bool { return true })
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader([]byte(answer))), nil)
+	if err != nil {
+		t.Fatalf("answer %q: %v", answer, err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Location") != device.Location ||
+		resp.Header.Get("Usn") != "uuid:"+device.UUID+"::urn:schemas-upnp-org:device:MediaServer:1" {
+		t.Errorf("answer = %q", answer)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	read(t, listener, func(msg string) bool { return strings.Contains(msg, "NTS: ssdp:byebye") })
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+}
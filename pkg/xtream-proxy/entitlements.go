@@ -0,0 +1,202 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"context"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+// categoryContentType maps the category actions to their content type.
+var categoryContentType = map[string]string{
+	getLiveCategories:   config.ContentLive,
+	getVodCategories:    config.ContentVOD,
+	getSeriesCategories: config.ContentSeries,
+}
+
+func categoryID(id *int, ids []int) int {
+	if id != nil {
+		return *id
+	}
+	if len(ids) > 0 {
+		return ids[0]
+	}
+
+	return 0
+}
+
+func liveContent(s *xtream.LiveStream, groups map[int]string) config.Content {
+	id := categoryID(s.CategoryID, s.CategoryIDs)
+	content := config.Content{Type: config.ContentLive, Group: groups[id], CategoryID: id, StreamID: s.StreamID, Name: s.Name}
+	if s.EPGChannelID != nil {
+		content.EPGChannelID = *s.EPGChannelID
+	}
+	if s.HasCatchup {
+		content.CatchupDays = s.CatchupDurationDays
+	}
+
+	return content
+}
+
+func vodContent(s *xtream.VODStream, groups map[int]string) config.Content {
+	id := categoryID(s.CategoryID, s.CategoryIDs)
+	return config.Content{Type: config.ContentVOD, Group: groups[id], CategoryID: id, StreamID: s.StreamID, Name: s.Name}
+}
+
+func seriesContent(s *xtream.SeriesStream, groups map[int]string) config.Content {
+	id := categoryID(s.CategoryID, s.CategoryIDs)
+	return config.Content{Type: config.ContentSeries, Group: groups[id], CategoryID: id, StreamID: s.SeriesID, Name: s.Name}
+}
+
+// categoryNames returns the category names by proxyfied ID of a content type.
+func (c *Client) categoryNames(ctx context.Context, contentType string) (map[int]string, error) {
+	var (
+		categories []xtream.Category
+		err        error
+	)
+	switch contentType {
+	case config.ContentLive:
+		categories, err = c.ListLiveCategories(ctx)
+	case config.ContentVOD:
+		categories, err = c.ListVODCategories(ctx)
+	case config.ContentSeries:
+		categories, err = c.ListSeriesCategories(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int]string, len(categories))
+	for _, cat := range categories {
+		names[c.source.ProxyID(cat.CategoryID)] = cat.CategoryName
+	}
+
+	return names, nil
+}
+
+// Contents returns the whole live, vod and series catalogue by content type and proxyfied stream ID.
+func (c *Client) Contents(ctx context.Context) (map[string]map[int]config.Content, error) {
+	contents := map[string]map[int]config.Content{}
+	for _, contentType := range []string{config.ContentLive, config.ContentVOD, config.ContentSeries} {
+		groups, err := c.categoryNames(ctx, contentType)
+		if err != nil {
+			return nil, err
+		}
+
+		byID := map[int]config.Content{}
+		switch contentType {
+		case config.ContentLive:
+			streams, err := c.ListLiveStreams(ctx)
+			if err != nil {
+				return nil, err
+			}
+			streams, _ = c.proxyIDs(streams).([]xtream.LiveStream)
+			for i := range streams {
+				byID[streams[i].StreamID] = liveContent(&streams[i], groups)
+			}
+		case config.ContentVOD:
+			streams, err := c.ListVODStreams(ctx)
+			if err != nil {
+				return nil, err
+			}
+			streams, _ = c.proxyIDs(streams).([]xtream.VODStream)
+			for i := range streams {
+				byID[streams[i].StreamID] = vodContent(&streams[i], groups)
+			}
+		case config.ContentSeries:
+			streams, err := c.ListSeriesStreams(ctx)
+			if err != nil {
+				return nil, err
+			}
+			streams, _ = c.proxyIDs(streams).([]xtream.SeriesStream)
+			for i := range streams {
+				byID[streams[i].SeriesID] = seriesContent(&streams[i], groups)
+			}
+		}
+		contents[contentType] = byID
+	}
+
+	return contents, nil
+}
+
+// filterEntitled removes from an action response the entries the user is not entitled to.
+func (c *Client) filterEntitled(ctx context.Context, user *config.User, action string, resp interface{}) (interface{}, error) {
+	e := &user.Entitlements
+	if !e.IsRestricted() {
+		return resp, nil
+	}
+
+	groups := func(contentType string) (map[int]string, error) {
+		if !e.NeedsGroup() {
+			return nil, nil
+		}
+		return c.categoryNames(ctx, contentType)
+	}
+
+	switch v := resp.(type) {
+	case []xtream.Category:
+		filtered := make([]xtream.Category, 0, len(v))
+		for _, cat := range v {
+			if e.MayAllow(config.Content{Type: categoryContentType[action], Group: cat.CategoryName, CategoryID: cat.CategoryID}) {
+				filtered = append(filtered, cat)
+			}
+		}
+		return filtered, nil
+	case []xtream.LiveStream:
+		names, err := groups(config.ContentLive)
+		if err != nil {
+			return nil, err
+		}
+		filtered := make([]xtream.LiveStream, 0, len(v))
+		for i := range v {
+			if e.Allows(liveContent(&v[i], names)) {
+				filtered = append(filtered, v[i])
+			}
+		}
+		return filtered, nil
+	case []xtream.VODStream:
+		names, err := groups(config.ContentVOD)
+		if err != nil {
+			return nil, err
+		}
+		filtered := make([]xtream.VODStream, 0, len(v))
+		for i := range v {
+			if e.Allows(vodContent(&v[i], names)) {
+				filtered = append(filtered, v[i])
+			}
+		}
+		return filtered, nil
+	case []xtream.SeriesStream:
+		names, err := groups(config.ContentSeries)
+		if err != nil {
+			return nil, err
+		}
+		filtered := make([]xtream.SeriesStream, 0, len(v))
+		for i := range v {
+			if e.Allows(seriesContent(&v[i], names)) {
+				filtered = append(filtered, v[i])
+			}
+		}
+		return filtered, nil
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,355 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
+	"github.com/sherif-fanous/xmltv"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+// ErrNoSource is returned when there is no xtream source.
+var ErrNoSource = errors.New("no xtream source")
+
+// sourceParams are the ID parameters routing an action to a single source.
+var sourceParams = map[string]string{
+	getLiveStreams:     "category_id",
+	getVodStreams:      "category_id",
+	getSeries:          "category_id",
+	getVodInfo:         "vod_id",
+	getSerieInfo:       "series_id",
+	getShortEPG:        "stream_id",
+	getSimpleDataTable: "stream_id",
+}
+
+// mergedActions are the list actions merging the responses of every source.
+var mergedActions = map[string]bool{
+	getLiveCategories:   true,
+	getLiveStreams:      true,
+	getVodCategories:    true,
+	getVodStreams:       true,
+	getSeriesCategories: true,
+	getSeries:           true,
+}
+
+// Clients are the clients of the xtream sources, in their source index order.
+type Clients []*Client
+
+// NewClients returns the clients of the xtream sources.
+func NewClients(sources []*config.Source, userAgent string) (Clients, error) {
+	clients := make(Clients, 0, len(sources))
+	for _, s := range sources {
+		client, err := New(s, userAgent)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// Action executes an xtream action on the source owning the requested ID,
+// or on every source for the lists: a source failing is skipped, the list fails only when every source does.
+func (cs Clients) Action(ctx context.Context, config *config.ProxyConfig, user *config.User, action string, q url.Values) (respBody interface{}, httpcode int, contentType string, err error) {
+	if len(cs) == 0 {
+		return nil, http.StatusNotFound, "", utils.PrintErrorAndReturn(ErrNoSource)
+	}
+
+	if param, ok := sourceParams[action]; ok && q.Get(param) != "" {
+		client, upstreamQuery, err := cs.route(q, param)
+		if err != nil {
+			return nil, http.StatusNotFound, "", utils.PrintErrorAndReturn(err)
+		}
+		return client.Action(ctx, config, user, action, upstreamQuery)
+	}
+
+	if !mergedActions[action] {
+		return cs[0].Action(ctx, config, user, action, q)
+	}
+
+	merged := 0
+	var failedCode int
+	var failedType string
+	for _, client := range cs {
+		resp, code, ctype, actionErr := client.Action(ctx, config, user, action, q)
+		if actionErr != nil {
+			log.Printf("[iptv-proxy] ERROR: xtream source %q: %s: %v", client.source.Name, action, actionErr)
+			failedCode, failedType, err = code, ctype, actionErr
+			continue
+		}
+		httpcode, contentType = code, ctype
+		respBody = merge(respBody, resp)
+		merged++
+	}
+	if merged == 0 {
+		return nil, failedCode, failedType, err
+	}
+
+	return respBody, httpcode, contentType, nil
+}
+
+// route returns the client of the proxyfied ID of the param, and the query with the upstream ID.
+func (cs Clients) route(q url.Values, param string) (*Client, url.Values, error) {
+	id, err := strconv.Atoi(q.Get(param))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s %q", param, q.Get(param))
+	}
+
+	if len(cs) == 1 {
+		// The IDs of a single source are its upstream IDs.
+		return cs[0], q, nil
+	}
+
+	index, upstreamID := config.SplitSourceID(id)
+	if index < 0 || index >= len(cs) {
+		return nil, nil, fmt.Errorf("no xtream source for %s %d", param, id)
+	}
+
+	upstreamQuery := url.Values{}
+	for k, v := range q {
+		upstreamQuery[k] = v
+	}
+	upstreamQuery.Set(param, strconv.Itoa(upstreamID))
+
+	return cs[index], upstreamQuery, nil
+}
+
+// merge appends the resp list to the all list.
+func merge(all, resp interface{}) interface{} {
+	switch v := resp.(type) {
+	case []xtream.Category:
+		if a, ok := all.([]xtream.Category); ok {
+			return append(a, v...)
+		}
+	case []xtream.LiveStream:
+		if a, ok := all.([]xtream.LiveStream); ok {
+			return append(a, v...)
+		}
+	case []xtream.VODStream:
+		if a, ok := all.([]xtream.VODStream); ok {
+			return append(a, v...)
+		}
+	case []xtream.SeriesStream:
+		if a, ok := all.([]xtream.SeriesStream); ok {
+			return append(a, v...)
+		}
+	}
+
+	return resp
+}
+
+// Contents returns the merged catalogue of the sources,
+// a source failing is skipped unless every source does.
+func (cs Clients) Contents(ctx context.Context) (map[string]map[int]config.Content, error) {
+	contents := map[string]map[int]config.Content{}
+	merged := 0
+	var err error
+	for _, client := range cs {
+		c, contentsErr := client.Contents(ctx)
+		if contentsErr != nil {
+			err = fmt.Errorf("xtream source %q: %w", client.source.Name, contentsErr)
+			log.Printf("[iptv-proxy] ERROR: %v", err)
+			continue
+		}
+		merged++
+		for contentType, byID := range c {
+			if contents[contentType] == nil {
+				contents[contentType] = map[int]config.Content{}
+			}
+			for id, content := range byID {
+				contents[contentType][id] = content
+			}
+		}
+	}
+	if merged == 0 && err != nil {
+		return nil, err
+	}
+
+	return contents, nil
+}
+
+// GetXMLTV returns the merged XMLTV EPG of the sources,
+// a source failing is skipped unless every source does.
+func (cs Clients) GetXMLTV(ctx context.Context) (*xmltv.EPG, error) {
+	if len(cs) == 0 {
+		return nil, ErrNoSource
+	}
+
+	var epg *xmltv.EPG
+	var err error
+	for _, client := range cs {
+		e, epgErr := client.GetXMLTV(ctx)
+		if epgErr != nil {
+			err = fmt.Errorf("xtream source %q: %w", client.source.Name, epgErr)
+			log.Printf("[iptv-proxy] ERROR: %v", err)
+			continue
+		}
+		if epg == nil {
+			epg = e
+			continue
+		}
+		epg.Channels = append(epg.Channels, e.Channels...)
+		epg.Programmes = append(epg.Programmes, e.Programmes...)
+	}
+	if epg == nil {
+		return nil, err
+	}
+
+	return epg, nil
+}
+
+func (c *Client) proxyID(id *int) {
+	if id != nil && *id != 0 {
+		*id = c.source.ProxyID(*id)
+	}
+}
+
+func (c *Client) proxyCategoryIDs(id **int, ids []int) {
+	if *id != nil {
+		proxyID := c.source.ProxyID(**id)
+		*id = &proxyID
+	}
+	for i := range ids {
+		ids[i] = c.source.ProxyID(ids[i])
+	}
+}
+
+// validIDs reports whether the upstream ID and categories of a stream have proxyfied IDs.
+func (c *Client) validIDs(id int, categoryID *int, categoryIDs []int) bool {
+	if !c.source.ValidID(id) || (categoryID != nil && !c.source.ValidID(*categoryID)) {
+		return false
+	}
+
+	return !slices.ContainsFunc(categoryIDs, func(id int) bool { return !c.source.ValidID(id) })
+}
+
+// dropInvalidIDs removes the entries of an action response without proxyfied IDs.
+func (c *Client) dropInvalidIDs(resp interface{}) interface{} {
+	n := 0
+	switch v := resp.(type) {
+	case []xtream.Category:
+		n = len(v)
+		resp = slices.DeleteFunc(v, func(cat xtream.Category) bool { return !c.source.ValidID(cat.CategoryID) })
+		n -= len(resp.([]xtream.Category))
+	case []xtream.LiveStream:
+		n = len(v)
+		resp = slices.DeleteFunc(v, func(s xtream.LiveStream) bool { return !c.validIDs(s.StreamID, s.CategoryID, s.CategoryIDs) })
+		n -= len(resp.([]xtream.LiveStream))
+	case []xtream.VODStream:
+		n = len(v)
+		resp = slices.DeleteFunc(v, func(s xtream.VODStream) bool { return !c.validIDs(s.StreamID, s.CategoryID, s.CategoryIDs) })
+		n -= len(resp.([]xtream.VODStream))
+	case []xtream.SeriesStream:
+		n = len(v)
+		resp = slices.DeleteFunc(v, func(s xtream.SeriesStream) bool { return !c.validIDs(s.SeriesID, s.CategoryID, s.CategoryIDs) })
+		n -= len(resp.([]xtream.SeriesStream))
+	case *xtream.Series:
+		for season, episodes := range v.Episodes {
+			n += len(episodes)
+			v.Episodes[season] = slices.DeleteFunc(episodes, func(e xtream.Episode) bool { return !c.source.ValidID(e.ID) })
+			n -= len(v.Episodes[season])
+		}
+	}
+	if n > 0 {
+		log.Printf("[iptv-proxy] %v | source %q: %d entries skipped, their IDs aren't below %d\n", time.Now().Format("2006/01/02 - 15:04:05"), c.source.Name, n, config.SourceIDStride)
+	}
+
+	return resp
+}
+
+// proxyIDs replaces the upstream IDs of an action response by the proxyfied IDs.
+// The entries without proxyfied IDs are removed from the lists shared with other sources.
+func (c *Client) proxyIDs(resp interface{}) interface{} {
+	if !c.source.SharesIDs() {
+		return resp
+	}
+	resp = c.dropInvalidIDs(resp)
+	if c.source.ProxyID(0) == 0 {
+		return resp
+	}
+
+	switch v := resp.(type) {
+	case []xtream.Category:
+		for i := range v {
+			c.proxyID(&v[i].CategoryID)
+			c.proxyID(&v[i].ParentCategoryID)
+		}
+	case []xtream.LiveStream:
+		for i := range v {
+			c.proxyID(&v[i].StreamID)
+			c.proxyCategoryIDs(&v[i].CategoryID, v[i].CategoryIDs)
+		}
+	case []xtream.VODStream:
+		for i := range v {
+			c.proxyID(&v[i].StreamID)
+			c.proxyCategoryIDs(&v[i].CategoryID, v[i].CategoryIDs)
+		}
+	case []xtream.SeriesStream:
+		for i := range v {
+			c.proxyID(&v[i].SeriesID)
+			c.proxyCategoryIDs(&v[i].CategoryID, v[i].CategoryIDs)
+		}
+	case *xtream.VOD:
+		c.proxyID(&v.MovieData.StreamID)
+		c.proxyCategoryIDs(&v.MovieData.CategoryID, v.MovieData.CategoryIDs)
+	case *xtream.Series:
+		c.proxyCategoryIDs(&v.Info.CategoryID, v.Info.CategoryIDs)
+		for _, episodes := range v.Episodes {
+			for i := range episodes {
+				c.proxyID(&episodes[i].ID)
+			}
+		}
+	case *xtream.EPG:
+		for i := range v.EPGListings {
+			c.proxyID(v.EPGListings[i].StreamID)
+		}
+	}
+
+	return resp
+}
+
+// shiftEPG corrects the programme times of an EPG response with the guide shift of the source.
+func (c *Client) shiftEPG(resp interface{}) {
+	v, ok := resp.(*xtream.EPG)
+	if !ok {
+		return
+	}
+
+	for i := range v.EPGListings {
+		l := &v.EPGListings[i]
+		shift := c.source.EPGShiftOf(l.ChannelID)
+		for _, t := range []*time.Time{&l.StartTimestamp, &l.StopTimestamp, &l.StartDateTime, &l.EndDateTime} {
+			if !t.IsZero() {
+				*t = t.Add(shift)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package xtreamproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	xtream "github.com/sherif-fanous/xtreamcodes"
+)
+
+func TestShiftEPG(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	stop := start.Add(time.Hour)
+	channels := map[string]string{"1": "tf1.fr", "2": "bbc1.uk"}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch q.Get("action") {
+		case "get_short_epg", "get_simple_data_table":
+			fmt.Fprintf(w, `{"epg_listings":[{"id":"1","epg_id":"1","title":"TmV3cw==","lang":"en","start":%q,"end":%q,"description":"","channel_id":%q,"start_timestamp":"%d","stop_timestamp":"%d"}]}`,
+				start.Format(time.DateTime), stop.Format(time.DateTime), channels[q.Get("stream_id")], start.Unix(), stop.Unix())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	sources, err := config.NewSources(config.Source{
+		Name:             "provider",
+		XtreamBaseURL:    upstream.URL,
+		XtreamUser:       "user",
+		XtreamPassword:   "pass",
+		EPGShift:         -time.Hour,
+		EPGChannelShifts: map[string]time.Duration{"tf1.fr": 30 * time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(sources[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		action   string
+		streamID string
+		shift    time.Duration
+	}{
+		{"get_short_epg", "1", 30 * time.Minute},
+		{"get_short_epg", "2", -time.Hour},
+		{"get_simple_data_table", "1", 30 * time.Minute},
+		{"get_simple_data_table", "2", -time.Hour},
+	}
+	for _, tt := range tests {
+		resp, _, _, err := client.Action(context.Background(), &config.ProxyConfig{}, &config.User{}, tt.action, url.Values{"stream_id": {tt.streamID}})
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.action, tt.streamID, err)
+		}
+		epg, ok := resp.(*xtream.EPG)
+		if !ok || len(epg.EPGListings) != 1 {
+			t.Fatalf("%s %s = %#v, want one listing", tt.action, tt.streamID, resp)
+		}
+
+		l := epg.EPGListings[0]
+		times := []struct {
+			name      string
+			got, want time.Time
+		}{
+			{"start_timestamp", l.StartTimestamp, start.Add(tt.shift)},
+			{"stop_timestamp", l.StopTimestamp, stop.Add(tt.shift)},
+			{"start", l.StartDateTime, start.Add(tt.shift)},
+			{"end", l.EndDateTime, stop.Add(tt.shift)},
+		}
+		for _, tm := range times {
+			if !tm.got.Equal(tm.want) {
+				t.Errorf("%s %s: %s = %v, want %v", tt.action, tt.streamID, tm.name, tm.got, tm.want)
+			}
+		}
+	}
+}
+
+func TestClientsIDRange(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("action") {
+		case "get_live_streams":
+			fmt.Fprint(w, `[{"num":1,"name":"small","stream_id":123,"category_id":"1"},{"num":2,"name":"large","stream_id":123456789,"category_id":"1"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	source := func(name string) config.Source {
+		return config.Source{Name: name, XtreamBaseURL: upstream.URL, XtreamUser: "user", XtreamPassword: "pass"}
+	}
+	tests := []struct {
+		name     string
+		sources  []config.Source
+		want     []int
+		upstream string
+	}{
+		{"single source", []config.Source{source("first")}, []int{123, 123456789}, "123456789"},
+		{"shared IDs", []config.Source{source("first"), source("second")}, []int{123, 100000123}, "123"},
+	}
+	for _, tt := range tests {
+		sources, err := config.NewSources(tt.sources...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients, err := NewClients(sources, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, _, _, err := clients.Action(context.Background(), &config.ProxyConfig{}, &config.User{}, "get_live_streams", url.Values{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []int
+		for _, s := range resp.([]xtream.LiveStream) {
+			got = append(got, s.StreamID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: stream IDs = %v, want %v", tt.name, got, tt.want)
+		}
+
+		last := fmt.Sprint(tt.want[len(tt.want)-1])
+		client, q, err := clients.route(url.Values{"stream_id": {last}}, "stream_id")
+		if err != nil {
+			t.Fatalf("%s: route(%s): %v", tt.name, last, err)
+		}
+		if client != clients[len(clients)-1] || q.Get("stream_id") != tt.upstream {
+			t.Errorf("%s: route(%s) = %s %s, want %s %s", tt.name, last, client.source.Name, q.Get("stream_id"), clients[len(clients)-1].source.Name, tt.upstream)
+		}
+	}
+}
+
+func TestClientsSourceFailure(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("action") {
+		case "get_live_streams":
+			fmt.Fprint(w, `[{"num":1,"name":"news","stream_id":123,"category_id":"1"}]`)
+		case "get_live_categories", "get_vod_categories", "get_series_categories":
+			fmt.Fprint(w, `[{"category_id":"1","category_name":"all","parent_id":0}]`)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	clients := func(urls ...string) Clients {
+		t.Helper()
+		var list []config.Source
+		for i, u := range urls {
+			list = append(list, config.Source{Name: fmt.Sprint("provider", i), XtreamBaseURL: u, XtreamUser: "user", XtreamPassword: "pass"})
+		}
+		sources, err := config.NewSources(list...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs, err := NewClients(sources, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+	ctx := context.Background()
+
+	cs := clients(down.URL, up.URL)
+	resp, _, _, err := cs.Action(ctx, &config.ProxyConfig{}, &config.User{}, "get_live_streams", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams := resp.([]xtream.LiveStream); len(streams) != 1 || streams[0].StreamID != 100000123 {
+		t.Errorf("get_live_streams = %+v, want the stream of the second source", streams)
+	}
+	contents, err := cs.Contents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := contents[config.ContentLive][100000123]; !ok || len(contents[config.ContentLive]) != 1 {
+		t.Errorf("Contents() live = %v, want the stream of the second source", contents[config.ContentLive])
+	}
+
+	cs = clients(down.URL, down.URL)
+	if _, _, _, err := cs.Action(ctx, &config.ProxyConfig{}, &config.User{}, "get_live_streams", url.Values{}); err == nil {
+		t.Error("get_live_streams of failing sources: want an error")
+	}
+	if _, err := cs.Contents(ctx); err == nil {
+		t.Error("Contents() of failing sources: want an error")
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/utils"
@@ -50,17 +51,20 @@ const (
 // Client represent an xtream client
 type Client struct {
 	*xtream.Client
+	source    *config.Source
 	baseURL   string
 	username  string
 	password  string
 	userAgent string
 }
 
-// New new xtream client
-func New(user, password, baseURL, userAgent string) (*Client, error) {
+// New new xtream client of an xtream source
+func New(source *config.Source, userAgent string) (*Client, error) {
+	user, password, baseURL := source.XtreamUser.String(), source.XtreamPassword.String(), source.XtreamBaseURL
 	cli := xtream.NewClient(baseURL, user, password, xtream.WithUserAgent(userAgent))
 	return &Client{
 		Client:    cli,
+		source:    source,
 		baseURL:   baseURL,
 		username:  user,
 		password:  password,
@@ -74,7 +78,7 @@ type login struct {
 }
 
 // Login xtream login
-func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int, protocol string) (login, error) {
+func (c *Client) login(ctx context.Context, proxyUser *config.User, proxyURL string, proxyPort int, protocol string) (login, error) {
 	// Note: The new library returns specific types. We need to map them back to what the proxy expects
 	// or update the proxy to use the new types.
 	// This function seems to construct a response object to return to the client.
@@ -88,20 +92,24 @@ func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int,
 	// The original code accessed c.UserInfo. It seems the old client struct exposed the UserInfo directly?
 	// The new Client struct doesn't expose UserInfo/ServerInfo directly. We have to fetch it.
 
-	ctx := context.Background()
 	authInfo, err := c.GetAuthInfo(ctx)
 	if err != nil {
 		return login{}, err
 	}
 
+	expiresAt := authInfo.UserInfo.ExpiresAt
+	if !proxyUser.ExpiresAt.IsZero() && (expiresAt.IsZero() || proxyUser.ExpiresAt.Before(expiresAt)) {
+		expiresAt = proxyUser.ExpiresAt
+	}
+
 	req := login{
 		UserInfo: xtream.UserInfo{
-			Username:             proxyUser,
-			Password:             proxyPassword,
+			Username:             proxyUser.Username.String(),
+			Password:             proxyUser.Password.String(),
 			Message:              authInfo.UserInfo.Message,
 			IsAuthorized:         authInfo.UserInfo.IsAuthorized, // Mapped from Auth
 			Status:               authInfo.UserInfo.Status,
-			ExpiresAt:            authInfo.UserInfo.ExpiresAt, // Mapped from ExpDate
+			ExpiresAt:            expiresAt, // Mapped from ExpDate, the proxy account can expire sooner
 			IsTrial:              authInfo.UserInfo.IsTrial,
 			ActiveConnections:    authInfo.UserInfo.ActiveConnections,
 			CreatedAt:            authInfo.UserInfo.CreatedAt,
@@ -123,8 +131,8 @@ func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int,
 	return req, nil
 }
 
-// Action execute an xtream action.
-func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values) (respBody interface{}, httpcode int, contentType string, err error) {
+// Action execute an xtream action, the upstream requests are cancelled with ctx.
+func (c *Client) Action(ctx context.Context, config *config.ProxyConfig, user *config.User, action string, q url.Values) (respBody interface{}, httpcode int, contentType string, err error) {
 	protocol := "http"
 	if config.HTTPS {
 		protocol = "https"
@@ -132,7 +140,6 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 
 	// Default content type for most responses
 	contentType = "application/json"
-	ctx := context.Background()
 
 	switch action {
 	case getLiveCategories:
@@ -248,12 +255,22 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 			err = utils.PrintErrorAndReturn(err)
 		}
 	default:
-		respBody, err = c.login(config.User.String(), config.Password.String(), protocol+"://"+config.HostConfig.Hostname, config.AdvertisedPort, protocol)
+		respBody, err = c.login(ctx, user, protocol+"://"+config.HostConfig.Hostname, config.AdvertisedPort, protocol)
 		if err != nil {
 			err = utils.PrintErrorAndReturn(err)
 		}
 	}
 
+	if err == nil {
+		respBody = c.proxyIDs(respBody)
+		c.shiftEPG(respBody)
+		respBody, err = c.filterEntitled(ctx, user, action, respBody)
+		if err != nil {
+			httpcode = http.StatusInternalServerError
+			err = utils.PrintErrorAndReturn(err)
+		}
+	}
+
 	return
 }
 
@@ -268,11 +285,19 @@ func validateParams(u url.Values, params ...string) (int, error) {
 	return 0, nil
 }
 
-// GetXMLTV retrieves the XMLTV EPG data.
-// Overrides the default xtream.Client.GetXMLTV method to handle date parsing issues.
-func (c *Client) GetXMLTV(ctx context.Context) (*xmltv.EPG, error) {
-	// 1. Construct the URL manually as we need to customize the request or handle raw response
-	// The original client uses internal buildURL logic which we can replicate simply.
+// xmltvClient downloads the XMLTV guides, a whole guide can take minutes to download
+// so only the response headers have a deadline.
+var xmltvClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// OpenXMLTV returns the raw XMLTV EPG data, the caller closes it.
+func (c *Client) OpenXMLTV(ctx context.Context) (io.ReadCloser, error) {
 	u, err := url.Parse(c.baseURL)
 	if err != nil {
 		return nil, err
@@ -284,42 +309,49 @@ func (c *Client) GetXMLTV(ctx context.Context) (*xmltv.EPG, error) {
 	q.Set("password", c.password)
 	u.RawQuery = q.Encode()
 
-	// 2. Create Request
 	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("User-Agent", c.userAgent)
 
-	// 3. Execute Request
-	// Note: We use default client here, ideally we should reuse the one from xtream.Client but it is unexported.
-	// We can create a new one.
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := xmltvClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() // nolint: errcheck
 		return nil, fmt.Errorf("XMLTV request failed with status: %d", resp.StatusCode)
 	}
 
-	// 4. Read Body
-	bodyBytes, err := io.ReadAll(resp.Body)
+	return resp.Body, nil
+}
+
+// GetXMLTV retrieves the XMLTV EPG data.
+// Overrides the default xtream.Client.GetXMLTV method to handle date parsing issues.
+func (c *Client) GetXMLTV(ctx context.Context) (*xmltv.EPG, error) {
+	body, err := c.OpenXMLTV(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	// Read Body
+	bodyBytes, err := io.ReadAll(body)
 	if err != nil {
 		return nil, err
 	}
 
 	bodyStr := string(bodyBytes)
 
-	// 5. Sanitize Body
+	// Sanitize Body
 	// Replace <date>YYYY</date> with <date>YYYY0101</date>
 	// Case insensitive just in case
 	re := regexp.MustCompile(`(?i)<date>\s*(\d{4})\s*</date>`)
 	fixedBodyStr := re.ReplaceAllString(bodyStr, "<date>${1}0101</date>")
 
-	// 6. Decode XML
+	// Decode XML
 	var epg xmltv.EPG
 	if err := xml.Unmarshal([]byte(fixedBodyStr), &epg); err != nil {
 		return nil, fmt.Errorf("failed to decode XMLTV response: %w", err)